@@ -1,13 +1,15 @@
 package blockchain
 
 import (
-	"fmt"
 	"sync"
 
+	"github.com/vquelque/Peerster/logger"
 	"github.com/vquelque/Peerster/message"
 	"github.com/vquelque/Peerster/utils"
 )
 
+var tlcLog = logger.New("tlc")
+
 type Blocks struct {
 	Blocks   map[utils.SHA256]*message.BlockPublish
 	PrevHash utils.SHA256
@@ -120,8 +122,8 @@ func (b *Blockchain) TryAcceptTLC(tlc *message.TLCMessage) {
 	b.PendingTLC.Lock.Lock()
 	id := b.IdForTLCVector(tlc.VectorClock)
 	b.PendingTLC.PengindTLCForClock[id] = tlc
-	fmt.Printf("TRY ACCEPT THIS VEC : %v, OTHER VEC : %v\n", b.TLCRoundVector.TLCRoundForPeer, tlc.VectorClock)
-	fmt.Printf("isInSync : %v \n", b.IsInSync(tlc.VectorClock))
+	tlcLog.Tracef("TRY ACCEPT THIS VEC : %v, OTHER VEC : %v\n", b.TLCRoundVector.TLCRoundForPeer, tlc.VectorClock)
+	tlcLog.Tracef("isInSync : %v \n", b.IsInSync(tlc.VectorClock))
 	b.PendingTLC.Lock.Unlock()
 	b.Accept(tlc)
 }
@@ -133,7 +135,7 @@ func (b *Blockchain) Accept(tlc *message.TLCMessage) {
 	defer b.PendingTLC.Lock.Unlock()
 	hash := tlc.TxBlock.Transaction.Hash()
 	if _, pending := b.PendingTLC.PendingTLC[hash]; pending {
-		fmt.Printf("ACCEPTING BLOCK WITH Hash : %x\n", hash)
+		tlcLog.Tracef("ACCEPTING BLOCK WITH Hash : %x\n", hash)
 		select {
 		case b.PendingBlocks.ConfirmedTLC <- tlc:
 		default:
@@ -0,0 +1,167 @@
+package clock
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the gossiper timers and of the simulated network.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func())
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers the time on C every period, like time.Ticker. Ticks are dropped
+// while the previous one was not received.
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// Real is the clock of the time package.
+type Real struct{}
+
+func (Real) Now() time.Time { return time.Now() }
+
+func (Real) AfterFunc(d time.Duration, f func()) { time.AfterFunc(d, f) }
+
+func (Real) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// Manual is a clock that only advances when Advance is called. Scheduled functions
+// and ticks run in deadline order (insertion order for equal deadlines), which makes
+// the timers and the packet deliveries of a simulation fully deterministic.
+type Manual struct {
+	now   time.Time
+	seq   uint64
+	queue scheduledQueue
+	lock  sync.Mutex
+}
+
+type scheduled struct {
+	at  time.Time
+	seq uint64
+	f   func()
+}
+
+type scheduledQueue []*scheduled
+
+func (q scheduledQueue) Len() int { return len(q) }
+func (q scheduledQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q scheduledQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *scheduledQueue) Push(x interface{}) { *q = append(*q, x.(*scheduled)) }
+func (q *scheduledQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	s := old[n-1]
+	*q = old[:n-1]
+	return s
+}
+
+// NewManual returns a manual clock starting at the given time.
+func NewManual(start time.Time) *Manual {
+	return &Manual{now: start}
+}
+
+// Now returns the current virtual time.
+func (c *Manual) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// AfterFunc schedules f to run once the clock has been advanced by d.
+func (c *Manual) AfterFunc(d time.Duration, f func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	heap.Push(&c.queue, &scheduled{at: c.now.Add(d), seq: c.seq, f: f})
+}
+
+// NewTicker returns a ticker firing each time the clock is advanced past its period.
+func (c *Manual) NewTicker(d time.Duration) Ticker {
+	t := &manualTicker{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d and runs every function that became due.
+func (c *Manual) Advance(d time.Duration) {
+	c.lock.Lock()
+	target := c.now.Add(d)
+	for len(c.queue) > 0 && !c.queue[0].at.After(target) {
+		s := heap.Pop(&c.queue).(*scheduled)
+		c.now = s.at
+		// release the lock so that f may schedule new functions
+		c.lock.Unlock()
+		s.f()
+		c.lock.Lock()
+	}
+	c.now = target
+	c.lock.Unlock()
+}
+
+// Pending returns the number of scheduled functions that did not run yet, including
+// the next tick of the tickers.
+func (c *Manual) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.queue)
+}
+
+type manualTicker struct {
+	clock  *Manual
+	c      chan time.Time
+	period time.Duration
+	gen    uint64 //incremented by Reset and Stop to cancel the scheduled tick
+	lock   sync.Mutex
+}
+
+func (t *manualTicker) C() <-chan time.Time { return t.c }
+
+func (t *manualTicker) Reset(d time.Duration) {
+	t.lock.Lock()
+	t.gen++
+	t.period = d
+	gen := t.gen
+	t.lock.Unlock()
+	t.schedule(gen, d)
+}
+
+func (t *manualTicker) Stop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.gen++
+}
+
+func (t *manualTicker) schedule(gen uint64, d time.Duration) {
+	t.clock.AfterFunc(d, func() { t.tick(gen) })
+}
+
+func (t *manualTicker) tick(gen uint64) {
+	t.lock.Lock()
+	if gen != t.gen {
+		t.lock.Unlock()
+		return
+	}
+	period := t.period
+	t.lock.Unlock()
+	select {
+	case t.c <- t.clock.Now():
+	default:
+	}
+	t.schedule(gen, period)
+}
@@ -0,0 +1,479 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/vquelque/Peerster/constant"
+	"github.com/vquelque/Peerster/logger"
+)
+
+// Config describes a gossiper. It is loaded from a JSON file and the command line
+// flags override its fields. The json keys are the names of the flags.
+type Config struct {
+	Name       string    `json:"name"`
+	GossipAddr string    `json:"gossipAddr"`
+	UIPort     int       `json:"UIPort"`
+	UIServer   bool      `json:"uisrv"`
+	Peers      []string  `json:"peers"`
+	Simple     bool      `json:"simple"`
+	Transport  string    `json:"transport"`
+	HopLimit   uint32    `json:"hopLimit"`          //of the private messages, data and search replies
+	Compress   int       `json:"compressThreshold"` //in bytes. Larger packets are compressed for the peers supporting it. 0 disables
+	Seed       int64     `json:"seed"`              //of the random choices of the gossiper, to replay a simulation. 0 seeds from the clock
+	Timers     Timers    `json:"timers"`
+	Private    Private   `json:"private"`
+	Files      Files     `json:"files"`
+	Search     Search    `json:"search"`
+	Consensus  Consensus `json:"consensus"`
+	Log        Log       `json:"log"`
+	Workers    Workers   `json:"workers"`
+	Limits     Limits    `json:"limits"`
+
+	// Profiles are partial configurations applied on top of the file, selected with -profile.
+	Profiles map[string]json.RawMessage `json:"profiles,omitempty"`
+}
+
+// Timers are in seconds unless stated otherwise. 0 disables the periodic ones.
+type Timers struct {
+	AntiEntropy          int `json:"antiEntropy"`
+	RTimer               int `json:"rtimer"`
+	Heartbeat            int `json:"heartbeat"`
+	AckTimeout           int `json:"ackTimeout"` //of the rumor mongering
+	DataRequestTimeout   int `json:"dataRequestTimeout"`
+	SearchRequestTimeout int `json:"searchRequestTimeout"` //in ms. Time between two duplicate search requests
+	SearchResendTimer    int `json:"searchResendTimer"`
+	RouteTimeout         int `json:"routeTimeout"`
+	NeighborTimeout      int `json:"neighborTimeout"`
+	PeerEvictTimeout     int `json:"peerEvictTimeout"`
+}
+
+// Private configures the reliable delivery of the private messages.
+type Private struct {
+	AckTimeout         int `json:"ackTimeout"` //in seconds. Doubled after each retransmission
+	MaxRetransmissions int `json:"maxRetransmissions"`
+}
+
+// Files configures the file sharing.
+type Files struct {
+	DataDir               string `json:"dataDir"` //chunks and state persisted across restarts. Kept in memory if empty
+	CacheChunks           bool   `json:"cacheChunks"`
+	KeyFile               string `json:"keyFile"` //identity key. Defaults to identity.key in dataDir, else to ~/.peerster/<name>.key
+	SharedDir             string `json:"sharedDir"`
+	DownloadDir           string `json:"downloadDir"`
+	ChunkSize             int    `json:"chunkSize"` //in bytes. Average size of the content defined chunks
+	Chunking              string `json:"chunking"`  //fixed or cdc (content defined)
+	MinChunkSize          int    `json:"minChunkSize"`
+	MaxChunkSize          int    `json:"maxChunkSize"`
+	DownloadWindow        int    `json:"downloadWindow"`
+	MaxChunkDownloadTries int    `json:"maxChunkDownloadTries"`
+	ChunkRequestTries     int    `json:"chunkRequestTries"`
+}
+
+// Search configures the expanding ring file search.
+type Search struct {
+	MaxBudget      uint64 `json:"maxBudget"`
+	MatchThreshold int    `json:"matchThreshold"` //full matches ending a search
+	MaxRetries     int    `json:"maxRetries"`
+}
+
+// Consensus configures the blockchain of the names of the shared files. The hw3ex
+// settings are independent and can be combined, as the flags of the same name.
+type Consensus struct {
+	HW3ex2          bool   `json:"hw3ex2"` //names published on the blockchain without TLC rounds
+	HW3ex3          bool   `json:"hw3ex3"` //names published with TLC rounds
+	HW3ex4          bool   `json:"hw3ex4"`
+	PeersNumber     uint64 `json:"N"`
+	StubbornTimeout int    `json:"stubbornTimeout"` //in seconds
+	AckAll          bool   `json:"ackAll"`
+	HopLimit        uint32 `json:"hoplimit"` //of the TLC acks
+}
+
+// Log configures the logs and the protocol trace.
+type Log struct {
+	Level string `json:"level"`
+	JSON  bool   `json:"json"`
+	Trace bool   `json:"trace"`
+}
+
+// Workers configures the pools processing the packets received from the peers, one per
+// class of packets so that bulk transfers do not delay the control traffic, and the pool
+// processing the client messages.
+type Workers struct {
+	Control Pool `json:"control"` //status packets and acks
+	Gossip  Pool `json:"gossip"`  //rumors, TLC and private messages
+	Search  Pool `json:"search"`
+	Data    Pool `json:"data"`   //data requests and replies
+	Client  Pool `json:"client"` //messages of the client and the web UI
+}
+
+// Pool is the number of workers of a pool and the number of packets waiting for them
+// before new ones are dropped.
+type Pool struct {
+	Workers int `json:"workers"`
+	Queue   int `json:"queue"`
+}
+
+// Limits protects the gossiper from the peers sending too many or too large packets.
+// Packets over the limits are dropped, and a source exceeding the limits too often is
+// banned for a while.
+type Limits struct {
+	Rates        map[string]Rate `json:"rates"`        //packet type -> limit per source address and per origin. Unlimited if absent
+	MaxTextSize  int             `json:"maxTextSize"`  //in bytes, of the rumors and private messages. 0 for no limit
+	MaxKeywords  int             `json:"maxKeywords"`  //of a search request. 0 for no limit
+	BanThreshold int             `json:"banThreshold"` //packets over the limits in a minute before the source is banned. 0 never bans
+	BanDuration  int             `json:"banDuration"`  //in seconds
+}
+
+// Rate is a token bucket refilled with PerSecond tokens every second up to Burst.
+type Rate struct {
+	PerSecond float64 `json:"perSecond"`
+	Burst     int     `json:"burst"`
+}
+
+// PacketTypes are the types of the gossip packets, as named in the rate limits and the
+// metrics.
+var PacketTypes = []string{"simple", "rumor", "status", "private", "data_request", "data_reply", "search_request",
+	"search_reply", "tlc", "tlc_ack", "encrypted_private", "private_ack", "hello"}
+
+// defaultRates returns the default limit of each packet type, by class of packets.
+func defaultRates() map[string]Rate {
+	control := Rate{PerSecond: constant.ControlRate, Burst: constant.ControlBurst}
+	gossip := Rate{PerSecond: constant.GossipRate, Burst: constant.GossipBurst}
+	search := Rate{PerSecond: constant.SearchRate, Burst: constant.SearchBurst}
+	data := Rate{PerSecond: constant.DataRate, Burst: constant.DataBurst}
+	return map[string]Rate{
+		"simple": gossip, "rumor": gossip, "tlc": gossip, "private": gossip, "encrypted_private": gossip,
+		"status": control, "tlc_ack": control, "private_ack": control, "hello": control,
+		"search_request": search, "search_reply": search,
+		"data_request": data, "data_reply": data,
+	}
+}
+
+// maximum chunk size for a data reply to fit in a packet
+const maxChunkSize = 32 * 1024
+
+// minimum size of the content defined chunks : the rolling hash covers the last 64 bytes
+const minCDCChunkSize = 64
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		UIPort:    8080,
+		Peers:     []string{},
+		Transport: constant.TransportUDP,
+		HopLimit:  constant.DefaultHopLimit,
+		Compress:  constant.CompressThreshold,
+		Timers: Timers{
+			AntiEntropy:          constant.DefaultAntiEntropy,
+			Heartbeat:            constant.DefaultHeartbeatInterval,
+			AckTimeout:           constant.AckTimeout,
+			DataRequestTimeout:   constant.Timeout,
+			SearchRequestTimeout: constant.SearchRequestTimeout,
+			SearchResendTimer:    constant.SearchRequestResendTimer,
+			RouteTimeout:         constant.RouteTimeout,
+			NeighborTimeout:      constant.NeighborTimeout,
+			PeerEvictTimeout:     constant.PeerEvictTimeout,
+		},
+		Private: Private{
+			AckTimeout:         constant.PrivateAckTimeout,
+			MaxRetransmissions: constant.PrivateMaxRetransmissions,
+		},
+		Files: Files{
+			SharedDir:             constant.FileTempDirectory,
+			DownloadDir:           constant.FileOutDirectory,
+			ChunkSize:             constant.ChunkSize,
+			Chunking:              constant.ChunkingFixed,
+			MinChunkSize:          constant.MinChunkSize,
+			MaxChunkSize:          constant.MaxChunkSize,
+			DownloadWindow:        constant.DefaultDownloadWindow,
+			MaxChunkDownloadTries: constant.MaxChunkDownloadTries,
+			ChunkRequestTries:     constant.ChunkRequestTries,
+		},
+		Search: Search{
+			MaxBudget:      constant.MaxBudget,
+			MatchThreshold: constant.SearchMatchThreshold,
+			MaxRetries:     constant.SearchRequestMaxRetries,
+		},
+		Consensus: Consensus{
+			StubbornTimeout: constant.DefaultStubbornTimeout,
+			HopLimit:        constant.DefaultHopLimit,
+		},
+		Log: Log{
+			Level: "info",
+			Trace: true,
+		},
+		Workers: Workers{
+			Control: Pool{Workers: constant.ControlWorkers, Queue: constant.ControlQueueSize},
+			Gossip:  Pool{Workers: constant.GossipWorkers, Queue: constant.GossipQueueSize},
+			Search:  Pool{Workers: constant.SearchWorkers, Queue: constant.SearchQueueSize},
+			Data:    Pool{Workers: constant.DataWorkers, Queue: constant.DataQueueSize},
+			Client:  Pool{Workers: constant.ClientWorkers, Queue: constant.ClientQueueSize},
+		},
+		Limits: Limits{
+			Rates:        defaultRates(),
+			MaxTextSize:  constant.MaxTextSize,
+			MaxKeywords:  constant.MaxKeywords,
+			BanThreshold: constant.BanThreshold,
+			BanDuration:  constant.BanDuration,
+		},
+	}
+}
+
+// Load reads the configuration file at path on top of the default configuration and
+// applies the given profile if not empty. The result must be validated once the flags
+// are applied.
+func Load(path string, profile string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s : %v", path, err)
+		}
+	}
+	if profile != "" {
+		raw, found := cfg.Profiles[profile]
+		if !found {
+			return nil, fmt.Errorf("unknown profile %s", profile)
+		}
+		if err := json.Unmarshal(raw, cfg); err != nil {
+			return nil, fmt.Errorf("profile %s : %v", profile, err)
+		}
+	}
+	return cfg, nil
+}
+
+// SetPeers sets the peers from a comma separated list of addresses.
+func (cfg *Config) SetPeers(list string) {
+	cfg.Peers = []string{}
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			cfg.Peers = append(cfg.Peers, p)
+		}
+	}
+}
+
+// PeersList returns the peers as a comma separated list of addresses.
+func (cfg *Config) PeersList() string {
+	return strings.Join(cfg.Peers, ",")
+}
+
+// PublishNames checks if the names of the shared files are published on the blockchain.
+func (cfg *Config) PublishNames() bool {
+	return cfg.Consensus.HW3ex2 || cfg.Consensus.HW3ex3
+}
+
+// Validate checks that the configuration is usable.
+func (cfg *Config) Validate() error {
+	if cfg.GossipAddr == "" {
+		return fmt.Errorf("gossipAddr is required")
+	}
+	if _, _, err := net.SplitHostPort(cfg.GossipAddr); err != nil {
+		return fmt.Errorf("gossipAddr : %v", err)
+	}
+	if cfg.UIPort <= 0 || cfg.UIPort > 65535 {
+		return fmt.Errorf("invalid UIPort %d", cfg.UIPort)
+	}
+	for _, p := range cfg.Peers {
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			return fmt.Errorf("peer %s : %v", p, err)
+		}
+	}
+	if cfg.Transport != constant.TransportUDP && cfg.Transport != constant.TransportTCP {
+		return fmt.Errorf("unknown transport %s", cfg.Transport)
+	}
+	if cfg.HopLimit == 0 {
+		return fmt.Errorf("hopLimit must be positive")
+	}
+	if cfg.Compress < 0 {
+		return fmt.Errorf("compressThreshold must not be negative")
+	}
+	t := cfg.Timers
+	periodic := map[string]int{"antiEntropy": t.AntiEntropy, "rtimer": t.RTimer, "heartbeat": t.Heartbeat,
+		"routeTimeout": t.RouteTimeout, "neighborTimeout": t.NeighborTimeout, "peerEvictTimeout": t.PeerEvictTimeout}
+	for _, name := range sortedKeys(periodic) {
+		if periodic[name] < 0 {
+			return fmt.Errorf("timer %s must not be negative", name)
+		}
+	}
+	timeouts := map[string]int{"ackTimeout": t.AckTimeout, "dataRequestTimeout": t.DataRequestTimeout,
+		"searchRequestTimeout": t.SearchRequestTimeout, "searchResendTimer": t.SearchResendTimer, "private.ackTimeout": cfg.Private.AckTimeout}
+	for _, name := range sortedKeys(timeouts) {
+		if timeouts[name] <= 0 {
+			return fmt.Errorf("timer %s must be positive", name)
+		}
+	}
+	if cfg.Private.MaxRetransmissions < 0 {
+		return fmt.Errorf("private.maxRetransmissions must not be negative")
+	}
+	f := cfg.Files
+	if f.ChunkSize <= 0 || f.ChunkSize > maxChunkSize {
+		return fmt.Errorf("chunkSize must be between 1 and %d bytes", maxChunkSize)
+	}
+	switch f.Chunking {
+	case constant.ChunkingFixed:
+	case constant.ChunkingCDC:
+		if f.MinChunkSize < minCDCChunkSize || f.MinChunkSize > f.ChunkSize || f.ChunkSize > f.MaxChunkSize || f.MaxChunkSize > maxChunkSize {
+			return fmt.Errorf("content defined chunking requires %d <= minChunkSize <= chunkSize <= maxChunkSize <= %d", minCDCChunkSize, maxChunkSize)
+		}
+	default:
+		return fmt.Errorf("unknown chunking %s", f.Chunking)
+	}
+	if f.SharedDir == "" || f.DownloadDir == "" {
+		return fmt.Errorf("sharedDir and downloadDir are required")
+	}
+	if f.DownloadWindow <= 0 || f.MaxChunkDownloadTries <= 0 || f.ChunkRequestTries <= 0 {
+		return fmt.Errorf("downloadWindow, maxChunkDownloadTries and chunkRequestTries must be positive")
+	}
+	if cfg.Search.MaxBudget == 0 || cfg.Search.MatchThreshold <= 0 || cfg.Search.MaxRetries < 0 {
+		return fmt.Errorf("invalid search configuration")
+	}
+	if cfg.PublishNames() && cfg.Consensus.PeersNumber == 0 {
+		return fmt.Errorf("hw3ex2 and hw3ex3 require the number of peers N")
+	}
+	if cfg.Consensus.StubbornTimeout <= 0 {
+		return fmt.Errorf("stubbornTimeout must be positive")
+	}
+	if _, err := logger.ParseLevel(cfg.Log.Level); err != nil {
+		return err
+	}
+	w := cfg.Workers
+	for _, p := range []struct {
+		name string
+		pool Pool
+	}{{"control", w.Control}, {"gossip", w.Gossip}, {"search", w.Search}, {"data", w.Data}, {"client", w.Client}} {
+		if p.pool.Workers <= 0 || p.pool.Queue <= 0 {
+			return fmt.Errorf("workers.%s : workers and queue must be positive", p.name)
+		}
+	}
+	l := cfg.Limits
+	types := make(map[string]bool, len(PacketTypes))
+	for _, t := range PacketTypes {
+		types[t] = true
+	}
+	for _, t := range sortedRates(l.Rates) {
+		if !types[t] {
+			return fmt.Errorf("limits.rates : unknown packet type %s", t)
+		}
+		if l.Rates[t].PerSecond <= 0 || l.Rates[t].Burst <= 0 {
+			return fmt.Errorf("limits.rates.%s : perSecond and burst must be positive", t)
+		}
+	}
+	if l.MaxTextSize < 0 || l.MaxKeywords < 0 || l.BanThreshold < 0 {
+		return fmt.Errorf("limits : maxTextSize, maxKeywords and banThreshold must not be negative")
+	}
+	if l.BanThreshold > 0 && l.BanDuration <= 0 {
+		return fmt.Errorf("limits.banDuration must be positive")
+	}
+	return nil
+}
+
+// sortedRates returns the packet types of rates in order.
+func sortedRates(rates map[string]Rate) []string {
+	types := make([]string, 0, len(rates))
+	for t := range rates {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// sortedKeys returns the keys of m in order, so that the validation errors do not
+// depend on the iteration order of the map.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ApplyLog configures the loggers.
+func (cfg *Config) ApplyLog() {
+	level, err := logger.ParseLevel(cfg.Log.Level)
+	if err == nil {
+		logger.SetLevel("", level)
+	}
+	logger.SetJSON(cfg.Log.JSON)
+	if cfg.Log.Trace {
+		logger.SetTraceOutput(os.Stdout)
+	} else {
+		logger.SetTraceOutput(nil)
+	}
+}
+
+// KeepRestartSettings copies into cfg the settings of the running configuration that are
+// only read when the gossiper starts, and returns the ones that were changed.
+func (cfg *Config) KeepRestartSettings(running *Config) []string {
+	kept := make([]string, 0)
+	check := func(setting string, changed bool) {
+		if changed {
+			kept = append(kept, setting)
+		}
+	}
+	check("name", cfg.Name != running.Name)
+	check("gossipAddr", cfg.GossipAddr != running.GossipAddr)
+	check("UIPort", cfg.UIPort != running.UIPort)
+	check("uisrv", cfg.UIServer != running.UIServer)
+	check("simple", cfg.Simple != running.Simple)
+	check("transport", cfg.Transport != running.Transport)
+	check("timers.heartbeat", cfg.Timers.Heartbeat != running.Timers.Heartbeat)
+	check("timers.peerEvictTimeout", cfg.Timers.PeerEvictTimeout != running.Timers.PeerEvictTimeout)
+	check("files.dataDir", cfg.Files.DataDir != running.Files.DataDir)
+	check("files.cacheChunks", cfg.Files.CacheChunks != running.Files.CacheChunks)
+	check("files.keyFile", cfg.Files.KeyFile != running.Files.KeyFile)
+	check("consensus.hw3ex2", cfg.Consensus.HW3ex2 != running.Consensus.HW3ex2)
+	check("consensus.hw3ex3", cfg.Consensus.HW3ex3 != running.Consensus.HW3ex3)
+	check("consensus.hw3ex4", cfg.Consensus.HW3ex4 != running.Consensus.HW3ex4)
+	check("workers", cfg.Workers != running.Workers)
+	check("seed", cfg.Seed != running.Seed)
+	cfg.Name, cfg.GossipAddr, cfg.UIPort, cfg.UIServer = running.Name, running.GossipAddr, running.UIPort, running.UIServer
+	cfg.Simple, cfg.Transport = running.Simple, running.Transport
+	cfg.Timers.Heartbeat, cfg.Timers.PeerEvictTimeout = running.Timers.Heartbeat, running.Timers.PeerEvictTimeout
+	cfg.Files.DataDir, cfg.Files.CacheChunks, cfg.Files.KeyFile = running.Files.DataDir, running.Files.CacheChunks, running.Files.KeyFile
+	cfg.Consensus.HW3ex2, cfg.Consensus.HW3ex3, cfg.Consensus.HW3ex4 = running.Consensus.HW3ex2, running.Consensus.HW3ex3, running.Consensus.HW3ex4
+	cfg.Workers = running.Workers
+	cfg.Seed = running.Seed
+	return kept
+}
+
+// Changes returns the settings that differ between old and cfg, named by their json keys.
+func (cfg *Config) Changes(old *Config) []string {
+	before, after := make(map[string]interface{}), make(map[string]interface{})
+	flatten(reflect.ValueOf(*old), "", before)
+	flatten(reflect.ValueOf(*cfg), "", after)
+	changes := make([]string, 0)
+	for setting, v := range after {
+		if !reflect.DeepEqual(v, before[setting]) {
+			changes = append(changes, setting)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// flatten maps the json key of each setting of the struct v, prefixed by its sections, to its value.
+func flatten(v reflect.Value, prefix string, settings map[string]interface{}) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		if key == "profiles" {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			flatten(v.Field(i), prefix+key+".", settings)
+			continue
+		}
+		settings[prefix+key] = v.Field(i).Interface()
+	}
+}
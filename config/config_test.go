@@ -0,0 +1,111 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vquelque/Peerster/constant"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		err    string //part of the error, empty if valid
+	}{
+		{"defaults", func(cfg *Config) {}, ""},
+		{"peers", func(cfg *Config) { cfg.SetPeers("127.0.0.1:5001, [::1]:5002") }, ""},
+		{"tcp", func(cfg *Config) { cfg.Transport = constant.TransportTCP }, ""},
+		{"cdc", func(cfg *Config) { cfg.Files.Chunking = constant.ChunkingCDC }, ""},
+		{"no limits", func(cfg *Config) { cfg.Limits = Limits{} }, ""},
+		{"zero TLC hop limit", func(cfg *Config) { cfg.Consensus.HopLimit = 0 }, ""},
+		{"missing gossipAddr", func(cfg *Config) { cfg.GossipAddr = "" }, "gossipAddr is required"},
+		{"gossipAddr without port", func(cfg *Config) { cfg.GossipAddr = "127.0.0.1" }, "gossipAddr"},
+		{"UIPort", func(cfg *Config) { cfg.UIPort = 70000 }, "UIPort"},
+		{"bad peer", func(cfg *Config) { cfg.SetPeers("127.0.0.1:5001,localhost") }, "peer localhost"},
+		{"transport", func(cfg *Config) { cfg.Transport = "quic" }, "unknown transport"},
+		{"hop limit", func(cfg *Config) { cfg.HopLimit = 0 }, "hopLimit"},
+		{"compression threshold", func(cfg *Config) { cfg.Compress = -1 }, "compressThreshold"},
+		{"negative timer", func(cfg *Config) { cfg.Timers.AntiEntropy = -1 }, "timer antiEntropy"},
+		{"zero timeout", func(cfg *Config) { cfg.Timers.DataRequestTimeout = 0 }, "timer dataRequestTimeout"},
+		{"first timer in order", func(cfg *Config) {
+			cfg.Timers.SearchResendTimer, cfg.Private.AckTimeout = 0, 0
+		}, "timer private.ackTimeout"},
+		{"retransmissions", func(cfg *Config) { cfg.Private.MaxRetransmissions = -1 }, "maxRetransmissions"},
+		{"chunk size", func(cfg *Config) { cfg.Files.ChunkSize = maxChunkSize + 1 }, "chunkSize"},
+		{"chunking", func(cfg *Config) { cfg.Files.Chunking = "rabin" }, "unknown chunking"},
+		{"cdc min above avg", func(cfg *Config) {
+			cfg.Files.Chunking, cfg.Files.MinChunkSize = constant.ChunkingCDC, cfg.Files.ChunkSize+1
+		}, "content defined chunking"},
+		{"cdc min below the window", func(cfg *Config) {
+			cfg.Files.Chunking, cfg.Files.MinChunkSize = constant.ChunkingCDC, minCDCChunkSize-1
+		}, "content defined chunking"},
+		{"cdc max too large", func(cfg *Config) {
+			cfg.Files.Chunking, cfg.Files.MaxChunkSize = constant.ChunkingCDC, maxChunkSize+1
+		}, "content defined chunking"},
+		{"download directory", func(cfg *Config) { cfg.Files.DownloadDir = "" }, "downloadDir"},
+		{"download window", func(cfg *Config) { cfg.Files.DownloadWindow = 0 }, "downloadWindow"},
+		{"search budget", func(cfg *Config) { cfg.Search.MaxBudget = 0 }, "search"},
+		{"names without N", func(cfg *Config) { cfg.Consensus.HW3ex3 = true }, "number of peers"},
+		{"stubborn timeout", func(cfg *Config) { cfg.Consensus.StubbornTimeout = 0 }, "stubbornTimeout"},
+		{"log level", func(cfg *Config) { cfg.Log.Level = "verbose" }, "verbose"},
+		{"workers", func(cfg *Config) { cfg.Workers.Search.Workers = 0 }, "workers.search"},
+		{"queue", func(cfg *Config) { cfg.Workers.Client.Queue = -1 }, "workers.client"},
+		{"unknown packet type", func(cfg *Config) { cfg.Limits.Rates["ping"] = Rate{1, 1} }, "unknown packet type ping"},
+		{"zero rate", func(cfg *Config) { cfg.Limits.Rates["rumor"] = Rate{0, 10} }, "limits.rates.rumor"},
+		{"zero burst", func(cfg *Config) { cfg.Limits.Rates["status"] = Rate{10, 0} }, "limits.rates.status"},
+		{"text size", func(cfg *Config) { cfg.Limits.MaxTextSize = -1 }, "maxTextSize"},
+		{"ban duration", func(cfg *Config) { cfg.Limits.BanThreshold, cfg.Limits.BanDuration = 5, 0 }, "banDuration"},
+		{"no ban", func(cfg *Config) { cfg.Limits.BanThreshold, cfg.Limits.BanDuration = 0, 0 }, ""},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		cfg.GossipAddr = "127.0.0.1:5000"
+		tt.modify(cfg)
+		err := cfg.Validate()
+		if tt.err == "" && err != nil {
+			t.Errorf("%s : %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s : error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peerster.json")
+	data := `{"name": "A", "gossipAddr": "127.0.0.1:5000", "timers": {"antiEntropy": 5},
+		"profiles": {"tcp": {"transport": "tcp", "timers": {"rtimer": 3}}}}`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		profile   string
+		transport string
+		rtimer    int
+		err       bool
+	}{
+		{"", constant.TransportUDP, 0, false},
+		{"tcp", constant.TransportTCP, 3, false},
+		{"udp", "", 0, true},
+	}
+	for _, tt := range tests {
+		cfg, err := Load(path, tt.profile)
+		if tt.err {
+			if err == nil {
+				t.Fatalf("profile %q : loaded", tt.profile)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("profile %q : %v", tt.profile, err)
+		}
+		// the profile applies on top of the file, which applies on top of the defaults
+		if cfg.Transport != tt.transport || cfg.Timers.RTimer != tt.rtimer || cfg.Timers.AntiEntropy != 5 ||
+			cfg.Timers.Heartbeat != constant.DefaultHeartbeatInterval || cfg.Validate() != nil {
+			t.Fatalf("profile %q : %+v", tt.profile, cfg)
+		}
+	}
+}
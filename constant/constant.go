@@ -1,14 +1,29 @@
 package constant
 
 const ChannelSize = 50
+
+const TransportUDP = "udp"
+const TransportTCP = "tcp" //falls back to UDP for the peers not accepting TCP connections
+
 const DefaultHopLimit = 10 //for private messages routing (in Hops)
 const AckTimeout = 10      //in seconds
 
+const PrivateAckTimeout = 1         //in seconds. Doubled after each retransmission
+const PrivateMaxRetransmissions = 5 //before marking a private message as failed
+
 const ChunkSize = 8192 //in bytes
+const ChunkingFixed = "fixed"
+const ChunkingCDC = "cdc"     //content defined chunking, ChunkSize being the average size of the chunks
+const MinChunkSize = 2 * 1024 //in bytes, of the content defined chunks
+const MaxChunkSize = 32 * 1024
 const FileTempDirectory = "./_SharedFiles/"
+const KeyDirectory = ".peerster" //in the home directory. Identity keys of the gossipers without data directory
+const NoKeyFile = "none"         //key file of a gossiper generating a new identity at every start
 const FileOutDirectory = "./_Downloads/"
 const MaxChunkDownloadTries = 10
-const Timeout = 5 //in seconds
+const DefaultDownloadWindow = 8 //number of outstanding chunk requests per download
+const ChunkRequestTries = 2     //retransmissions to the same source before trying another one
+const Timeout = 5               //in seconds
 
 const SearchRequestTimeout = 500 //in ms
 const DefaultSearchBudget = 2
@@ -18,3 +33,54 @@ const SearchMatchThreshold = 2
 const SearchRequestMaxRetries = 10
 
 const DefaultStubbornTimeout = 5
+const DefaultAntiEntropy = 10 //in seconds
+
+const RouteTimeout = 120      //in seconds. Routes not refreshed for this long are invalid
+const NeighborTimeout = 120   //in seconds. Routes via a neighbor silent for this long are invalid
+const RouteSwitchRatio = 0.75 //a route only switches to a neighbor with a round trip time below this ratio of the current one
+
+const DefaultHeartbeatInterval = 0 //in seconds. Off by default : the heartbeats add status packets to the trace
+const PeerSuspectHeartbeats = 3    //missed heartbeat intervals before a peer is suspected
+const PeerDeadHeartbeats = 6       //missed heartbeat intervals before a peer is dead
+const PeerEvictTimeout = 300       //in seconds. Dead peers not given on the command line are forgotten after this
+
+// worker pools processing the packets received from the peers. Packets are dropped when
+// the queue of their class is full
+const ControlWorkers = 2 //status packets, acks and hellos
+const ControlQueueSize = 256
+const GossipWorkers = 4 //rumors, TLC and private messages
+const GossipQueueSize = 256
+const SearchWorkers = 2
+const SearchQueueSize = 64
+const DataWorkers = 4 //data requests and replies
+const DataQueueSize = 128
+const ClientWorkers = 4 //messages of the client and the web UI. A search keeps its worker until it ends
+const ClientQueueSize = 64
+
+// token bucket limits of the packets received from the peers, per source address and
+// per origin. The rates are in packets per second
+const ControlRate = 50 //status packets, acks and hellos
+const ControlBurst = 100
+const GossipRate = 20 //rumors, TLC and private messages
+const GossipBurst = 100
+const SearchRate = 2
+const SearchBurst = 10
+const DataRate = 200 //data requests and replies
+const DataBurst = 400
+const MaxTextSize = 4096 //in bytes, of the rumors and private messages
+const MaxKeywords = 16   //of a search request
+const ConnectionRate = 1 //TCP connections per second of an IP address
+const ConnectionBurst = 10
+const BanThreshold = 100 //packets over the limits in a minute before their source is banned
+const BanDuration = 300  //in seconds
+
+const ProtocolVersion = 2 //advertised in the hellos. The original protocol, without hellos, is version 1
+const HelloRetry = 10     //in seconds. A peer which did not answer our hello is greeted again after this
+
+const CompressThreshold = 1024      //in bytes. Larger packets are compressed for the peers supporting it
+const MaxDecompressedSize = 1 << 20 //in bytes, of a compressed packet once decompressed
+
+const MaxManifestSize = 32 * 1024 //in bytes. A manifest is sent in a single data reply
+
+const MetafileFanout = 256    //hashes per metafile. Files with more chunks get a Merkle-tree metafile
+const MaxFileChunks = 1 << 24 //chunks of a downloaded file, i.e. 128GB of 8KB chunks
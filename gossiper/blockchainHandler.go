@@ -2,7 +2,6 @@ package gossiper
 
 import (
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
@@ -12,14 +11,14 @@ import (
 )
 
 func (gsp *Gossiper) PublishName(file *storage.File) {
-	fmt.Printf("PUBLISHING NAME %s ON BLOCKCHAIN\n", file.Name)
+	tlcLog.Tracef("PUBLISHING NAME %s ON BLOCKCHAIN\n", file.Name)
 	bp := blockchain.NewBlockPublish(file.Name, file.Size, file.MetafileHash, gsp.Blockchain.GetPreviousHash())
-	if gsp.AdditionalFlags.HW3ex2 == true {
+	if gsp.Config().Consensus.HW3ex2 {
 		// ex2 -> don't care about TLC rounds
 		gsp.HandleBlockPublish(bp, 0)
 		return
 	}
-	fmt.Printf("ALLOWED : %v \n", gsp.Blockchain.CheckAllowedToPublish())
+	tlcLog.Tracef("ALLOWED : %v \n", gsp.Blockchain.CheckAllowedToPublish())
 	if gsp.Blockchain.CheckAllowedToPublish() {
 		gsp.HandleBlockPublish(bp, 0)
 		return
@@ -28,16 +27,16 @@ func (gsp *Gossiper) PublishName(file *storage.File) {
 }
 
 func (gsp *Gossiper) StartTLCRoundHandler() {
-	go func() {
+	gsp.spawn(func() {
 		TLCProofsForRound := make([]*message.TLCMessage, 0)
 		for {
 			select {
 			case confirmedTLC := <-gsp.Blockchain.PendingBlocks.ConfirmedTLC:
 				TLCProofsForRound = append(TLCProofsForRound, confirmedTLC)
-				if uint64(len(TLCProofsForRound)) > gsp.AdditionalFlags.PeersNumber/2 {
+				if uint64(len(TLCProofsForRound)) > gsp.Config().Consensus.PeersNumber/2 {
 					gsp.Blockchain.ResetAllowedForRound()
 					gsp.Blockchain.AdvanceRoundForPeer(gsp.Name)
-					fmt.Printf("ADVANCING TO round ​%d BASED ON CONFIRMED MESSAGES %s\n", gsp.Blockchain.GetRoundForPeer(gsp.Name), ProofsForRound(TLCProofsForRound))
+					tlcLog.Tracef("ADVANCING TO round ​%d BASED ON CONFIRMED MESSAGES %s\n", gsp.Blockchain.GetRoundForPeer(gsp.Name), ProofsForRound(TLCProofsForRound))
 					gsp.UIStorage.AppendProofsForRoundAsync(TLCProofsForRound, gsp.Blockchain.GetRoundForPeer(gsp.Name))
 					TLCProofsForRound = make([]*message.TLCMessage, 0)
 					select {
@@ -48,30 +47,31 @@ func (gsp *Gossiper) StartTLCRoundHandler() {
 
 				}
 				if gsp.Blockchain.CheckAllowedToPublish() && gsp.Blockchain.HasPendingBlocks() {
-					go gsp.HandleBlockPublish(gsp.Blockchain.ShiftPendingBlock(), 0)
+					bp := gsp.Blockchain.ShiftPendingBlock()
+					gsp.spawn(func() { gsp.HandleBlockPublish(bp, 0) })
 				}
+			case <-gsp.ctx.Done():
+				return
 			}
 		}
-	}()
+	})
 }
 
 func (gsp *Gossiper) HandleBlockPublish(bp *message.BlockPublish, fitness float32) {
 	nextID := gsp.VectorClock.NextMessageForPeer(gsp.Name)
 	TLCStatusPkt := gsp.Blockchain.TLCRoundStatus()
 	TLC := message.NewTLCMessage(gsp.Name, nextID, bp, -1, TLCStatusPkt, fitness)
+	gsp.signTLC(TLC)
 	validTx := gsp.Blockchain.AddPendingTLCIfValid(TLC)
 	if !validTx {
-		log.Printf("NON VALID BLOCK. NAME ALREADY PUBLISHED\n")
+		tlcLog.Warnf("NON VALID BLOCK. NAME ALREADY PUBLISHED")
 		return
 	}
 	gsp.Blockchain.Published()
 	channel := gsp.WaitingForTLCAck.RegisterTLCAckObserver(TLC)
-	var timer *time.Ticker
-	if gsp.AdditionalFlags.StubbornTimeout > 0 {
-		stubbornTimeoutDuration := time.Duration(gsp.AdditionalFlags.StubbornTimeout) * time.Second
-		timer = time.NewTicker(stubbornTimeoutDuration)
-	}
-	majority := gsp.AdditionalFlags.PeersNumber / 2
+	stubbornTimeoutDuration := time.Duration(gsp.Config().Consensus.StubbornTimeout) * time.Second
+	timer := gsp.clock.NewTicker(stubbornTimeoutDuration)
+	majority := gsp.Config().Consensus.PeersNumber / 2
 	acknowledged := []string{gsp.Name}
 	gsp.mongerTLC(TLC, "")
 	defer func() {
@@ -81,9 +81,9 @@ func (gsp *Gossiper) HandleBlockPublish(bp *message.BlockPublish, fitness float3
 	//keep running while channel open with for loop assignment
 	for {
 		select {
-		case <-timer.C:
+		case <-timer.C():
 			//RUMORMONGER AGAIN
-			fmt.Printf("MONGERING AGAIN TLC. STUBBORDN TIMEOUT EXCEEDED. \n")
+			tlcLog.Tracef("MONGERING AGAIN TLC. STUBBORDN TIMEOUT EXCEEDED. \n")
 			gsp.mongerTLC(TLC, "")
 			//TODO MONGER AGAIN
 		case ack := <-channel:
@@ -94,14 +94,17 @@ func (gsp *Gossiper) HandleBlockPublish(bp *message.BlockPublish, fitness float3
 				nextID := gsp.VectorClock.NextMessageForPeer(gsp.Name)
 				TLCStatusPkt := gsp.Blockchain.TLCRoundStatus()
 				confirmedTLC := message.NewTLCMessage(gsp.Name, nextID, &TLC.TxBlock, int(TLC.ID), TLCStatusPkt, TLC.Fitness)
-				fmt.Printf("RE-BROADCAST ID %d WITNESSES %s\n", TLC.ID, strings.Join(acknowledged, ","))
+				gsp.signTLC(confirmedTLC)
+				tlcLog.Tracef("RE-BROADCAST ID %d WITNESSES %s\n", TLC.ID, strings.Join(acknowledged, ","))
 				gsp.processTLCMessage(confirmedTLC, "")
 				return
 			}
 		case <-gsp.Blockchain.NextRound:
-			fmt.Printf("NEXT ROUND. FORGETTING BLOCK")
+			tlcLog.Tracef("NEXT ROUND. FORGETTING BLOCK")
 			gsp.Blockchain.RemovePendingTLC(TLC)
 			return
+		case <-gsp.ctx.Done():
+			return
 		}
 	}
 }
@@ -109,19 +112,20 @@ func (gsp *Gossiper) HandleBlockPublish(bp *message.BlockPublish, fitness float3
 func (gsp *Gossiper) processTLCMessage(tlcmsg *message.TLCMessage, sender string) {
 	rp := &message.RumorPacket{TLCMessage: tlcmsg}
 	gsp.processRumorPacket(rp, sender)
-	fmt.Printf("%v \n", tlcmsg.VectorClock.Want)
+	tlcLog.Tracef("%v \n", tlcmsg.VectorClock.Want)
 	if tlcmsg.Confirmed > 0 {
 		//mothing more to do. we treated the message in the rumorMnonger handler
 		return
 	}
 	valid := gsp.Blockchain.AddPendingTLCIfValid(tlcmsg)
 	//send ACK to origin
-	fmt.Printf("FORWARD : %v \n", gsp.Blockchain.IsFowardRumor(tlcmsg.VectorClock))
-	fmt.Printf("THIS ROUND CLOCK %v \n", gsp.Blockchain.TLCRoundVector)
-	fmt.Printf("OTER ROUND CLOCK %v \n", tlcmsg.VectorClock)
+	tlcLog.Tracef("FORWARD : %v \n", gsp.Blockchain.IsFowardRumor(tlcmsg.VectorClock))
+	tlcLog.Tracef("THIS ROUND CLOCK %v \n", gsp.Blockchain.TLCRoundVector)
+	tlcLog.Tracef("OTER ROUND CLOCK %v \n", tlcmsg.VectorClock)
 	if valid && tlcmsg.Origin != gsp.Name {
-		if gsp.AdditionalFlags.HW3ex2 || gsp.Blockchain.IsFowardRumor(tlcmsg.VectorClock) || gsp.AdditionalFlags.AckAll {
-			ack := blockchain.NewTLCAck(gsp.Name, tlcmsg.Origin, tlcmsg.ID, gsp.HopLimit)
+		if gsp.Config().Consensus.HW3ex2 || gsp.Blockchain.IsFowardRumor(tlcmsg.VectorClock) || gsp.Config().Consensus.AckAll {
+			ack := blockchain.NewTLCAck(gsp.Name, tlcmsg.Origin, tlcmsg.ID, gsp.Config().Consensus.HopLimit)
+			gsp.signTLCAck(ack)
 			// fmt.Printf("SENDING ACK origin %s ID %d \n", gsp.Name, tlcmsg.ID)
 			gsp.sendTLACK(ack)
 		}
@@ -129,7 +133,7 @@ func (gsp *Gossiper) processTLCMessage(tlcmsg *message.TLCMessage, sender string
 }
 
 func (gsp *Gossiper) mongerTLC(tlcmsg *message.TLCMessage, sender string) {
-	log.Println("SENDING TLC")
+	tlcLog.Debugf("SENDING TLC")
 	gp := &message.RumorPacket{TLCMessage: tlcmsg}
 	gsp.processRumorPacket(gp, sender)
 }
@@ -139,15 +143,16 @@ func (gsp *Gossiper) processTLCAck(tlcack message.TLCAck) {
 		gsp.sendTLACK(tlcack)
 		return
 	}
+	gsp.Metrics.tlcAcks.Inc()
 	gsp.WaitingForTLCAck.SendTLCToAckObserver(tlcack)
 }
 
 func (gsp *Gossiper) sendTLACK(ack message.TLCAck) {
 	ack.HopLimit = ack.HopLimit - 1
 	gp := &GossipPacket{Ack: &ack}
-	fmt.Printf("SENDING TLC ACK TO %s \n", ack.Destination)
+	tlcLog.Tracef("SENDING TLC ACK TO %s \n", ack.Destination)
 	nextHopAddr := gsp.Routing.GetRoute(ack.Destination)
-	if nextHopAddr != "" {
+	if nextHopAddr != "" && gsp.supports(nextHopAddr, message.CapTLC) {
 		if ack.HopLimit > 0 {
 			gsp.send(gp, nextHopAddr)
 		}
@@ -1,16 +1,13 @@
 package gossiper
 
 import (
-	"fmt"
-
-	"github.com/vquelque/Peerster/constant"
 	"github.com/vquelque/Peerster/message"
 	"github.com/vquelque/Peerster/utils"
 )
 
 // ProcessClientMessage processes client messages
 func (gsp *Gossiper) ProcessClientMessage(msg *message.Message) {
-	fmt.Println(msg.String())
+	netLog.Tracef("%s\n", msg.String())
 	if gsp.Simple {
 		gp := &GossipPacket{Simple: message.NewSimpleMessage(msg.Text, gsp.Name, gsp.PeersSocket.Address())}
 		//broadcast packet
@@ -18,8 +15,7 @@ func (gsp *Gossiper) ProcessClientMessage(msg *message.Message) {
 	} else {
 		if msg.Destination != "" && len(msg.Request) == 0 {
 			//private message
-			m := message.NewPrivateMessage(gsp.Name, msg.Text, msg.Destination, constant.DefaultHopLimit)
-			gsp.processPrivateMessage(m)
+			gsp.sendPrivateText(msg.Text, msg.Destination)
 		} else if msg.File != "" && len(msg.Request) == 0 {
 			gsp.processFile(msg.File)
 		} else if len(msg.Request) != 0 && msg.File != "" {
@@ -35,6 +31,7 @@ func (gsp *Gossiper) ProcessClientMessage(msg *message.Message) {
 			//rumor message
 			mID := gsp.VectorClock.NextMessageForPeer(gsp.Name)
 			m := message.NewRumorMessage(gsp.Name, mID, msg.Text)
+			gsp.signRumor(m)
 			gsp.processRumorMessage(m, "")
 		}
 	}
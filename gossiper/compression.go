@@ -0,0 +1,89 @@
+package gossiper
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/dedis/protobuf"
+	"github.com/vquelque/Peerster/constant"
+	"github.com/vquelque/Peerster/message"
+)
+
+// flate writers are large : they are reused across packets
+var compressors = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+// encodePacket encodes gp for peer. Packets larger than the compression threshold are
+// wrapped compressed in a GossipPacket if peer supports it and if it saves bytes.
+func (gsp *Gossiper) encodePacket(gp *GossipPacket, peer string) ([]byte, error) {
+	pkt, err := protobuf.Encode(gp)
+	if err != nil {
+		return nil, err
+	}
+	threshold := gsp.Config().Compress
+	if threshold == 0 || len(pkt) <= threshold || !gsp.supports(peer, message.CapCompression) {
+		return pkt, nil
+	}
+	compressed, err := protobuf.Encode(&GossipPacket{Compressed: &message.CompressedPacket{Data: compress(pkt)}})
+	if err != nil || len(compressed) >= len(pkt) {
+		return pkt, nil
+	}
+	gsp.Metrics.packetsCompressed.With(packetType(gp)).Inc()
+	gsp.Metrics.bytesSaved.Add(uint64(len(pkt) - len(compressed)))
+	return compressed, nil
+}
+
+// decodePacket decodes a packet received from a peer, decompressing it if needed.
+func (gsp *Gossiper) decodePacket(data []byte) (*GossipPacket, error) {
+	gp := &GossipPacket{}
+	if err := protobuf.Decode(data, gp); err != nil {
+		return nil, err
+	}
+	if gp.Compressed == nil {
+		return gp, nil
+	}
+	pkt, err := decompress(gp.Compressed.Data)
+	if err != nil {
+		return nil, err
+	}
+	gp = &GossipPacket{}
+	if err := protobuf.Decode(pkt, gp); err != nil {
+		return nil, err
+	}
+	if gp.Compressed != nil {
+		return nil, fmt.Errorf("packet compressed twice")
+	}
+	return gp, nil
+}
+
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := compressors.Get().(*flate.Writer)
+	defer compressors.Put(w)
+	w.Reset(&buf)
+	// writes to a buffer never fail
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// decompress inflates data, refusing packets larger than MaxDecompressedSize once
+// decompressed.
+func decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	pkt, err := ioutil.ReadAll(io.LimitReader(r, constant.MaxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress packet : %v", err)
+	}
+	if len(pkt) > constant.MaxDecompressedSize {
+		return nil, fmt.Errorf("compressed packet larger than %d bytes", constant.MaxDecompressedSize)
+	}
+	return pkt, nil
+}
@@ -0,0 +1,73 @@
+package gossiper
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/protobuf"
+	"github.com/vquelque/Peerster/constant"
+	"github.com/vquelque/Peerster/message"
+)
+
+func compressedPacket(t *testing.T, data []byte) []byte {
+	pkt, err := protobuf.Encode(&GossipPacket{Compressed: &message.CompressedPacket{Data: data}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func TestDecompressLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		ok   bool
+	}{
+		{"empty", 0, true},
+		{"small", 100, true},
+		{"max size", constant.MaxDecompressedSize, true},
+		{"oversized", constant.MaxDecompressedSize + 1, false},
+		{"bomb", 64 * constant.MaxDecompressedSize, false},
+	}
+	for _, tt := range tests {
+		data := bytes.Repeat([]byte("peerster"), tt.size/8+1)[:tt.size]
+		pkt, err := decompress(compress(data))
+		if (err == nil) != tt.ok || tt.ok && !bytes.Equal(pkt, data) {
+			t.Fatalf("%s : %d bytes, %v", tt.name, len(pkt), err)
+		}
+	}
+	if _, err := decompress([]byte("not flate data")); err == nil {
+		t.Fatal("invalid data decompressed")
+	}
+}
+
+func TestDecodeCompressedPacket(t *testing.T) {
+	gsp := &Gossiper{}
+	rumor := &GossipPacket{RumorMessage: message.NewRumorMessage("A", 1, string(bytes.Repeat([]byte("x"), 10000)))}
+	pkt, err := protobuf.Encode(rumor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := compress(pkt)
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"uncompressed", pkt, true},
+		{"compressed", compressedPacket(t, compressed), true},
+		{"compressed twice", compressedPacket(t, compress(compressedPacket(t, compressed))), false},
+		{"truncated", compressedPacket(t, compressed[:len(compressed)/2]), false},
+		{"invalid data", compressedPacket(t, []byte("not flate data")), false},
+		{"bomb", compressedPacket(t, compress(make([]byte, 2*constant.MaxDecompressedSize))), false},
+	}
+	for _, tt := range tests {
+		gp, err := gsp.decodePacket(tt.data)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%s : %v", tt.name, err)
+		}
+		if tt.ok && (gp.RumorMessage == nil || gp.RumorMessage.Text != rumor.RumorMessage.Text) {
+			t.Fatalf("%s : decoded %v", tt.name, gp)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package gossiper
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/vquelque/Peerster/constant"
+	"github.com/vquelque/Peerster/storage"
+	"github.com/vquelque/Peerster/utils"
+)
+
+// chunkJob is a chunk waiting to be downloaded.
+type chunkJob struct {
+	index    uint64 //index of the chunk in the metafile (starting at 0)
+	hash     utils.SHA256
+	sources  []string
+	tried    map[string]bool //sources that failed for this chunk
+	attempts int
+}
+
+type chunkResult struct {
+	job     *chunkJob
+	peer    string
+	data    []byte
+	err     error
+	elapsed time.Duration
+}
+
+// sourceStats keeps track of the behaviour of a source during a download.
+type sourceStats struct {
+	inFlight int
+	failures int
+	latency  time.Duration //moving average of the reply time
+}
+
+// downloadScheduler downloads the chunks of a file keeping up to window DataRequests
+// in flight, spread across all the known sources of each chunk.
+type downloadScheduler struct {
+	gsp      *Gossiper
+	filename string
+	metahash utils.SHA256
+	out      *storage.PartialFile
+	window   int
+	queue    []*chunkJob
+	stats    map[string]*sourceStats
+	results  chan *chunkResult
+}
+
+// downloadChunks fetches all the chunks of chunksHash that are not stored yet, and writes
+// them to out. first is the index of the first of them among the total chunks of the file.
+// chunkSources maps a chunk index to the peers having it. If nil, every chunk is requested
+// from peer.
+func (gsp *Gossiper) downloadChunks(metahash utils.SHA256, filename string, chunksHash []utils.SHA256, first uint64, total uint64, peer string, chunkSources map[uint64][]string, out *storage.PartialFile) error {
+	window := gsp.Config().Files.DownloadWindow
+	if window <= 0 {
+		window = constant.DefaultDownloadWindow
+	}
+	ds := &downloadScheduler{
+		gsp:      gsp,
+		filename: filename,
+		metahash: metahash,
+		out:      out,
+		window:   window,
+		queue:    make([]*chunkJob, 0),
+		stats:    make(map[string]*sourceStats),
+		results:  make(chan *chunkResult, window),
+	}
+	// a chunk appearing several times in the file is only requested once
+	scheduled := make(map[utils.SHA256]bool)
+	for i, h := range chunksHash {
+		index := first + uint64(i)
+		if scheduled[h] {
+			continue
+		}
+		if gsp.hasVerifiedChunk(metahash, index, h) {
+			if !gsp.DownloadSessions.IsCompleted(metahash, index) {
+				// shared with a file already stored
+				gsp.Metrics.chunksReused.Inc()
+			}
+			continue
+		}
+		scheduled[h] = true
+		sources := []string{peer}
+		if chunkSources != nil {
+			sources = chunkSources[index]
+		}
+		ds.queue = append(ds.queue, &chunkJob{index: index, hash: h, sources: sources, tried: make(map[string]bool)})
+	}
+	// rarest chunks first
+	sort.SliceStable(ds.queue, func(i, j int) bool {
+		return len(ds.queue[i].sources) < len(ds.queue[j].sources)
+	})
+	downloaded := first + uint64(len(chunksHash)-len(ds.queue))
+	gsp.UIStorage.UpdateDownloadProgress(metahash, filename, downloaded, total)
+	return ds.run(downloaded, total)
+}
+
+// hasVerifiedChunk checks if the chunk is already stored. Chunks recorded by a resumed
+// download session are checked against their hash before being reused.
+func (gsp *Gossiper) hasVerifiedChunk(metahash utils.SHA256, index uint64, hash utils.SHA256) bool {
+	data := gsp.FileStorage.GetChunkOrMeta(hash)
+	if data == nil {
+		return false
+	}
+	if gsp.DownloadSessions.IsCompleted(metahash, index) {
+		return sha256.Sum256(data) == hash
+	}
+	return true
+}
+
+func (ds *downloadScheduler) run(downloaded uint64, total uint64) error {
+	inFlight := 0
+	for len(ds.queue) > 0 || inFlight > 0 {
+		for inFlight < ds.window && len(ds.queue) > 0 {
+			job := ds.queue[0]
+			ds.queue = ds.queue[1:]
+			peer := ds.pickSource(job)
+			if peer == "" {
+				ds.drain(inFlight)
+				return fmt.Errorf("no source available for chunk %d of %s", job.index+1, ds.filename)
+			}
+			if !ds.gsp.spawn(func() { ds.request(job, peer) }) {
+				ds.drain(inFlight)
+				return ds.gsp.ctx.Err()
+			}
+			ds.stats[peer].inFlight++
+			inFlight++
+		}
+		r := <-ds.results
+		inFlight--
+		s := ds.stats[r.peer]
+		s.inFlight--
+		if r.err != nil || r.data == nil {
+			s.failures++
+			r.job.tried[r.peer] = true
+			r.job.attempts++
+			if r.job.attempts >= ds.gsp.Config().Files.MaxChunkDownloadTries {
+				ds.drain(inFlight)
+				return fmt.Errorf("ERROR DOWNLOADING CHUNK %d OF %s : MAX RETRIES LIMIT REACHED. ABORTING", r.job.index+1, ds.filename)
+			}
+			// retry as soon as possible, preferably on another source
+			ds.queue = append([]*chunkJob{r.job}, ds.queue...)
+			continue
+		}
+		ds.gsp.Metrics.downloadedBytes.Add(uint64(len(r.data)))
+		ds.gsp.Metrics.chunkLatency.Observe(r.elapsed.Seconds())
+		if s.latency == 0 {
+			s.latency = r.elapsed
+		} else {
+			s.latency = (3*s.latency + r.elapsed) / 4
+		}
+		if err := ds.gsp.FileStorage.StorePartialChunk(ds.out, r.job.index, &storage.Chunk{Data: r.data, Hash: r.job.hash}); err != nil {
+			ds.drain(inFlight)
+			return err
+		}
+		ds.gsp.DownloadSessions.MarkCompleted(ds.metahash, r.job.index)
+		downloaded++
+		ds.gsp.UIStorage.UpdateDownloadProgress(ds.metahash, ds.filename, downloaded, total)
+	}
+	return nil
+}
+
+// pickSource returns the source to use for the job. Sources that did not fail yet for
+// this chunk are preferred, then the least loaded, then the fastest.
+func (ds *downloadScheduler) pickSource(job *chunkJob) string {
+	candidates := make([]string, 0)
+	for _, p := range job.sources {
+		if !job.tried[p] {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		// every source failed once : give them another chance
+		job.tried = make(map[string]bool)
+		candidates = append(candidates, job.sources...)
+	}
+	best := ""
+	for _, p := range candidates {
+		if p == "" {
+			continue
+		}
+		if _, found := ds.stats[p]; !found {
+			ds.stats[p] = &sourceStats{}
+		}
+		if best == "" || ds.better(p, best) {
+			best = p
+		}
+	}
+	return best
+}
+
+func (ds *downloadScheduler) better(p string, q string) bool {
+	sp, sq := ds.stats[p], ds.stats[q]
+	if sp.inFlight != sq.inFlight {
+		return sp.inFlight < sq.inFlight
+	}
+	if sp.failures != sq.failures {
+		return sp.failures < sq.failures
+	}
+	return sp.latency < sq.latency
+}
+
+func (ds *downloadScheduler) request(job *chunkJob, peer string) {
+	filesLog.Tracef("DOWNLOADING %s chunk %d from %s \n", ds.filename, job.index+1, peer)
+	start := ds.gsp.clock.Now()
+	data, err := ds.gsp.downloadFromPeerWithTries(job.hash, peer, ds.gsp.Config().Files.ChunkRequestTries)
+	ds.results <- &chunkResult{job: job, peer: peer, data: data, err: err, elapsed: ds.gsp.clock.Now().Sub(start)}
+}
+
+// drain waits for the outstanding requests before aborting the download.
+func (ds *downloadScheduler) drain(inFlight int) {
+	for ; inFlight > 0; inFlight-- {
+		<-ds.results
+	}
+}
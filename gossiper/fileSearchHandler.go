@@ -1,11 +1,8 @@
 package gossiper
 
 import (
-	"fmt"
-	"log"
 	"time"
 
-	"github.com/vquelque/Peerster/constant"
 	"github.com/vquelque/Peerster/message"
 	"github.com/vquelque/Peerster/storage"
 	"github.com/vquelque/Peerster/utils"
@@ -34,7 +31,8 @@ func (gsp *Gossiper) processSearchRequest(sr *message.SearchRequest, origin stri
 	}
 	if len(matches) > 0 {
 		// log.Printf("GOT MATCHING FILE SENDING REPLY\n")
-		reply := message.NewSearchReply(gsp.Name, sr.Origin, constant.DefaultHopLimit, results)
+		reply := message.NewSearchReply(gsp.Name, sr.Origin, gsp.Config().HopLimit, results)
+		gsp.signSearchReply(reply)
 		gsp.sendSearchReply(reply)
 	}
 	if sr.Budget > 1 {
@@ -81,9 +79,17 @@ func (gsp *Gossiper) distributeSearchRequest(sr *message.SearchRequest, origin s
 	}
 	mBudget = sr.Budget / peers
 	rBudget := sr.Budget % peers
+	if mBudget > 0 {
+		gsp.Metrics.searchFanout.Observe(float64(peers))
+	} else {
+		gsp.Metrics.searchFanout.Observe(float64(rBudget))
+	}
 	// log.Printf("mBudget %d, rBudget %d \n", mBudget, rBudget)
 	msr := message.NewSearchRequest(sr.Origin, sr.Keywords, mBudget)
 	rsr := message.NewSearchRequest(sr.Origin, sr.Keywords, mBudget+1)
+	// the budget is not signed : keep the key and signature of the origin
+	msr.PublicKey, msr.Signature = sr.PublicKey, sr.Signature
+	rsr.PublicKey, rsr.Signature = sr.PublicKey, sr.Signature
 	for _, p := range neighbors {
 		if rBudget > 0 {
 			gsp.sendSearchRequest(rsr, p)
@@ -97,18 +103,19 @@ func (gsp *Gossiper) distributeSearchRequest(sr *message.SearchRequest, origin s
 func (gsp *Gossiper) registerSearchRequest(sr *message.SearchRequest) {
 	gsp.PendingSearchRequest.Add(sr)
 	// log.Printf("REGISTERED SR WITH ID %s \n", storage.GetRequestID(sr))
-	rTimerDuration := time.Duration(constant.SearchRequestTimeout) * time.Millisecond
-	timer := time.NewTicker(rTimerDuration)
+	rTimerDuration := time.Duration(gsp.Config().Timers.SearchRequestTimeout) * time.Millisecond
+	timer := gsp.clock.NewTicker(rTimerDuration)
 	//deregister after timeout
-	go func() {
+	gsp.spawn(func() {
+		defer timer.Stop()
 		select {
-		case <-timer.C:
+		case <-timer.C():
 			// timer elapsed : unregister search request
 			// log.Printf("UNREGISTERED SR WITH ID %s \n", storage.GetRequestID(sr))
 			gsp.PendingSearchRequest.Delete(sr)
-			timer.Stop()
+		case <-gsp.ctx.Done():
 		}
-	}()
+	})
 }
 
 func (gsp *Gossiper) sendSearchRequest(sr *message.SearchRequest, peer string) {
@@ -119,7 +126,7 @@ func (gsp *Gossiper) sendSearchRequest(sr *message.SearchRequest, peer string) {
 
 // search request initiated from this peer
 func (gsp *Gossiper) startSearchRequest(keywords []string, budget uint64) {
-	log.Printf("STARTING SEARCH REQUEST WITH KEYWORDS %s AND BUDGET %d", keywords, budget)
+	searchLog.Infof("STARTING SEARCH REQUEST WITH KEYWORDS %s AND BUDGET %d", keywords, budget)
 	expandingSearch := false
 	if budget == 0 {
 		expandingSearch = true
@@ -127,10 +134,11 @@ func (gsp *Gossiper) startSearchRequest(keywords []string, budget uint64) {
 	}
 	timeout := 0
 	sr := message.NewSearchRequest(gsp.Name, keywords, budget)
+	gsp.signSearchRequest(sr)
 	currBudget := budget
 	gsp.processSearchRequest(sr, "")
-	rTimerDuration := time.Duration(constant.SearchRequestResendTimer) * time.Second
-	timer := time.NewTicker(rTimerDuration)
+	rTimerDuration := time.Duration(gsp.Config().Timers.SearchResendTimer) * time.Second
+	timer := gsp.clock.NewTicker(rTimerDuration)
 	match := gsp.WaitingForSearchReply.RegisterSearchObserver(sr)
 	matches := make(map[utils.SHA256]bool)     //metahash --> bool
 	nMatches := make(map[utils.SHA256]uint32)  //metahash --> number of match
@@ -143,18 +151,18 @@ func (gsp *Gossiper) startSearchRequest(keywords []string, budget uint64) {
 	}()
 	for {
 		select {
-		case <-timer.C:
+		case <-timer.C():
 			timeout++
 			if expandingSearch {
-				if currBudget < constant.MaxBudget {
+				if currBudget < gsp.Config().Search.MaxBudget {
 					currBudget *= 2
 					sr.Budget = currBudget
 					gsp.distributeSearchRequest(sr, "")
-					log.Printf("EXPANDING SEARCH CIRCLE BUDGET %d \n", currBudget)
+					searchLog.Debugf("EXPANDING SEARCH CIRCLE BUDGET %d", currBudget)
 				}
 			}
-			if timeout > constant.SearchRequestMaxRetries {
-				fmt.Printf("REQUEST TIMEOUT \n")
+			if timeout > gsp.Config().Search.MaxRetries {
+				searchLog.Tracef("REQUEST TIMEOUT \n")
 				return
 			}
 		case reply := <-match:
@@ -162,7 +170,7 @@ func (gsp *Gossiper) startSearchRequest(keywords []string, budget uint64) {
 				metahash := utils.SliceToHash(r.MetafileHash)
 				new := gsp.SearchResults.AddSearchResult(r, reply.Origin)
 				if new {
-					fmt.Printf("FOUND match %s at %s metafile=%x chunks=%s \n", r.FileName, reply.Origin, r.MetafileHash, utils.ChunkMapToString(r.ChunkMap))
+					searchLog.Tracef("FOUND match %s at %s metafile=%x chunks=%s \n", r.FileName, reply.Origin, r.MetafileHash, utils.ChunkMapToString(r.ChunkMap))
 					matches[metahash] = false
 					filenames[metahash] = r.FileName
 					if uint64(len(r.ChunkMap)) == r.ChunkCount {
@@ -187,13 +195,15 @@ func (gsp *Gossiper) startSearchRequest(keywords []string, budget uint64) {
 				}
 			}
 
-			if fullMatches >= constant.SearchMatchThreshold {
-				fmt.Printf("SEARCH FINISHED \n")
+			if fullMatches >= gsp.Config().Search.MatchThreshold {
+				searchLog.Tracef("SEARCH FINISHED \n")
 				for m, _ := range matches {
 					gsp.SearchResults.Clear(m)
 				}
 				return
 			}
+		case <-gsp.ctx.Done():
+			return
 		}
 	}
 }
@@ -204,6 +214,6 @@ func (gsp *Gossiper) StartSearchedFileDownload(metahash utils.SHA256, filename s
 	if sources != nil {
 		gsp.startFileDownload(metahash, sources[0][0], filename, sources)
 	} else {
-		fmt.Printf("No peer known for this file \n")
+		searchLog.Tracef("No peer known for this file \n")
 	}
 }
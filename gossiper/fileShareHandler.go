@@ -5,8 +5,8 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/vquelque/Peerster/constant"
@@ -19,149 +19,338 @@ func (gsp *Gossiper) processFile(filename string) {
 	if filename == "" {
 		return
 	}
-	fileURI := constant.FileTempDirectory + filename
+	fileURI := filepath.Join(gsp.Config().Files.SharedDir, filename)
+	if info, err := os.Stat(fileURI); err == nil && info.IsDir() {
+		gsp.processDirectory(filename)
+		return
+	}
+	f := gsp.indexFile(fileURI, filename)
+	if f == nil {
+		return
+	}
+	//register name on blockchain
+	if gsp.Config().PublishNames() {
+		gsp.PublishName(f)
+	}
+}
+
+// indexFile stores the chunks and the metafile of the file at fileURI, shared as filename.
+// Returns nil if the file cannot be read.
+func (gsp *Gossiper) indexFile(fileURI string, filename string) *storage.File {
 	file, err := os.Open(fileURI)
 	if err != nil {
-		fmt.Println(err)
-		return
+		filesLog.Tracef("%v\n", err)
+		return nil
 	}
 	defer file.Close()
 
-	buffer := make([]byte, constant.ChunkSize)
-	metafile := make([]byte, 0)
+	chunker := gsp.newChunker(file)
+	chunksHash := make([]utils.SHA256, 0)
 	var count uint64 = 0
 	var size int64 = 0
 
 	for {
-		//for each chunk of 8KB
-		bytesread, err := file.Read(buffer)
+		//for each chunk
+		data, err := chunker.Next()
 		if err != nil {
 			if err != io.EOF {
 				//error reading file
-				log.Println(err)
+				filesLog.Errorf("cannot read %s : %v", fileURI, err)
 				//TODO clean all previously stored chunks
-				return
+				return nil
 			}
 			break
 		}
 		count++
-		size = size + int64(bytesread)
-		hash := sha256.Sum256(buffer[:bytesread])
-		metafile = append(metafile, hash[:]...)
-		data := make([]byte, bytesread)
-		copy(data, buffer[:bytesread])
+		size = size + int64(len(data))
+		hash := sha256.Sum256(data)
+		chunksHash = append(chunksHash, hash)
 		c := &storage.Chunk{Data: data, Hash: hash}
-		gsp.FileStorage.StoreChunk(c)
+		if !gsp.FileStorage.StoreChunk(c) {
+			gsp.Metrics.chunksReused.Inc()
+		}
 		// fmt.Printf("CHUNK %d STORED. HASH %x. \n", count, hash)
 	}
+	metafile, nodes := storage.BuildMetafile(chunksHash)
+	for _, node := range nodes {
+		gsp.FileStorage.StoreMetafile(sha256.Sum256(node), node)
+	}
 	metaHash := sha256.Sum256(metafile)
 	f := &storage.File{Name: filename, MetafileHash: metaHash, ChunkCount: count, Size: size}
 	gsp.FileStorage.StoreFile(f, metafile)
-	fmt.Printf("File stored in memory. Name : %s.Metahash : %x\n", f.Name, f.MetafileHash)
-	//register name on blockchain
-	if gsp.AdditionalFlags.HW3ex2 || gsp.AdditionalFlags.HW3ex3 {
-		gsp.PublishName(f)
+	filesLog.Tracef("File stored in memory. Name : %s.Metahash : %x\n", f.Name, f.MetafileHash)
+	return f
+}
+
+// newChunker returns the chunker of the shared files set by the configuration.
+func (gsp *Gossiper) newChunker(r io.Reader) *storage.Chunker {
+	files := gsp.Config().Files
+	if files.Chunking == constant.ChunkingCDC {
+		return storage.NewCDCChunker(r, files.MinChunkSize, files.ChunkSize, files.MaxChunkSize)
 	}
+	return storage.NewFixedChunker(r, files.ChunkSize)
 }
 
-func (gsp *Gossiper) startFileDownload(metahash utils.SHA256, peer string, filename string, chunkSources map[uint64][]string) {
-	go func() {
-		file := gsp.FileStorage.GetFile(metahash)
-		//fmt.Printf("STARTING FILE DOWNLOAD. Filename : %s. Peer : %s \n", filename, peer)
-		// if file != nil && file.Completed {
-		// 	// already have file
-		// 	fmt.Printf("File already downloaded \n")
-		// 	return
-		// }
-		if file == nil {
-			file = &storage.File{Name: filename, MetafileHash: metahash, ChunkCount: 0, Completed: false}
-		}
-		//get or request metafile
-		meta := gsp.FileStorage.GetMetafile(metahash)
-		if len(meta) == 0 {
-			fmt.Printf("DOWNLOADING metafile of %s from %s\n", filename, peer)
-			meta, err := gsp.downloadFromPeer(metahash, peer)
-			if err != nil {
-				// log.Printf("ERROR DOWNLOADING METAFILE FOR FILE %s FROM PEER %s", filename, peer)
-				file.Completed = false
-				return
-			}
-			if meta == nil {
-				// fmt.Printf("PEER DOES NOT HAVE THIS FILE. ABORTING.")
-				return
-			}
-			gsp.FileStorage.StoreMetafile(metahash, meta)
-		}
-		meta = gsp.FileStorage.GetMetafile(metahash)
-		toDownload := len(meta) / sha256.Size //number of chunks to download
-		file.ChunkCount = uint64(toDownload)
-
-		// create the slice of all hashes
-		var chunksHash []utils.SHA256
-		for i := 0; i < toDownload; i++ {
-			j := i * sha256.Size
-			k := j + sha256.Size
-			var hash utils.SHA256
-			copy(hash[:], meta[j:k])
-			chunksHash = append(chunksHash, hash)
-		}
-		var downloadedCount uint64 = 0
-		// download all the chunks
-		for downloadedCount < uint64(toDownload) {
-			h := chunksHash[downloadedCount]
-			chunk := gsp.FileStorage.GetChunkOrMeta(h)
-			if chunk == nil {
-				if chunkSources != nil {
-					peer = chunkSources[downloadedCount][0]
-				}
-				fmt.Printf("DOWNLOADING %s chunk %d from %s \n", filename, downloadedCount+1, peer)
-				data, err := gsp.downloadFromPeer(h, peer)
-				if err != nil {
-					//ABORTING
-					//log.Print(err)
-					file.Completed = false
-					return
-				}
-				chunk := &storage.Chunk{Data: data, Hash: h}
-				gsp.FileStorage.StoreChunk(chunk)
-			}
-			downloadedCount++
+// processDirectory indexes every regular file of the tree dirname of the shared directory,
+// and the manifest listing them. The whole tree is downloaded with the hash of the manifest.
+func (gsp *Gossiper) processDirectory(dirname string) {
+	root := filepath.Join(gsp.Config().Files.SharedDir, dirname)
+	manifest := &storage.Manifest{Entries: make([]storage.ManifestEntry, 0)}
+	var size int64 = 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-
-		// if _, err := os.Stat(FileOutDirectory); os.IsNotExist(err) {
-		// 	os.Mkdir(FileOutDirectory, os.ModePerm)
-		// }
-
-		out, err := os.Create(constant.FileOutDirectory + filename)
+		if !info.Mode().IsRegular() {
+			// directories are recreated from the paths of their files. Links are not followed
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
 		if err != nil {
-			//	fmt.Println("Impossible to create a new file \n", err)
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		f := gsp.indexFile(path, dirname+"/"+rel)
+		if f == nil {
+			return fmt.Errorf("cannot index %s", path)
+		}
+		manifest.Entries = append(manifest.Entries, storage.ManifestEntry{Path: rel, Size: f.Size, Metahash: f.MetafileHash[:]})
+		size += f.Size
+		return nil
+	})
+	if err != nil {
+		filesLog.Errorf("cannot share directory %s : %v", dirname, err)
+		return
+	}
+	meta, err := manifest.Encode()
+	if err != nil {
+		filesLog.Errorf("cannot encode the manifest of %s : %v", dirname, err)
+		return
+	}
+	if len(meta) > constant.MaxManifestSize {
+		filesLog.Errorf("cannot share directory %s : %d files are too many for a manifest", dirname, len(manifest.Entries))
+		return
+	}
+	d := &storage.File{Name: dirname, MetafileHash: sha256.Sum256(meta), ChunkCount: uint64(len(manifest.Entries)), Size: size, Directory: true}
+	gsp.FileStorage.StoreFile(d, meta)
+	filesLog.Infof("Directory stored in memory. Name : %s. Files : %d. Metahash : %x", d.Name, d.ChunkCount, d.MetafileHash)
+	if gsp.Config().PublishNames() {
+		gsp.PublishName(d)
+	}
+}
+
+func (gsp *Gossiper) startFileDownload(metahash utils.SHA256, peer string, filename string, chunkSources map[uint64][]string) {
+	if !gsp.DownloadSessions.Acquire(metahash) {
+		filesLog.Infof("%s is already being downloaded", filename)
+		return
+	}
+	started := gsp.spawn(func() {
+		defer gsp.DownloadSessions.Release(metahash)
+		if err := gsp.downloadFile(metahash, peer, filename, -1, chunkSources, true); err != nil {
 			return
 		}
-		//have all the chunks. Reconstructing the file
-		gsp.FileStorage.WriteChunksToFile(chunksHash, out)
-		file.Completed = true
-		gsp.FileStorage.StoreFile(file, meta)
-		fmt.Printf("RECONSTRUCTED file %s \n", filename)
 		if chunkSources != nil {
 			// succesuffly downloaded file from search
 			gsp.ToDownload.RemoveFileFromDownloadable(metahash, filename)
 		}
-	}()
+	})
+	if !started {
+		gsp.DownloadSessions.Release(metahash)
+	}
+}
+
+// downloadFile downloads the file of metahash from peer, or from chunkSources if not nil,
+// and reconstructs it as filename in the download directory. The file is preallocated if
+// its size is known, i.e. positive. A directory is downloaded file by file. If session is
+// set, the download is resumed after a restart.
+func (gsp *Gossiper) downloadFile(metahash utils.SHA256, peer string, filename string, size int64, chunkSources map[uint64][]string, session bool) error {
+	file := gsp.FileStorage.GetFile(metahash)
+	//fmt.Printf("STARTING FILE DOWNLOAD. Filename : %s. Peer : %s \n", filename, peer)
+	// if file != nil && file.Completed {
+	// 	// already have file
+	// 	fmt.Printf("File already downloaded \n")
+	// 	return
+	// }
+	if file == nil {
+		file = &storage.File{Name: filename, MetafileHash: metahash, ChunkCount: 0, Completed: false}
+	}
+	//get or request metafile
+	meta := gsp.FileStorage.GetMetafile(metahash)
+	if len(meta) == 0 {
+		filesLog.Tracef("DOWNLOADING metafile of %s from %s\n", filename, peer)
+		meta, err := gsp.downloadFromPeer(metahash, peer)
+		if err != nil {
+			// log.Printf("ERROR DOWNLOADING METAFILE FOR FILE %s FROM PEER %s", filename, peer)
+			file.Completed = false
+			return err
+		}
+		if meta == nil {
+			// fmt.Printf("PEER DOES NOT HAVE THIS FILE. ABORTING.")
+			return fmt.Errorf("%s does not have %s", peer, filename)
+		}
+		gsp.FileStorage.StoreMetafile(metahash, meta)
+	}
+	meta = gsp.FileStorage.GetMetafile(metahash)
+	if storage.IsManifest(meta) {
+		if !session {
+			return fmt.Errorf("%s : a directory cannot contain a manifest", filename)
+		}
+		return gsp.downloadDirectory(metahash, meta, peer, filename, chunkSources)
+	}
+	count, err := storage.ChunkCountOf(meta)
+	if err != nil {
+		filesLog.Errorf("cannot download %s : %v", filename, err)
+		return err
+	}
+	file.ChunkCount = count
+	if session {
+		gsp.DownloadSessions.Start(metahash, filename, peer, chunkSources, file.ChunkCount)
+	}
+	// if _, err := os.Stat(FileOutDirectory); os.IsNotExist(err) {
+	// 	os.Mkdir(FileOutDirectory, os.ModePerm)
+	// }
+
+	// the chunks are written to the file as they are downloaded
+	outPath := filepath.Join(gsp.Config().Files.DownloadDir, filepath.FromSlash(filename))
+	out, err := gsp.FileStorage.CreatePartial(outPath, size, count)
+	if err != nil {
+		filesLog.Errorf("cannot reconstruct %s : %v", filename, err)
+		return err
+	}
+	// download all the chunks, node by node of a metafile tree
+	download := func(first uint64, chunks []utils.SHA256) error {
+		if err := gsp.FileStorage.AddPartialChunks(out, chunks); err != nil {
+			return err
+		}
+		return gsp.downloadChunks(metahash, filename, chunks, first, count, peer, chunkSources, out)
+	}
+	if storage.IsTree(meta) {
+		getNode := func(hash utils.SHA256) (storage.Metafile, error) {
+			return gsp.downloadTreeNode(hash, peer, filename)
+		}
+		err = storage.WalkTree(meta, getNode, download)
+	} else {
+		err = download(0, storage.SplitHashes(meta))
+	}
+	if err == nil {
+		err = gsp.FileStorage.CompletePartial(out)
+	}
+	if err != nil {
+		//ABORTING
+		//log.Print(err)
+		filesLog.Warnf("cannot reconstruct %s : %v", filename, err)
+		gsp.FileStorage.AbortPartial(out)
+		file.Completed = false
+		return err
+	}
+	file.Completed = true
+	gsp.FileStorage.StoreFile(file, meta)
+	if session {
+		gsp.DownloadSessions.Remove(metahash)
+	}
+	gsp.Metrics.downloadedFiles.Inc()
+	filesLog.Tracef("RECONSTRUCTED file %s \n", filename)
+	return nil
+}
+
+// downloadTreeNode returns the node of a metafile tree, requesting it from peer if it is
+// not stored yet.
+func (gsp *Gossiper) downloadTreeNode(hash utils.SHA256, peer string, filename string) (storage.Metafile, error) {
+	if node := gsp.FileStorage.GetMetafile(hash); node != nil {
+		return node, nil
+	}
+	filesLog.Debugf("DOWNLOADING metafile node %x of %s from %s", hash, filename, peer)
+	node, err := gsp.downloadFromPeer(hash, peer)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fmt.Errorf("%s does not have the metafile of %s", peer, filename)
+	}
+	gsp.FileStorage.StoreMetafile(hash, node)
+	return node, nil
+}
+
+// downloadDirectory downloads the files listed by the manifest of a directory and recreates
+// the tree as dirname in the download directory. The files are spread across the peers
+// having the directory.
+func (gsp *Gossiper) downloadDirectory(metahash utils.SHA256, meta storage.Metafile, peer string, dirname string, chunkSources map[uint64][]string) error {
+	manifest, err := storage.DecodeManifest(meta)
+	if err != nil {
+		filesLog.Errorf("cannot download directory %s : %v", dirname, err)
+		return err
+	}
+	sources := []string{peer}
+	if chunkSources != nil && len(chunkSources[0]) > 0 {
+		sources = chunkSources[0]
+	}
+	gsp.DownloadSessions.Start(metahash, dirname, peer, chunkSources, 1)
+	downloadDir := gsp.Config().Files.DownloadDir
+	var size int64 = 0
+	for i, e := range manifest.Entries {
+		filename := dirname + "/" + e.Path
+		size += e.Size
+		if e.Size == 0 {
+			// nothing to download
+			if err := createEmptyFile(filepath.Join(downloadDir, filepath.FromSlash(filename))); err != nil {
+				filesLog.Errorf("cannot reconstruct %s : %v", filename, err)
+				return err
+			}
+			continue
+		}
+		err := gsp.downloadFile(utils.SliceToHash(e.Metahash), sources[i%len(sources)], filename, e.Size, nil, false)
+		if err != nil {
+			filesLog.Warnf("cannot download directory %s : %v", dirname, err)
+			return err
+		}
+	}
+	d := &storage.File{Name: dirname, MetafileHash: metahash, ChunkCount: uint64(len(manifest.Entries)), Completed: true, Size: size, Directory: true}
+	gsp.FileStorage.StoreFile(d, meta)
+	gsp.DownloadSessions.Remove(metahash)
+	filesLog.Infof("RECONSTRUCTED directory %s", dirname)
+	return nil
+}
+
+// createEmptyFile creates the empty file at path and its parent directories.
+func createEmptyFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// resumeDownloads restarts the downloads that were interrupted by a restart of the gossiper.
+func (gsp *Gossiper) resumeDownloads() {
+	for _, s := range gsp.DownloadSessions.GetAll() {
+		filesLog.Infof("RESUMING download of %s", s.Filename)
+		gsp.startFileDownload(s.Metahash, s.Peer, s.Filename, s.Sources)
+	}
 }
 
 func (gsp *Gossiper) downloadFromPeer(hash utils.SHA256, peer string) ([]byte, error) {
+	return gsp.downloadFromPeerWithTries(hash, peer, gsp.Config().Files.MaxChunkDownloadTries)
+}
+
+// downloadFromPeerWithTries requests hash from peer, retransmitting the request up to
+// maxTries times. Returns nil data if the peer does not have it.
+func (gsp *Gossiper) downloadFromPeerWithTries(hash utils.SHA256, peer string, maxTries int) ([]byte, error) {
 	tries := 1
-	timeoutTimer := time.Duration(constant.Timeout) * time.Second
-	timer := time.NewTicker(timeoutTimer)
+	timeoutTimer := time.Duration(gsp.Config().Timers.DataRequestTimeout) * time.Second
+	timer := gsp.clock.NewTicker(timeoutTimer)
 	defer timer.Stop()
 	callback := gsp.WaitingForData.RegisterFileObserver(hash)
-	defer gsp.WaitingForData.UnregisterFileObserver(hash)
+	defer gsp.WaitingForData.UnregisterFileObserver(hash, callback)
 	// fmt.Printf("REGISTERING OBSERVER %x \n", hash)
-	dr := message.NewDataRequest(gsp.Name, peer, constant.DefaultHopLimit, hash)
+	dr := message.NewDataRequest(gsp.Name, peer, gsp.Config().HopLimit, hash)
+	gsp.signDataRequest(dr)
 	gsp.forwardDataRequest(dr)
-	for tries <= constant.MaxChunkDownloadTries {
+	for tries <= maxTries {
 		select {
-		case <-timer.C:
+		case <-timer.C():
 			//timeout restransmitting data request
 			//	fmt.Printf("TIMEOUT FOR CHUNK %x. Retrying %d more time. \n", hash, maxChunkDownloadTries-tries)
 		case reply := <-callback:
@@ -175,6 +364,8 @@ func (gsp *Gossiper) downloadFromPeer(hash utils.SHA256, peer string) ([]byte, e
 			if bytes.Compare(h[:], reply.HashValue) == 0 {
 				return data, nil
 			}
+		case <-gsp.ctx.Done():
+			return nil, gsp.ctx.Err()
 		}
 		tries++
 		gsp.forwardDataRequest(dr)
@@ -195,7 +386,8 @@ func (gsp *Gossiper) processDataRequest(dr *message.DataRequest) {
 		if data == nil {
 			data = make([]byte, 0)
 		}
-		r := message.NewDataReply(gsp.Name, constant.DefaultHopLimit, dr, data)
+		r := message.NewDataReply(gsp.Name, gsp.Config().HopLimit, dr, data)
+		gsp.signDataReply(r)
 		gsp.forwardDataReply(r)
 	}
 }
@@ -1,13 +1,23 @@
 package gossiper
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/dedis/protobuf"
 	"github.com/vquelque/Peerster/blockchain"
+	"github.com/vquelque/Peerster/clock"
+	"github.com/vquelque/Peerster/config"
 	"github.com/vquelque/Peerster/constant"
+	"github.com/vquelque/Peerster/identity"
 	"github.com/vquelque/Peerster/message"
 	"github.com/vquelque/Peerster/observer"
 	"github.com/vquelque/Peerster/peers"
@@ -33,19 +43,41 @@ type Gossiper struct {
 	WaitingForAck         *observer.Observer     //registered go routines channels waiting for an ACK.
 	WaitingForData        *observer.FileObserver //registered routines waiting for file data
 	WaitingForSearchReply *observer.SearchObserver
-	AntiEntropyTimer      int
 	ResetAntiEntropyTimer chan bool
 	Routing               *routing.Routing
-	Rtimer                int
 	UIStorage             *storage.UIStorage
 	PendingSearchRequest  *storage.PendingRequests
 	SearchResults         *storage.SearchResults
 	ToDownload            *storage.ToDownload
+	DownloadSessions      *storage.DownloadSessions
+	History               *storage.History //rumors and private messages persisted across restarts
 	Blockchain            *blockchain.Blockchain
-	AdditionalFlags       *utils.AdditionalFlags
+	config                *config.Config //see Config
+	configLock            sync.RWMutex
+	configLoader          func() (*config.Config, error) //reloads the configuration. See ReloadConfig
+	antiEntropyReload     chan bool                      //wakes up the periodic handlers after a reload
+	routingReload         chan bool
+	pools                 [classCount]*workerPool //process the packets received from the peers
+	clock                 clock.Clock             //drives all the timers of the handlers
+	rand                  *rand.Rand              //all the random choices, seeded with the seed of the configuration
+	limiter               *rateLimiter            //rates of the packets of each source and origin
+	violations            *rateLimiter            //packets over the limits of each source, see limitExceeded
+	statusDeltas          *vector.Deltas          //status packets exchanged with each neighbor
+	ctx                   context.Context         //cancelled by Stop
+	cancel                context.CancelFunc
+	routines              sync.WaitGroup //loops and handlers, waited for by Stop
+	receivers             sync.WaitGroup //loops reading the sockets
+	routinesLock          sync.Mutex
+	acceptLock            sync.Mutex //see acceptRumor
+	started               bool
+	stopped               bool
+	shutdownHooks         []func(context.Context) error
 	TLCStorage            *storage.TLCStorage
 	WaitingForTLCAck      *observer.TLCAckObserver
-	HopLimit              uint32
+	WaitingForPrivateAck  *observer.PrivateAckObserver
+	Identity              *identity.Identity //key pair bound to Name
+	Keys                  *identity.KeyStore //public keys pinned for the other gossipers
+	Metrics               *GossiperMetrics
 }
 
 // GossipPacket is the only type of packet sent to other peers.
@@ -60,6 +92,10 @@ type GossipPacket struct {
 	SearchReply   *message.SearchReply
 	TLCMessage    *message.TLCMessage
 	Ack           *message.TLCAck
+	EncPrivate    *message.EncryptedPrivateMessage
+	PrivateAck    *message.PrivateAck
+	Hello         *message.Hello
+	Compressed    *message.CompressedPacket //see encodePacket
 }
 
 // Encapsulate received messages from peers/client to put in the queue
@@ -68,29 +104,110 @@ type receivedPackets struct {
 	sender string
 }
 
-// NewGossiper creates and returns a new gossiper running at given address, port with given name.
-func NewGossiper(address string, name string, uiPort int, peersList string, simple bool, antiEntropyTimer int, rtimer int, hoplimit uint32, additionalFlags *utils.AdditionalFlags) *Gossiper {
-	peersSocket := socket.NewUDPSocket(address)
-	uiSocket := socket.NewUDPSocket(fmt.Sprintf("127.0.0.1:%d", uiPort))
-	peersSet := peers.NewPeersSet(peersList)
+// NewGossiper creates and returns a new gossiper described by the given configuration.
+func NewGossiper(cfg *config.Config) *Gossiper {
+	var peersSocket socket.Socket
+	if cfg.Transport == constant.TransportTCP {
+		peersSocket = socket.NewTCPSocket(cfg.GossipAddr)
+	} else {
+		peersSocket = socket.NewUDPSocket(cfg.GossipAddr)
+	}
+	uiSocket := socket.NewUDPSocket(fmt.Sprintf("127.0.0.1:%d", cfg.UIPort))
+	gsp := NewGossiperWithSockets(peersSocket, uiSocket, cfg, nil)
+	if tcp, ok := peersSocket.(*socket.TCPSocket); ok {
+		tcp.SetAdmit(gsp.admitConnection)
+	}
+	return gsp
+}
+
+// NewGossiperWithSockets creates a gossiper on top of the given peers and client sockets,
+// whose timers run on clk. Used to run gossipers on a simulated network (see
+// socket.SimNetwork). The default configuration and the real clock are used if cfg and
+// clk are nil.
+func NewGossiperWithSockets(peersSocket socket.Socket, uiSocket socket.Socket, cfg *config.Config, clk clock.Clock) *Gossiper {
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	name := cfg.Name
+	simple := cfg.Simple
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = clk.Now().UnixNano()
+	}
+	rnd := utils.NewRand(seed)
+	peersSet := peers.NewPeersSet(cfg.PeersList(), clk, rnd)
+	if !simple && cfg.Timers.Heartbeat > 0 {
+		heartbeat := time.Duration(cfg.Timers.Heartbeat) * time.Second
+		peersSet.SetTimeouts(constant.PeerSuspectHeartbeats*heartbeat, constant.PeerDeadHeartbeats*heartbeat, time.Duration(cfg.Timers.PeerEvictTimeout)*time.Second)
+	}
 	vectorClock := vector.NewVector()
 	rumorStorage := storage.NewRumorStorage()
-	privateStorage := storage.NewPrivateStorage()
+	privateIDsPath := ""
+	if path := keyPath(cfg); path != "" {
+		// the IDs of the private messages are bound to the identity of the gossiper
+		privateIDsPath = strings.TrimSuffix(path, filepath.Ext(path)) + ".private"
+	}
+	privateStorage, err := storage.NewPrivateStorage(privateIDsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
 	fileStorage := storage.NewFileStorage()
+	if cfg.Files.DataDir != "" {
+		fileStorage, err = storage.NewDiskFileStorage(cfg.Files.DataDir, cfg.Files.CacheChunks)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	waitingForAck := observer.Init()
 	waitingForData := observer.InitFileObserver()
 	waitingForSearchReply := observer.InitSearchObserver()
 	resetAntiEntropyChan := make(chan (bool))
-	routing := routing.NewRoutingTable()
+	routing := routing.NewRoutingTable(clk)
+	routing.SetTimeouts(routeTimeouts(cfg))
+	routing.SetLatency(peersSet.RTT)
 	uiStorage := storage.NewUIStorage()
 	searchResults := storage.NewSearchResult()
 	toDownload := storage.NewToDownload()
+	sessionsDir := ""
+	if cfg.Files.DataDir != "" {
+		sessionsDir = filepath.Join(cfg.Files.DataDir, "downloads")
+	}
+	downloadSessions, err := storage.NewDownloadSessions(sessionsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	historyDir := ""
+	if cfg.Files.DataDir != "" {
+		historyDir = filepath.Join(cfg.Files.DataDir, "history")
+	}
+	history, err := storage.NewHistory(historyDir)
+	if err != nil {
+		log.Fatal(err)
+	}
 	pendingSearchRequest := storage.NewPendingRequests()
 	blockchain := blockchain.InitBlockchain(name)
 	tlcStorage := storage.NewTLCMessageStorage()
 	waitingForTLCAck := observer.InitTLCAckObserver()
+	waitingForPrivateAck := observer.InitPrivateAckObserver()
+	var id *identity.Identity
+	if path := keyPath(cfg); path != "" {
+		id, err = identity.LoadOrCreateIdentity(name, path)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		id = identity.NewIdentity(name)
+	}
+	keys := identity.NewKeyStore()
+	keys.Pin(name, id.PublicKey)
+	keys.PinEncryptionKey(name, id.EncryptionKey)
 
-	return &Gossiper{
+	ctx, cancel := context.WithCancel(context.Background())
+
+	gsp := &Gossiper{
 		Name:                  name,
 		Peers:                 peersSet,
 		Simple:                simple,
@@ -104,20 +221,54 @@ func NewGossiper(address string, name string, uiPort int, peersList string, simp
 		WaitingForData:        waitingForData,
 		WaitingForSearchReply: waitingForSearchReply,
 		Active:                sync.WaitGroup{},
-		AntiEntropyTimer:      antiEntropyTimer,
 		ResetAntiEntropyTimer: resetAntiEntropyChan,
 		Routing:               routing,
-		Rtimer:                rtimer,
 		UIStorage:             uiStorage,
 		SearchResults:         searchResults,
 		ToDownload:            toDownload,
+		DownloadSessions:      downloadSessions,
+		History:               history,
 		PendingSearchRequest:  pendingSearchRequest,
 		Blockchain:            blockchain,
-		AdditionalFlags:       additionalFlags,
+		config:                cfg,
+		antiEntropyReload:     make(chan bool, 1),
+		routingReload:         make(chan bool, 1),
+		pools:                 newWorkerPools(cfg.Workers),
+		clock:                 clk,
+		rand:                  rnd,
+		limiter:               newRateLimiter(clk, maxBuckets),
+		violations:            newRateLimiter(clk, maxViolations),
+		statusDeltas:          vector.NewDeltas(),
+		ctx:                   ctx,
+		cancel:                cancel,
 		TLCStorage:            tlcStorage,
 		WaitingForTLCAck:      waitingForTLCAck,
-		HopLimit:              hoplimit,
+		WaitingForPrivateAck:  waitingForPrivateAck,
+		Identity:              id,
+		Keys:                  keys,
 	}
+	gsp.Metrics = newGossiperMetrics(gsp)
+	gsp.replayHistory()
+	return gsp
+}
+
+// keyPath returns the file persisting the identity key of the gossiper, "" to generate a
+// new identity at every start. A gossiper without data directory keeps its key in the home
+// directory, or in the working directory if there is none.
+func keyPath(cfg *config.Config) string {
+	switch {
+	case cfg.Files.KeyFile == constant.NoKeyFile:
+		return ""
+	case cfg.Files.KeyFile != "":
+		return cfg.Files.KeyFile
+	case cfg.Files.DataDir != "":
+		return filepath.Join(cfg.Files.DataDir, "identity.key")
+	}
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, constant.KeyDirectory, url.PathEscape(cfg.Name)+".key")
 }
 
 ////////////////////////////
@@ -126,10 +277,13 @@ func NewGossiper(address string, name string, uiPort int, peersList string, simp
 
 // serialize with protobuf and send the gossipPacket to the provided UDP addr using the provided gossiper
 func (gsp *Gossiper) send(gossipPacket *GossipPacket, addr string) {
-	pkt, err := protobuf.Encode(gossipPacket)
+	pkt, err := gsp.encodePacket(gossipPacket, addr)
 	if err != nil {
-		//log.Print(err)
+		netLog.Errorf("cannot encode packet for %s : %v", addr, err)
+		return
 	}
+	gsp.Metrics.packetsSent.With(packetType(gossipPacket)).Inc()
+	gsp.Metrics.bytesSent.Add(uint64(len(pkt)))
 	gsp.PeersSocket.Send(pkt, addr)
 }
 
@@ -150,8 +304,8 @@ func (gsp *Gossiper) newForwardedMessage(msg *message.SimpleMessage) *message.Si
 }
 
 func (gsp *Gossiper) processSimpleMessage(msg *message.SimpleMessage) {
-	fmt.Println(msg.String())
-	fmt.Println(gsp.Peers.PrintPeers())
+	netLog.Tracef("%s\n", msg.String())
+	netLog.Tracef("%s\n", gsp.Peers.PrintPeers())
 	fwdMsg := gsp.newForwardedMessage(msg)
 	packet := &GossipPacket{Simple: fwdMsg}
 	gsp.broadcastPacket(packet, msg.RelayPeerAddr)
@@ -160,44 +314,65 @@ func (gsp *Gossiper) processSimpleMessage(msg *message.SimpleMessage) {
 ////////////////////////////
 // Routing //
 ////////////////////////////
+// Sends route rumors every rtimer seconds. Idle while rtimer is 0.
 func (gsp *Gossiper) startRoutingMessageHandler() {
-	rTimerDuration := time.Duration(gsp.Rtimer) * time.Second
-	timer := time.NewTicker(rTimerDuration)
-	//send initial routing message to all neighbors
-	for _, peer := range gsp.Peers.GetAllPeers() {
-		gsp.sendRouteRumor(peer)
-	}
-	go func() {
+	gsp.spawn(func() {
+		var timer clock.Ticker
+		var tick <-chan time.Time
 		for {
+			rtimer := gsp.Config().Timers.RTimer
+			if timer == nil && rtimer > 0 {
+				//send initial routing message to all neighbors
+				for _, peer := range gsp.Peers.GetAllPeers() {
+					gsp.sendRouteRumor(peer)
+				}
+			}
+			timer, tick = gsp.resetTicker(timer, rtimer)
 			select {
-			case <-timer.C:
+			case <-tick:
 				// timer elapsed : send route rumor packet to randomly chosen peer
 				randPeer := gsp.Peers.PickRandomPeer("")
 				if randPeer != "" {
 					gsp.sendRouteRumor(randPeer)
 				}
+			case <-gsp.routingReload:
+			case <-gsp.ctx.Done():
+				gsp.resetTicker(timer, 0)
+				return
 			}
 		}
-	}()
+	})
 }
 
 func (gsp *Gossiper) sendRouteRumor(peer string) {
 	rID := gsp.VectorClock.NextMessageForPeer(gsp.Name)
 	r := message.NewRouteRumorMessage(gsp.Name, rID)
+	gsp.signRumor(r)
+	gsp.History.SetLastRouteRumor(rID)
 	gsp.processRumorMessage(r, "")
 }
 
 ////////////////////////////
 // Network //
 ////////////////////////////
-// Handles the incoming packets.
-func handleIncomingPackets(socket socket.Socket) <-chan *receivedPackets {
+// Handles the incoming packets until the socket is closed.
+func (gsp *Gossiper) handleIncomingPackets(socket socket.Socket) <-chan *receivedPackets {
 	out := make(chan *receivedPackets, constant.ChannelSize)
+	gsp.receivers.Add(1)
 	go func() {
+		defer gsp.receivers.Done()
 		for {
 			data, sender := socket.Receive()
+			if sender == "" {
+				// socket closed
+				return
+			}
 			receivedPackets := &receivedPackets{data: data, sender: sender}
-			out <- receivedPackets
+			select {
+			case out <- receivedPackets:
+			case <-gsp.ctx.Done():
+				return
+			}
 		}
 	}()
 	return out
@@ -208,45 +383,86 @@ func (gsp *Gossiper) processMessages(peerMsgs <-chan *receivedPackets, clientMsg
 	for {
 		select {
 		case peerMsg := <-peerMsgs:
-			var gp *GossipPacket = &GossipPacket{}
-			err := protobuf.Decode(peerMsg.data, gp)
+			if gsp.Peers.IsBanned(peerMsg.sender) {
+				gsp.Metrics.packetsBanned.Inc()
+				continue
+			}
+			gp, err := gsp.decodePacket(peerMsg.data)
 			if peerMsg.sender != "" {
-				gsp.Peers.Add(peerMsg.sender)
+				gsp.Peers.Seen(peerMsg.sender)
 			}
 			if err != nil {
-				// log.Print(err)
+				netLog.Warnf("cannot decode packet from %s : %v", peerMsg.sender, err)
+				continue
+			}
+			gsp.Metrics.packetsReceived.With(packetType(gp)).Inc()
+			gsp.Metrics.bytesReceived.Add(uint64(len(peerMsg.data)))
+			if !gsp.admitSource(gp, peerMsg.sender) {
+				continue
+			}
+			if !gsp.verifyPacket(gp) {
+				// forged or unknown origin
+				netLog.Debugf("dropping %s packet from %s : invalid signature", packetType(gp), peerMsg.sender)
+				continue
+			}
+			if !gsp.admitOrigin(gp, peerMsg.sender) {
+				continue
+			}
+			if peerMsg.sender != "" {
+				gsp.Routing.NeighborSeen(peerMsg.sender)
+				gsp.greet(peerMsg.sender)
 			}
+			if gp.StatusPacket != nil && !gsp.decodeStatus(gp, peerMsg.sender) {
+				continue
+			}
+			if gp.RumorMessage != nil {
+				// one more hop from the origin
+				gp.RumorMessage.HopCount++
+			}
+			var handle func()
 			switch {
 			case gp.Simple != nil:
 				// received a simple message
-				go gsp.processSimpleMessage(gp.Simple)
+				handle = func() { gsp.processSimpleMessage(gp.Simple) }
 			case gp.RumorMessage != nil:
 				// received a rumorMessage
-				go gsp.processRumorMessage(gp.RumorMessage, peerMsg.sender)
+				handle = func() { gsp.processRumorMessage(gp.RumorMessage, peerMsg.sender) }
 			case gp.StatusPacket != nil:
-				go gsp.processStatusPacket(gp.StatusPacket, peerMsg.sender)
+				handle = func() { gsp.processStatusPacket(gp.StatusPacket, peerMsg.sender) }
 			case gp.Private != nil:
-				go gsp.processPrivateMessage(gp.Private)
+				handle = func() { gsp.processPrivateMessage(gp.Private) }
 			case gp.DataRequest != nil:
-				go gsp.processDataRequest(gp.DataRequest)
+				handle = func() { gsp.processDataRequest(gp.DataRequest) }
 			case gp.DataReply != nil:
-				go gsp.processDataReply(gp.DataReply)
+				handle = func() { gsp.processDataReply(gp.DataReply) }
 			case gp.SearchRequest != nil:
-				go gsp.processSearchRequest(gp.SearchRequest, peerMsg.sender)
+				handle = func() { gsp.processSearchRequest(gp.SearchRequest, peerMsg.sender) }
 			case gp.SearchReply != nil:
-				go gsp.processSearchReply(gp.SearchReply)
+				handle = func() { gsp.processSearchReply(gp.SearchReply) }
 			case gp.TLCMessage != nil:
-				go gsp.processTLCMessage(gp.TLCMessage, peerMsg.sender)
+				handle = func() { gsp.processTLCMessage(gp.TLCMessage, peerMsg.sender) }
 			case gp.Ack != nil:
-				go gsp.processTLCAck(*gp.Ack)
+				handle = func() { gsp.processTLCAck(*gp.Ack) }
+			case gp.EncPrivate != nil:
+				handle = func() { gsp.processEncryptedPrivateMessage(gp.EncPrivate) }
+			case gp.PrivateAck != nil:
+				handle = func() { gsp.processPrivateAck(gp.PrivateAck) }
+			case gp.Hello != nil:
+				handle = func() { gsp.processHello(gp.Hello, peerMsg.sender) }
+			default:
+				continue
 			}
+			gsp.dispatch(gp, handle)
 		case cliMsg := <-clientMsgs:
 			msg := &message.Message{}
 			err := protobuf.Decode(cliMsg.data, msg)
 			if err != nil {
-				//	log.Print(err)
+				netLog.Warnf("cannot decode client message from %s : %v", cliMsg.sender, err)
+				continue
 			}
-			go gsp.ProcessClientMessage(msg)
+			gsp.ProcessClientMessageAsync(msg)
+		case <-gsp.ctx.Done():
+			return
 		}
 	}
 }
@@ -254,27 +470,38 @@ func (gsp *Gossiper) processMessages(peerMsgs <-chan *receivedPackets, clientMsg
 ////////////////////////////
 // Gossiper //
 ////////////////////////////
-// Kills the gossiper
+// Kills the gossiper without waiting for a deadline. See Stop.
 func (gsp *Gossiper) KillGossiper() {
-	gsp.PeersSocket.Close()
-	gsp.UISocket.Close()
-	gsp.Active.Done()
-	gsp = nil
+	gsp.Stop(context.Background())
 }
 
-// Starts the gossiper
+// Starts the gossiper. It is started once : Start does nothing after Stop.
 func (gsp *Gossiper) Start() {
+	gsp.routinesLock.Lock()
+	if gsp.started || gsp.stopped {
+		gsp.routinesLock.Unlock()
+		netLog.Errorf("Gossiper %s cannot be started again", gsp.Name)
+		return
+	}
+	gsp.started = true
+	gsp.routinesLock.Unlock()
 	gsp.Active.Add(1)
-	peerChan := handleIncomingPackets(gsp.PeersSocket)
-	clientChan := handleIncomingPackets(gsp.UISocket)
-	go gsp.processMessages(peerChan, clientChan)
-	if !gsp.Simple && gsp.AntiEntropyTimer > 0 {
+	peerChan := gsp.handleIncomingPackets(gsp.PeersSocket)
+	clientChan := gsp.handleIncomingPackets(gsp.UISocket)
+	gsp.startWorkers()
+	gsp.spawn(func() { gsp.processMessages(peerChan, clientChan) })
+	if !gsp.Simple {
 		gsp.startAntiEntropyHandler()
 	}
-	if gsp.Rtimer > 0 {
-		gsp.startRoutingMessageHandler()
+	if !gsp.Simple && gsp.Config().Timers.Heartbeat > 0 {
+		gsp.startHeartbeatHandler()
+	}
+	gsp.startRoutingMessageHandler()
+	for _, peer := range gsp.Peers.GetAllPeers() {
+		gsp.greet(peer)
 	}
-	if gsp.AdditionalFlags.HW3ex2 || gsp.AdditionalFlags.HW3ex3 {
+	if gsp.Config().PublishNames() {
 		gsp.StartTLCRoundHandler()
 	}
+	gsp.resumeDownloads()
 }
@@ -0,0 +1,77 @@
+package gossiper
+
+import (
+	"time"
+
+	"github.com/vquelque/Peerster/constant"
+	"github.com/vquelque/Peerster/message"
+)
+
+// localCapabilities returns the capabilities advertised to the peers.
+func (gsp *Gossiper) localCapabilities() message.Capabilities {
+	caps := message.CapTLC | message.CapEncryptedPrivate | message.CapCompression | message.CapDeltaStatus
+	if gsp.Config().Transport == constant.TransportTCP {
+		caps |= message.CapTCP
+	}
+	return caps
+}
+
+// sendHello advertises our protocol version and capabilities to peer.
+func (gsp *Gossiper) sendHello(peer string, reply bool) {
+	h := &message.Hello{Version: constant.ProtocolVersion, Capabilities: gsp.localCapabilities(), Reply: reply}
+	gsp.send(&GossipPacket{Hello: h}, peer)
+}
+
+// greet sends a hello to peer if its capabilities are still unknown. A peer which does not
+// answer, as the peers running the original protocol, is greeted again after HelloRetry.
+func (gsp *Gossiper) greet(peer string) {
+	if gsp.Simple {
+		return
+	}
+	if gsp.Peers.NeedHello(peer, constant.HelloRetry*time.Second) {
+		gsp.sendHello(peer, false)
+	}
+}
+
+// processHello records the version and the capabilities of sender, and answers its hello.
+func (gsp *Gossiper) processHello(h *message.Hello, sender string) {
+	if h.Version == 0 {
+		return
+	}
+	version, caps, known := gsp.Peers.Capabilities(sender)
+	gsp.Peers.SetCapabilities(sender, h.Version, h.Capabilities)
+	if !known || version != h.Version || caps != h.Capabilities {
+		netLog.Infof("peer %s speaks version %d with capabilities %v", sender, h.Version, h.Capabilities.Names())
+	}
+	if !h.Reply {
+		gsp.sendHello(sender, true)
+	}
+}
+
+// supports checks if peer advertised all the capabilities of c. The peers which never sent
+// a hello are assumed to support the baseline capabilities only.
+func (gsp *Gossiper) supports(peer string, c message.Capabilities) bool {
+	_, caps, known := gsp.Peers.Capabilities(peer)
+	if !known {
+		caps = message.BaselineCapabilities
+	}
+	return caps.Has(c)
+}
+
+// pickPeer picks a random peer, except the given one, to monger pkt among the peers
+// supporting it. Returns an empty string if there is no such peer.
+func (gsp *Gossiper) pickPeer(pkt *message.RumorPacket, except string) string {
+	if pkt.TLCMessage == nil {
+		return gsp.Peers.PickRandomPeer(except)
+	}
+	candidates := make([]string, 0)
+	for _, peer := range gsp.Peers.GetAllPeersExcept(except) {
+		if gsp.supports(peer, message.CapTLC) {
+			candidates = append(candidates, peer)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[gsp.rand.Intn(len(candidates))]
+}
@@ -0,0 +1,88 @@
+package gossiper
+
+import (
+	"github.com/vquelque/Peerster/message"
+	"github.com/vquelque/Peerster/storage"
+)
+
+// replayHistory restores the rumors, TLC messages and private conversations logged by a
+// previous run, so that the vector clock resumes with the right sequence numbers.
+// Route rumors are not logged : ours are signed again, and the vector clock skips the
+// ones of the other origins, which we then cannot send to the peers.
+func (gsp *Gossiper) replayHistory() {
+	rumors, err := gsp.History.Rumors()
+	if err != nil {
+		rumorLog.Errorf("cannot replay rumors history : %v", err)
+	}
+	for _, pkt := range rumors {
+		origin, id, rumor := pkt.GetDetails()
+		if origin == gsp.Name && id > 0 {
+			gsp.restoreRouteRumors(id - 1)
+		}
+		next := gsp.VectorClock.NextMessageForPeer(origin)
+		if id < next {
+			continue
+		}
+		// pin the keys of the origin as if the packet was just received
+		gp := &GossipPacket{RumorMessage: pkt.RumorMessage, TLCMessage: pkt.TLCMessage}
+		if !gsp.verifyPacket(gp) {
+			continue
+		}
+		for ; next < id; next++ {
+			// a route rumor of origin
+			gsp.VectorClock.IncrementMIDForPeer(origin, true)
+		}
+		gsp.RumorStorage.Skip(origin, id)
+		gsp.VectorClock.IncrementMIDForPeer(origin, rumor)
+		gsp.RumorStorage.Store(pkt)
+		if rumor && pkt.RumorMessage.Text != "" {
+			gsp.UIStorage.AppendRumor(pkt.RumorMessage)
+		}
+		if !rumor && pkt.TLCMessage.Confirmed > 0 {
+			gsp.UIStorage.AppendConfirmedRumor(pkt.TLCMessage)
+		}
+	}
+	gsp.restoreRouteRumors(gsp.History.LastRouteRumor())
+
+	conversations, err := gsp.History.Private()
+	if err != nil {
+		privateLog.Errorf("cannot replay private history : %v", err)
+	}
+	for peer, records := range conversations {
+		// the last record of a message we sent holds its final status
+		status := make(map[uint32]string)
+		for _, r := range records {
+			if r.Status != "" {
+				status[r.ID] = r.Status
+			}
+		}
+		for _, r := range records {
+			if r.Message == nil {
+				continue
+			}
+			sent := r.Message.Origin == gsp.Name && peer != gsp.Name
+			gsp.PrivateStorage.Restore(r.Message, peer, sent)
+			if !sent {
+				gsp.UIStorage.StorePrivateMsg(r.Message, peer)
+				continue
+			}
+			gsp.UIStorage.StoreSentPrivateMsg(r.Message, peer)
+			if status[r.ID] == storage.DeliveryPending {
+				// the retransmissions stopped with the previous run
+				status[r.ID] = storage.DeliveryFailed
+				gsp.History.AppendPrivateStatus(peer, r.ID, storage.DeliveryFailed)
+			}
+			gsp.UIStorage.SetPrivateMsgStatus(peer, r.ID, status[r.ID])
+		}
+	}
+}
+
+// restoreRouteRumors signs again our route rumors up to id, which are not logged.
+func (gsp *Gossiper) restoreRouteRumors(id uint32) {
+	for next := gsp.VectorClock.NextMessageForPeer(gsp.Name); next <= id; next++ {
+		r := message.NewRouteRumorMessage(gsp.Name, next)
+		gsp.signRumor(r)
+		gsp.VectorClock.IncrementMIDForPeer(gsp.Name, true)
+		gsp.RumorStorage.Store(&message.RumorPacket{RumorMessage: r})
+	}
+}
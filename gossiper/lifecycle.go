@@ -0,0 +1,93 @@
+package gossiper
+
+import (
+	"context"
+	"sync"
+
+	"github.com/vquelque/Peerster/message"
+)
+
+// spawn runs f in a goroutine tracked by Stop. Returns false, without running f, once
+// the gossiper is stopping.
+func (gsp *Gossiper) spawn(f func()) bool {
+	gsp.routinesLock.Lock()
+	defer gsp.routinesLock.Unlock()
+	if gsp.stopped {
+		return false
+	}
+	gsp.routines.Add(1)
+	go func() {
+		defer gsp.routines.Done()
+		f()
+	}()
+	return true
+}
+
+// OnShutdown registers a hook called first when the gossiper stops, e.g. to close the
+// web server so that no more client messages are received.
+func (gsp *Gossiper) OnShutdown(hook func(context.Context) error) {
+	gsp.routinesLock.Lock()
+	defer gsp.routinesLock.Unlock()
+	gsp.shutdownHooks = append(gsp.shutdownHooks, hook)
+}
+
+// ProcessClientMessageAsync queues the client message in the pool of the client
+// messages. The message is dropped if the queue is full.
+func (gsp *Gossiper) ProcessClientMessageAsync(msg *message.Message) {
+	if !gsp.enqueue(classClient, func() { gsp.ProcessClientMessage(msg) }) {
+		gsp.Metrics.packetsDropped.With("client").Inc()
+		netLog.Warnf("dropping client message : %s queue full", classNames[classClient])
+	}
+}
+
+// Stop gracefully stops the gossiper. The shutdown hooks are called, all the loops are
+// cancelled and the in-flight handlers drained before the sockets are closed and the
+// storages flushed. Returns when all the goroutines exited, or with the error of ctx if
+// it expires first. The gossiper cannot be started again.
+func (gsp *Gossiper) Stop(ctx context.Context) error {
+	gsp.routinesLock.Lock()
+	if gsp.stopped {
+		gsp.routinesLock.Unlock()
+		return nil
+	}
+	gsp.stopped = true
+	started := gsp.started
+	hooks := gsp.shutdownHooks
+	gsp.routinesLock.Unlock()
+
+	var err error
+	for _, hook := range hooks {
+		if hookErr := hook(ctx); hookErr != nil && err == nil {
+			err = hookErr
+		}
+	}
+	gsp.cancel()
+	if waitErr := wait(ctx, &gsp.routines); waitErr != nil {
+		err = waitErr
+	}
+	gsp.PeersSocket.Close()
+	gsp.UISocket.Close()
+	if waitErr := wait(ctx, &gsp.receivers); waitErr != nil {
+		err = waitErr
+	}
+	gsp.History.Close()
+	if started {
+		gsp.Active.Done()
+	}
+	return err
+}
+
+// wait waits for the wait group, or until ctx expires.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
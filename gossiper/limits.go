@@ -0,0 +1,204 @@
+package gossiper
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vquelque/Peerster/clock"
+	"github.com/vquelque/Peerster/config"
+	"github.com/vquelque/Peerster/constant"
+)
+
+// rateLimiter holds the token buckets limiting the packets of each source address and of
+// each origin, per packet type.
+type rateLimiter struct {
+	clock   clock.Clock
+	buckets map[string]*tokenBucket
+	max     int //buckets kept before the idle ones are forgotten
+	lock    sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time //last refill
+}
+
+// maxBuckets is the number of buckets kept before the idle ones are forgotten, so that
+// peers cannot exhaust the memory by using new origins.
+const maxBuckets = 1 << 16
+
+// maxViolations is the number of sources whose violations of the limits are counted. They
+// are kept apart from the buckets so that new origins do not make them forgotten.
+const maxViolations = 1 << 12
+
+// idleBucket is the time after which a bucket is forgotten when there are too many. An
+// idle bucket is full again and behaves as a new one.
+const idleBucket = time.Minute
+
+// encryptedOverhead is the size of an encrypted private message in addition to its text :
+// the keys, the signature and the encoding of the private message encrypted.
+const encryptedOverhead = 1024
+
+func newRateLimiter(clk clock.Clock, max int) *rateLimiter {
+	return &rateLimiter{clock: clk, buckets: make(map[string]*tokenBucket), max: max}
+}
+
+// allow takes a token from the bucket of key, refilled with rate.PerSecond tokens per
+// second up to rate.Burst. Returns false if the bucket is empty.
+func (rl *rateLimiter) allow(key string, rate config.Rate) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	now := rl.clock.Now()
+	b, found := rl.buckets[key]
+	if !found {
+		if len(rl.buckets) >= rl.max {
+			rl.forgetIdle(now)
+		}
+		b = &tokenBucket{tokens: float64(rate.Burst), last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(rate.Burst), b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// forgetIdle removes the buckets idle for idleBucket. If there are still too many, the
+// least recently used ones are removed until an eighth of the table is free : the buckets
+// in use keep their tokens.
+// caller must hold the lock
+func (rl *rateLimiter) forgetIdle(now time.Time) {
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > idleBucket {
+			delete(rl.buckets, key)
+		}
+	}
+	if len(rl.buckets) < rl.max {
+		return
+	}
+	keys := make([]string, 0, len(rl.buckets))
+	for key := range rl.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return rl.buckets[keys[i]].last.Before(rl.buckets[keys[j]].last) })
+	for _, key := range keys[:len(keys)-rl.max*7/8] {
+		delete(rl.buckets, key)
+	}
+}
+
+// admitSource checks the limits of the packets of sender : the size of the packet and the
+// rate of its type. Checked before the signature so that a flooding peer does not cost
+// signature verifications.
+func (gsp *Gossiper) admitSource(gp *GossipPacket, sender string) bool {
+	limits := gsp.Config().Limits
+	if err := checkSizes(gp, limits); err != nil {
+		gsp.limitExceeded(gp, sender, err.Error(), true)
+		return false
+	}
+	typ := packetType(gp)
+	rate, limited := limits.Rates[typ]
+	if limited && !gsp.limiter.allow("source/"+typ+"/"+sender, rate) {
+		gsp.limitExceeded(gp, sender, "rate of "+typ+" packets exceeded", true)
+		return false
+	}
+	return true
+}
+
+// admitConnection checks the rate of the TCP connections opened from the IP address of
+// remote, before reading any of their frames.
+func (gsp *Gossiper) admitConnection(remote string) bool {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return false
+	}
+	rate := config.Rate{PerSecond: constant.ConnectionRate, Burst: constant.ConnectionBurst}
+	if !gsp.limiter.allow("connection/"+host, rate) {
+		netLog.Debugf("refusing connection from %s : rate of connections exceeded", remote)
+		return false
+	}
+	return true
+}
+
+// admitOrigin checks the rate of the packets of the origin of gp, once authenticated. The
+// sender is not blamed as it may only relay the packets of the origin.
+func (gsp *Gossiper) admitOrigin(gp *GossipPacket, sender string) bool {
+	origin := packetOrigin(gp)
+	if origin == "" {
+		return true
+	}
+	typ := packetType(gp)
+	rate, limited := gsp.Config().Limits.Rates[typ]
+	if limited && !gsp.limiter.allow("origin/"+typ+"/"+origin, rate) {
+		gsp.limitExceeded(gp, sender, "rate of "+typ+" packets of origin "+origin+" exceeded", false)
+		return false
+	}
+	return true
+}
+
+// limitExceeded counts a packet dropped for exceeding the limits. If blame is set, the
+// sender is banned once it exceeded the limits more than BanThreshold times in a minute.
+func (gsp *Gossiper) limitExceeded(gp *GossipPacket, sender string, reason string, blame bool) {
+	gsp.Metrics.packetsLimited.With(packetType(gp)).Inc()
+	netLog.Debugf("dropping %s packet from %s : %s", packetType(gp), sender, reason)
+	limits := gsp.Config().Limits
+	if !blame || limits.BanThreshold == 0 {
+		return
+	}
+	violations := config.Rate{PerSecond: float64(limits.BanThreshold) / 60, Burst: limits.BanThreshold}
+	if !gsp.violations.allow(sender, violations) {
+		d := time.Duration(limits.BanDuration) * time.Second
+		gsp.Peers.Ban(sender, d, reason)
+		netLog.Warnf("banning %s for %v : %s", sender, d, reason)
+	}
+}
+
+// checkSizes checks the size of the texts and of the keyword lists against the limits.
+func checkSizes(gp *GossipPacket, limits config.Limits) error {
+	maxText := limits.MaxTextSize
+	switch {
+	case maxText > 0 && gp.RumorMessage != nil && len(gp.RumorMessage.Text) > maxText:
+		return fmt.Errorf("rumor text of %d bytes", len(gp.RumorMessage.Text))
+	case maxText > 0 && gp.Private != nil && len(gp.Private.Text) > maxText:
+		return fmt.Errorf("private text of %d bytes", len(gp.Private.Text))
+	case maxText > 0 && gp.EncPrivate != nil && len(gp.EncPrivate.Ciphertext) > maxText+encryptedOverhead:
+		return fmt.Errorf("encrypted private message of %d bytes", len(gp.EncPrivate.Ciphertext))
+	case limits.MaxKeywords > 0 && gp.SearchRequest != nil && len(gp.SearchRequest.Keywords) > limits.MaxKeywords:
+		return fmt.Errorf("search request with %d keywords", len(gp.SearchRequest.Keywords))
+	}
+	return nil
+}
+
+// packetOrigin returns the origin of the packet, empty for simple messages, status packets
+// and hellos.
+func packetOrigin(gp *GossipPacket) string {
+	switch {
+	case gp.RumorMessage != nil:
+		return gp.RumorMessage.Origin
+	case gp.TLCMessage != nil:
+		return gp.TLCMessage.Origin
+	case gp.Private != nil:
+		return gp.Private.Origin
+	case gp.Ack != nil && *gp.Ack != nil:
+		return (*gp.Ack).Origin
+	case gp.EncPrivate != nil:
+		return gp.EncPrivate.Origin
+	case gp.PrivateAck != nil:
+		return gp.PrivateAck.Origin
+	case gp.DataRequest != nil:
+		return gp.DataRequest.Origin
+	case gp.DataReply != nil:
+		return gp.DataReply.Origin
+	case gp.SearchRequest != nil:
+		return gp.SearchRequest.Origin
+	case gp.SearchReply != nil:
+		return gp.SearchReply.Origin
+	}
+	return ""
+}
@@ -0,0 +1,17 @@
+package gossiper
+
+import (
+	"github.com/vquelque/Peerster/logger"
+)
+
+// loggers of the components of the gossiper
+var (
+	netLog     = logger.New("net")
+	rumorLog   = logger.New("rumor")
+	routingLog = logger.New("routing")
+	privateLog = logger.New("private")
+	filesLog   = logger.New("files")
+	searchLog  = logger.New("search")
+	tlcLog     = logger.New("tlc")
+	configLog  = logger.New("config")
+)
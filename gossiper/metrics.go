@@ -0,0 +1,113 @@
+package gossiper
+
+import (
+	"github.com/vquelque/Peerster/metrics"
+)
+
+// GossiperMetrics are the counters and histograms exposed on the /metrics endpoint.
+type GossiperMetrics struct {
+	Registry          *metrics.Registry
+	packetsSent       *metrics.CounterVec
+	packetsReceived   *metrics.CounterVec
+	packetsDropped    *metrics.CounterVec //queue of the worker pool full
+	packetsLimited    *metrics.CounterVec //over the rate or size limits
+	packetsBanned     *metrics.Counter    //received from banned peers
+	statusSent        *metrics.CounterVec //by encoding : full, delta or digest only
+	statusResyncs     *metrics.Counter    //deltas which could not be decoded
+	bytesSent         *metrics.Counter
+	bytesReceived     *metrics.Counter
+	packetsCompressed *metrics.CounterVec
+	bytesSaved        *metrics.Counter //by the compression of the packets sent
+	rumormongerRounds *metrics.Counter
+	coinFlips         *metrics.Counter
+	antiEntropyRounds *metrics.Counter
+	inSync            *metrics.Counter
+	statusDiff        *metrics.Histogram //number of origins to exchange per status packet
+	downloadedBytes   *metrics.Counter
+	downloadedFiles   *metrics.Counter
+	chunksReused      *metrics.Counter //already stored when sharing or downloading a file
+	chunkLatency      *metrics.Histogram
+	searchFanout      *metrics.Histogram
+	tlcAcks           *metrics.Counter
+}
+
+func newGossiperMetrics(gsp *Gossiper) *GossiperMetrics {
+	r := metrics.NewRegistry()
+	m := &GossiperMetrics{
+		Registry:          r,
+		packetsSent:       r.NewCounterVec("peerster_packets_sent_total", "Gossip packets sent by type.", "type"),
+		packetsReceived:   r.NewCounterVec("peerster_packets_received_total", "Gossip packets received by type.", "type"),
+		packetsDropped:    r.NewCounterVec("peerster_packets_dropped_total", "Gossip packets dropped by type because their worker pool was busy.", "type"),
+		packetsLimited:    r.NewCounterVec("peerster_packets_limited_total", "Gossip packets dropped by type because they exceeded the rate or size limits.", "type"),
+		packetsBanned:     r.NewCounter("peerster_packets_banned_total", "Packets ignored because their sender is banned."),
+		bytesSent:         r.NewCounter("peerster_bytes_sent_total", "Bytes sent to the other peers."),
+		bytesReceived:     r.NewCounter("peerster_bytes_received_total", "Bytes received from the other peers."),
+		packetsCompressed: r.NewCounterVec("peerster_packets_compressed_total", "Gossip packets sent compressed by type.", "type"),
+		bytesSaved:        r.NewCounter("peerster_compression_saved_bytes_total", "Bytes saved by compressing the packets sent."),
+		rumormongerRounds: r.NewCounter("peerster_rumormonger_rounds_total", "Rumors mongered with a peer."),
+		coinFlips:         r.NewCounter("peerster_coin_flips_total", "Rumors mongered again after a coin flip."),
+		antiEntropyRounds: r.NewCounter("peerster_anti_entropy_rounds_total", "Status packets sent by the anti entropy timer."),
+		inSync:            r.NewCounter("peerster_in_sync_total", "Status packets showing that we are in sync with the sender."),
+		statusSent:        r.NewCounterVec("peerster_status_sent_total", "Status packets sent by encoding : full, delta or digest only.", "encoding"),
+		statusResyncs:     r.NewCounter("peerster_status_resyncs_total", "Status packets which could not be decoded, answered by a request for the full vector."),
+		statusDiff: r.NewHistogram("peerster_status_diff_origins", "Origins for which messages are missing on either side, per status packet.",
+			[]float64{0, 1, 2, 5, 10, 20, 50}),
+		downloadedBytes: r.NewCounter("peerster_downloaded_bytes_total", "Bytes of chunks downloaded."),
+		downloadedFiles: r.NewCounter("peerster_downloaded_files_total", "Files downloaded and reconstructed."),
+		chunksReused:    r.NewCounter("peerster_chunks_reused_total", "Chunks of the files shared or downloaded which were already stored."),
+		chunkLatency: r.NewHistogram("peerster_chunk_download_seconds", "Time to download a chunk from a source.",
+			[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}),
+		searchFanout: r.NewHistogram("peerster_search_request_fanout", "Neighbors a search request is distributed to.",
+			[]float64{0, 1, 2, 4, 8, 16, 32}),
+		tlcAcks: r.NewCounter("peerster_tlc_acks_total", "TLC acks received for our TLC messages."),
+	}
+	r.NewGaugeFunc("peerster_tlc_round", "Current TLC round of the gossiper.", func() float64 {
+		return float64(gsp.Blockchain.GetRoundForPeer(gsp.Name))
+	})
+	r.NewGaugeFunc("peerster_routing_table_size", "Valid routes in the routing table.", func() float64 {
+		return float64(len(gsp.Routing.GetAllRoutes()))
+	})
+	r.NewGaugeFunc("peerster_queued_packets", "Packets received waiting for a worker.", func() float64 {
+		return float64(gsp.queuedPackets())
+	})
+	r.NewGaugeFunc("peerster_peers", "Known peers, dead or alive.", func() float64 {
+		return float64(gsp.Peers.Size())
+	})
+	r.NewGaugeFunc("peerster_banned_peers", "Peers banned for exceeding the limits.", func() float64 {
+		return float64(len(gsp.Peers.GetBanned()))
+	})
+	return m
+}
+
+// packetType returns the name of the type of the packet used as a metric label.
+func packetType(gp *GossipPacket) string {
+	switch {
+	case gp.Simple != nil:
+		return "simple"
+	case gp.RumorMessage != nil:
+		return "rumor"
+	case gp.StatusPacket != nil:
+		return "status"
+	case gp.Private != nil:
+		return "private"
+	case gp.DataRequest != nil:
+		return "data_request"
+	case gp.DataReply != nil:
+		return "data_reply"
+	case gp.SearchRequest != nil:
+		return "search_request"
+	case gp.SearchReply != nil:
+		return "search_reply"
+	case gp.TLCMessage != nil:
+		return "tlc"
+	case gp.Ack != nil:
+		return "tlc_ack"
+	case gp.EncPrivate != nil:
+		return "encrypted_private"
+	case gp.PrivateAck != nil:
+		return "private_ack"
+	case gp.Hello != nil:
+		return "hello"
+	}
+	return "unknown"
+}
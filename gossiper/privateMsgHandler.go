@@ -1,9 +1,12 @@
 package gossiper
 
 import (
-	"fmt"
+	"time"
 
+	"github.com/dedis/protobuf"
+	"github.com/vquelque/Peerster/identity"
 	"github.com/vquelque/Peerster/message"
+	"github.com/vquelque/Peerster/storage"
 )
 
 func (gsp *Gossiper) processPrivateMessage(msg *message.PrivateMessage) {
@@ -15,10 +18,52 @@ func (gsp *Gossiper) processPrivateMessage(msg *message.PrivateMessage) {
 		return
 	}
 	// this private message is for us
-	gsp.PrivateStorage.Store(msg, msg.Origin)
+	gsp.deliverPrivateMessage(msg)
+}
+
+// deliverPrivateMessage stores a private message received for us. Messages with an ID
+// are acknowledged to their origin and stored only once.
+func (gsp *Gossiper) deliverPrivateMessage(msg *message.PrivateMessage) {
+	if msg.ID == 0 || msg.Text == "" {
+		gsp.PrivateStorage.Store(msg, msg.Origin)
+	} else {
+		new, conflict := gsp.PrivateStorage.StoreIfNew(msg, msg.Origin)
+		if conflict {
+			// not the message we acknowledged : the origin reused the ID
+			privateLog.Warnf("dropped private message %d from %s : another message was received with this ID", msg.ID, msg.Origin)
+			return
+		}
+		if msg.Origin != gsp.Name {
+			// ack duplicates too : our previous ack may have been lost
+			ack := message.NewPrivateAck(gsp.Name, msg.Origin, msg.ID, gsp.Config().HopLimit)
+			gsp.signPrivateAck(ack)
+			gsp.sendPrivateAck(ack)
+		}
+		if !new {
+			return
+		}
+	}
 	gsp.UIStorage.StorePrivateMsgAsync(msg, msg.Origin)
 	if msg.Text != "" {
-		fmt.Println(msg.String())
+		gsp.History.AppendPrivate(msg.Origin, msg, "")
+		privateLog.Tracef("%s\n", msg.String())
+	}
+}
+
+func (gsp *Gossiper) processPrivateAck(ack *message.PrivateAck) {
+	if ack.Destination != gsp.Name {
+		gsp.sendPrivateAck(ack)
+		return
+	}
+	gsp.WaitingForPrivateAck.SendAckToObserver(ack)
+}
+
+func (gsp *Gossiper) sendPrivateAck(ack *message.PrivateAck) {
+	ack.HopLimit = ack.HopLimit - 1
+	gp := &GossipPacket{PrivateAck: ack}
+	nextHopAddr := gsp.Routing.GetRoute(ack.Destination)
+	if nextHopAddr != "" && ack.HopLimit > 0 && gsp.supportsEncryption(nextHopAddr) {
+		gsp.send(gp, nextHopAddr)
 	}
 }
 
@@ -34,9 +79,177 @@ func (gsp *Gossiper) sendPrivateMessage(msg *message.PrivateMessage) {
 			// store only if txt is not empty otherwise it is just a TLCAck
 			gsp.PrivateStorage.Store(msg, msg.Destination)
 			gsp.UIStorage.StorePrivateMsgAsync(msg, msg.Destination)
+			gsp.History.AppendPrivate(msg.Destination, msg, "")
 		}
 		if msg.HopLimit > 0 {
 			gsp.send(gp, nextHopAddr)
 		}
 	}
 }
+
+////////////////////////////
+// Encrypted private messages //
+////////////////////////////
+
+// sendPrivateText encrypts a private message for dest with the encryption key learned from its
+// rumors and sends it until it is acknowledged. The cleartext is kept in our own storage.
+// If no rumor of dest was received yet, the message stays pending until its key is known.
+func (gsp *Gossiper) sendPrivateText(text string, dest string) {
+	msg := message.NewPrivateMessage(gsp.Name, text, dest, gsp.Config().HopLimit)
+	if dest == gsp.Name {
+		gsp.deliverPrivateMessage(msg)
+		return
+	}
+	msg.ID = gsp.PrivateStorage.NextID(dest)
+	gsp.PrivateStorage.Store(msg, dest)
+	gsp.UIStorage.StoreSentPrivateMsg(msg, dest)
+	gsp.History.AppendPrivate(dest, msg, storage.DeliveryPending)
+	gsp.spawn(func() {
+		destKey := gsp.waitForEncryptionKey(dest)
+		if destKey == nil {
+			privateLog.Warnf("NO ENCRYPTION KEY for %s. Private message %d not sent", dest, msg.ID)
+			gsp.setPrivateStatus(dest, msg.ID, storage.DeliveryFailed)
+			return
+		}
+		enc, err := gsp.encryptPrivateMessage(msg, destKey)
+		if err != nil {
+			privateLog.Errorf("cannot encrypt private message for %s : %v", dest, err)
+			gsp.setPrivateStatus(dest, msg.ID, storage.DeliveryFailed)
+			return
+		}
+		gsp.sendUntilAcknowledged(enc, msg.ID)
+	})
+}
+
+// waitForEncryptionKey returns the encryption key of dest, waiting for one of its rumors
+// as long as a message would be retransmitted. Returns nil if the key is still unknown.
+func (gsp *Gossiper) waitForEncryptionKey(dest string) []byte {
+	if key := gsp.Keys.GetEncryptionKey(dest); key != nil {
+		return key
+	}
+	privateLog.Infof("NO ENCRYPTION KEY for %s yet. Waiting for its rumors", dest)
+	cfg := gsp.Config().Private
+	maxWait := cfg.AckTimeout * (1<<uint(cfg.MaxRetransmissions+1) - 1) //in seconds
+	timer := gsp.clock.NewTicker(time.Second)
+	defer timer.Stop()
+	for waited := 0; waited < maxWait; waited++ {
+		select {
+		case <-timer.C():
+		case <-gsp.ctx.Done():
+			return nil
+		}
+		if key := gsp.Keys.GetEncryptionKey(dest); key != nil {
+			return key
+		}
+	}
+	return nil
+}
+
+// encryptPrivateMessage encrypts msg for its destination and signs the envelope.
+func (gsp *Gossiper) encryptPrivateMessage(msg *message.PrivateMessage, destKey []byte) (*message.EncryptedPrivateMessage, error) {
+	plaintext, err := protobuf.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, nonce, ciphertext, err := identity.Encrypt(destKey, plaintext, privateAD(msg.Origin, msg.Destination))
+	if err != nil {
+		return nil, err
+	}
+	enc := &message.EncryptedPrivateMessage{
+		Origin:       msg.Origin,
+		Destination:  msg.Destination,
+		HopLimit:     msg.HopLimit,
+		EphemeralKey: ephemeral,
+		Nonce:        nonce,
+		Ciphertext:   ciphertext,
+	}
+	gsp.signEncryptedPrivate(enc)
+	return enc, nil
+}
+
+// setPrivateStatus records the delivery status of a private message we sent.
+func (gsp *Gossiper) setPrivateStatus(dest string, id uint32, status string) {
+	gsp.UIStorage.SetPrivateMsgStatus(dest, id, status)
+	gsp.History.AppendPrivateStatus(dest, id, status)
+}
+
+// sendUntilAcknowledged retransmits the message with exponential backoff until the
+// destination acknowledges it, and updates its delivery status.
+func (gsp *Gossiper) sendUntilAcknowledged(enc *message.EncryptedPrivateMessage, id uint32) {
+	ackChan := gsp.WaitingForPrivateAck.RegisterPrivateAckObserver(enc.Destination, id)
+	defer gsp.WaitingForPrivateAck.UnregisterPrivateAckObserver(enc.Destination, id)
+	timeout := time.Duration(gsp.Config().Private.AckTimeout) * time.Second
+	for try := 0; try <= gsp.Config().Private.MaxRetransmissions; try++ {
+		// the route is looked up again at each try. Hop limit is not signed.
+		pkt := *enc
+		gsp.sendEncryptedPrivateMessage(&pkt)
+		timer := gsp.clock.NewTicker(timeout)
+		select {
+		case <-ackChan:
+			timer.Stop()
+			gsp.setPrivateStatus(enc.Destination, id, storage.DeliveryDelivered)
+			return
+		case <-timer.C():
+			timer.Stop()
+		case <-gsp.ctx.Done():
+			// still pending : the replayed history reports it as failed
+			timer.Stop()
+			return
+		}
+		timeout *= 2
+	}
+	privateLog.Warnf("PRIVATE message %d to %s NOT DELIVERED", id, enc.Destination)
+	gsp.setPrivateStatus(enc.Destination, id, storage.DeliveryFailed)
+}
+
+func (gsp *Gossiper) processEncryptedPrivateMessage(msg *message.EncryptedPrivateMessage) {
+	if msg.Destination != gsp.Name {
+		if msg.HopLimit == 0 {
+			return
+		}
+		// we can't read it, only route it
+		gsp.sendEncryptedPrivateMessage(msg)
+		return
+	}
+	plaintext, err := gsp.Identity.Decrypt(msg.EphemeralKey, msg.Nonce, msg.Ciphertext, privateAD(msg.Origin, msg.Destination))
+	if err != nil {
+		privateLog.Warnf("cannot decrypt private message from %s : %v", msg.Origin, err)
+		return
+	}
+	pm := &message.PrivateMessage{}
+	if err := protobuf.Decode(plaintext, pm); err != nil {
+		return
+	}
+	if pm.Origin != msg.Origin || pm.Destination != msg.Destination {
+		// inner message does not match the signed envelope
+		return
+	}
+	pm.HopLimit = msg.HopLimit
+	gsp.deliverPrivateMessage(pm)
+}
+
+// sendEncryptedPrivateMessage forwards the encrypted message to the next hop and decrements hop limit
+func (gsp *Gossiper) sendEncryptedPrivateMessage(msg *message.EncryptedPrivateMessage) {
+	msg.HopLimit = msg.HopLimit - 1
+	gp := &GossipPacket{EncPrivate: msg}
+	nextHopAddr := gsp.Routing.GetRoute(msg.Destination)
+	if nextHopAddr != "" && msg.HopLimit > 0 && gsp.supportsEncryption(nextHopAddr) {
+		gsp.send(gp, nextHopAddr)
+	}
+}
+
+// supportsEncryption checks if the next hop can relay the encrypted private messages and
+// their acks. Otherwise they are not sent : the messages are retransmitted until the next
+// hop greets us or another route is found.
+func (gsp *Gossiper) supportsEncryption(nextHop string) bool {
+	if gsp.supports(nextHop, message.CapEncryptedPrivate) {
+		return true
+	}
+	privateLog.Debugf("%s does not support encrypted private messages", nextHop)
+	return false
+}
+
+// privateAD is the data authenticated along the encrypted private messages
+func privateAD(origin string, destination string) []byte {
+	return []byte(origin + "->" + destination)
+}
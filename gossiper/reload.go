@@ -0,0 +1,89 @@
+package gossiper
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vquelque/Peerster/config"
+)
+
+// ReloadReport lists the settings changed by a configuration reload.
+type ReloadReport struct {
+	Applied         []string //settings applied to the running gossiper
+	RestartRequired []string //settings ignored until the gossiper is restarted
+	PeersAdded      []string
+	PeersRemoved    []string
+}
+
+// Config returns the current configuration of the gossiper. It must not be modified.
+func (gsp *Gossiper) Config() *config.Config {
+	gsp.configLock.RLock()
+	defer gsp.configLock.RUnlock()
+	return gsp.config
+}
+
+// SetConfigLoader sets the function loading the configuration again on ReloadConfig.
+func (gsp *Gossiper) SetConfigLoader(loader func() (*config.Config, error)) {
+	gsp.configLock.Lock()
+	defer gsp.configLock.Unlock()
+	gsp.configLoader = loader
+}
+
+// ReloadConfig loads the configuration again and applies it to the running gossiper.
+func (gsp *Gossiper) ReloadConfig() (*ReloadReport, error) {
+	gsp.configLock.RLock()
+	loader := gsp.configLoader
+	gsp.configLock.RUnlock()
+	if loader == nil {
+		return nil, fmt.Errorf("no configuration to reload")
+	}
+	cfg, err := loader()
+	if err != nil {
+		configLog.Errorf("cannot reload the configuration : %v", err)
+		return nil, err
+	}
+	return gsp.ApplyConfig(cfg), nil
+}
+
+// ApplyConfig replaces the configuration of the running gossiper. The timers, hop limits,
+// peers and file directories are applied live. The settings only read at startup keep
+// their current value and are reported as requiring a restart.
+func (gsp *Gossiper) ApplyConfig(cfg *config.Config) *ReloadReport {
+	gsp.configLock.Lock()
+	old := gsp.config
+	report := &ReloadReport{RestartRequired: cfg.KeepRestartSettings(old)}
+	report.Applied = cfg.Changes(old)
+	gsp.config = cfg
+	gsp.configLock.Unlock()
+
+	report.PeersAdded, report.PeersRemoved = gsp.Peers.SetStatic(cfg.Peers)
+	gsp.Routing.SetTimeouts(routeTimeouts(cfg))
+	cfg.ApplyLog()
+	// wake up the periodic handlers to pick up their new timers
+	for _, c := range []chan bool{gsp.antiEntropyReload, gsp.routingReload} {
+		select {
+		case c <- true:
+		default:
+		}
+	}
+	configLog.Infof("configuration reloaded. Applied : %v. Restart required : %v", report.Applied, report.RestartRequired)
+	return report
+}
+
+// routeTimeouts returns the route and neighbor timeouts of the routing table. Routes are
+// only refreshed periodically when route rumors are sent, and neighbors when anti
+// entropy is enabled.
+func routeTimeouts(cfg *config.Config) (time.Duration, time.Duration) {
+	var routeTimeout, neighborTimeout time.Duration
+	rtimer := cfg.Timers.RTimer
+	if rtimer > 0 && cfg.Timers.RouteTimeout > 0 {
+		routeTimeout = time.Duration(cfg.Timers.RouteTimeout) * time.Second
+		if 3*rtimer > cfg.Timers.RouteTimeout {
+			routeTimeout = time.Duration(3*rtimer) * time.Second
+		}
+	}
+	if cfg.Timers.AntiEntropy > 0 {
+		neighborTimeout = time.Duration(cfg.Timers.NeighborTimeout) * time.Second
+	}
+	return routeTimeout, neighborTimeout
+}
@@ -2,10 +2,8 @@ package gossiper
 
 import (
 	"fmt"
-	"math/rand"
 	"time"
 
-	"github.com/vquelque/Peerster/constant"
 	"github.com/vquelque/Peerster/message"
 )
 
@@ -20,25 +18,21 @@ func (gsp *Gossiper) processRumorPacket(pkt *message.RumorPacket, sender string)
 
 	origin, id, rumor := pkt.GetDetails()
 	//store rumor packets
-
-	next := gsp.VectorClock.NextMessageForPeer(origin)
-	if rumor && sender != "" && id >= next && origin != gsp.Name {
-		gsp.Routing.UpdateRoute(pkt.RumorMessage, sender) //update routing table
-		if pkt.RumorMessage.Text != "" {
-			fmt.Println(gsp.Routing.PrintUpdate(pkt.RumorMessage.Origin))
+	accepted := gsp.acceptRumor(pkt)
+	if rumor && sender != "" && origin != gsp.Name {
+		//update routing table. Older rumors may still advertise a shorter path
+		gsp.Routing.UpdateRoute(origin, id, pkt.RumorMessage.HopCount, sender)
+		if accepted && pkt.RumorMessage.Text != "" {
+			routingLog.Tracef("%s\n", gsp.Routing.PrintUpdate(pkt.RumorMessage.Origin))
 		}
 	}
 
-	if id == next {
+	if accepted {
 		if sender != "" {
-			fmt.Println(pkt.String(origin))
+			rumorLog.Tracef("%s\n", pkt.String(origin))
 		}
-		// we were waiting for this message
-		// increase mID for peer and store message
-		gsp.VectorClock.IncrementMIDForPeer(origin, rumor)
-		gsp.RumorStorage.Store(pkt)
 		//pick random peer and rumormonger
-		randPeer := gsp.Peers.PickRandomPeer(sender)
+		randPeer := gsp.pickPeer(pkt, sender)
 		if rumor && pkt.RumorMessage.Text != "" {
 			//not route rumor => append to UI
 			gsp.UIStorage.AppendRumorAsync(pkt.RumorMessage)
@@ -63,16 +57,34 @@ func (gsp *Gossiper) processRumorPacket(pkt *message.RumorPacket, sender string)
 
 }
 
+// acceptRumor stores pkt if it is the next message we were waiting for from its origin and
+// returns whether it was. The packets are processed concurrently : the vector clock, the
+// storage and the history are updated together so that they always hold the same rumors.
+func (gsp *Gossiper) acceptRumor(pkt *message.RumorPacket) bool {
+	gsp.acceptLock.Lock()
+	defer gsp.acceptLock.Unlock()
+	origin, id, rumor := pkt.GetDetails()
+	if id != gsp.VectorClock.NextMessageForPeer(origin) {
+		return false
+	}
+	// increase mID for peer and store message
+	gsp.VectorClock.IncrementMIDForPeer(origin, rumor)
+	gsp.RumorStorage.Store(pkt)
+	gsp.History.AppendRumor(pkt)
+	return true
+}
+
 // Handle the rumormongering process and launch go routine that listens for ack or timeout.
 func (gsp *Gossiper) rumormonger(rumorPkt *message.RumorPacket, peerAddr string) {
-	go gsp.listenForAck(rumorPkt, peerAddr)
+	gsp.spawn(func() { gsp.listenForAck(rumorPkt, peerAddr) })
 	switch {
 	case rumorPkt.RumorMessage != nil:
 		gsp.sendRumorMessage(rumorPkt.RumorMessage, peerAddr)
 	case rumorPkt.TLCMessage != nil:
 		gsp.sendTLCMessage(rumorPkt.TLCMessage, peerAddr)
 	}
-	fmt.Printf("MONGERING with %s \n", peerAddr)
+	gsp.Metrics.rumormongerRounds.Inc()
+	rumorLog.Tracef("MONGERING with %s \n", peerAddr)
 }
 
 // Listen and handle ack or timeout.
@@ -81,7 +93,7 @@ func (gsp *Gossiper) listenForAck(pkt *message.RumorPacket, peerAddr string) {
 	origin, id, _ := pkt.GetDetails()
 	cID := fmt.Sprintf("%s : %s : %d", peerAddr, origin, id)
 	channel := gsp.WaitingForAck.Register(cID)
-	timer := time.NewTicker(constant.AckTimeout * time.Second)
+	timer := gsp.clock.NewTicker(time.Duration(gsp.Config().Timers.AckTimeout) * time.Second)
 	defer func() {
 		timer.Stop()
 		gsp.WaitingForAck.Unregister(cID)
@@ -90,7 +102,7 @@ func (gsp *Gossiper) listenForAck(pkt *message.RumorPacket, peerAddr string) {
 	//keep running while channel open with for loop assignment
 	for {
 		select {
-		case <-timer.C:
+		case <-timer.C():
 			gsp.coinFlip(pkt, peerAddr)
 			//	fmt.Printf("TIMEOUT \n")
 			return
@@ -100,6 +112,8 @@ func (gsp *Gossiper) listenForAck(pkt *message.RumorPacket, peerAddr string) {
 			}
 			//	fmt.Printf("GOT ACK \n")
 			return
+		case <-gsp.ctx.Done():
+			return
 		}
 	}
 }
@@ -118,12 +132,13 @@ func (gsp *Gossiper) sendTLCMessage(msg *message.TLCMessage, peerAddr string) {
 // CoinFlip tosses a coin. If head, we rumormonger the rumor to a random peer. We exclude the sender
 // from the randomly chosen peer.
 func (gsp *Gossiper) coinFlip(rumor *message.RumorPacket, sender string) {
-	head := rand.Int() % 2
+	head := gsp.rand.Intn(2)
 	if head == 0 {
 		// exclude the sender of the rumor from the set where we pick our random peer to prevent a loop.
-		peer := gsp.Peers.PickRandomPeer(sender)
+		peer := gsp.pickPeer(rumor, sender)
 		if peer != "" {
-			fmt.Printf("FLIPPED COIN sending rumor to %s\n", peer)
+			gsp.Metrics.coinFlips.Inc()
+			rumorLog.Tracef("FLIPPED COIN sending rumor to %s\n", peer)
 			gsp.rumormonger(rumor, peer)
 		}
 	}
@@ -132,17 +147,20 @@ func (gsp *Gossiper) coinFlip(rumor *message.RumorPacket, sender string) {
 // Check if we are in sync with peer. Else, send the missing messages to the peer.
 func (gsp *Gossiper) synchronizeWithPeer(same bool, toAsk []message.PeerStatus, toSend []message.PeerStatus, peerAddr string) {
 	if same {
-		fmt.Printf("IN SYNC WITH %s \n", peerAddr)
+		rumorLog.Tracef("IN SYNC WITH %s \n", peerAddr)
 		return
 	}
-	if len(toSend) > 0 {
+	for _, ps := range toSend {
 		// we have new messages to send to the peer : start mongering
-		//get the rumor we need to send from storage
-		rumor := gsp.RumorStorage.Get(toSend[0].Identifier, toSend[0].NextID)
-		if rumor != nil {
+		//get the rumor we need to send from storage. The route rumors skipped by the
+		//history are missing
+		rumor := gsp.RumorStorage.Get(ps.Identifier, ps.NextID)
+		if rumor != nil && (rumor.TLCMessage == nil || gsp.supports(peerAddr, message.CapTLC)) {
 			gsp.rumormonger(rumor, peerAddr)
+			return
 		}
-	} else if len(toAsk) > 0 {
+	}
+	if len(toAsk) > 0 {
 		// send status for triggering peer mongering
 		//fmt.Println(toAsk)
 		gsp.sendStatusPacket(peerAddr)
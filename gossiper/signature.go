@@ -0,0 +1,145 @@
+package gossiper
+
+import (
+	"bytes"
+
+	"github.com/vquelque/Peerster/message"
+)
+
+////////////////////////////
+// Signing //
+////////////////////////////
+
+func (gsp *Gossiper) signRumor(msg *message.RumorMessage) {
+	msg.PublicKey = gsp.Identity.PublicKey
+	msg.EncryptionKey = gsp.Identity.EncryptionKey
+	d := msg.Digest()
+	msg.Signature = gsp.Identity.Sign(d[:])
+}
+
+func (gsp *Gossiper) signTLC(msg *message.TLCMessage) {
+	msg.PublicKey = gsp.Identity.PublicKey
+	d := msg.Digest()
+	msg.Signature = gsp.Identity.Sign(d[:])
+}
+
+func (gsp *Gossiper) signTLCAck(ack message.TLCAck) {
+	ack.PublicKey = gsp.Identity.PublicKey
+	d := message.TLCAckDigest(ack)
+	ack.Signature = gsp.Identity.Sign(d[:])
+}
+
+func (gsp *Gossiper) signEncryptedPrivate(msg *message.EncryptedPrivateMessage) {
+	msg.PublicKey = gsp.Identity.PublicKey
+	d := msg.Digest()
+	msg.Signature = gsp.Identity.Sign(d[:])
+}
+
+func (gsp *Gossiper) signPrivateAck(ack *message.PrivateAck) {
+	ack.PublicKey = gsp.Identity.PublicKey
+	d := ack.Digest()
+	ack.Signature = gsp.Identity.Sign(d[:])
+}
+
+func (gsp *Gossiper) signDataRequest(dr *message.DataRequest) {
+	dr.PublicKey = gsp.Identity.PublicKey
+	d := dr.Digest()
+	dr.Signature = gsp.Identity.Sign(d[:])
+}
+
+func (gsp *Gossiper) signDataReply(r *message.DataReply) {
+	r.PublicKey = gsp.Identity.PublicKey
+	d := r.Digest()
+	r.Signature = gsp.Identity.Sign(d[:])
+}
+
+func (gsp *Gossiper) signSearchRequest(sr *message.SearchRequest) {
+	sr.PublicKey = gsp.Identity.PublicKey
+	d := sr.Digest()
+	sr.Signature = gsp.Identity.Sign(d[:])
+}
+
+func (gsp *Gossiper) signSearchReply(r *message.SearchReply) {
+	r.PublicKey = gsp.Identity.PublicKey
+	d := r.Digest()
+	r.Signature = gsp.Identity.Sign(d[:])
+}
+
+////////////////////////////
+// Verification //
+////////////////////////////
+
+// verifyPacket checks the signature of the origin of the packet. Every signed packet
+// carries the public key of its origin, which is pinned the first time it is seen, so a
+// fresh node can verify packets from origins it never received a rumor from.
+func (gsp *Gossiper) verifyPacket(gp *GossipPacket) bool {
+	switch {
+	case gp.RumorMessage != nil:
+		m := gp.RumorMessage
+		d := m.Digest()
+		if !gsp.verifyAndPin(m.Origin, m.PublicKey, d[:], m.Signature) {
+			return false
+		}
+		if len(m.EncryptionKey) > 0 {
+			// signed by origin : learn its encryption key
+			if !gsp.Keys.PinEncryptionKey(m.Origin, m.EncryptionKey) {
+				netLog.Warnf("%s announces encryption key %x instead of the pinned one", m.Origin, m.EncryptionKey)
+			}
+		}
+		return true
+	case gp.TLCMessage != nil:
+		m := gp.TLCMessage
+		d := m.Digest()
+		return gsp.verifyAndPin(m.Origin, m.PublicKey, d[:], m.Signature)
+	case gp.Private != nil:
+		m := gp.Private
+		d := m.Digest()
+		return gsp.verifyAndPin(m.Origin, m.PublicKey, d[:], m.Signature)
+	case gp.Ack != nil:
+		ack := *gp.Ack
+		if ack == nil {
+			return false
+		}
+		d := message.TLCAckDigest(ack)
+		return gsp.verifyAndPin(ack.Origin, ack.PublicKey, d[:], ack.Signature)
+	case gp.EncPrivate != nil:
+		m := gp.EncPrivate
+		d := m.Digest()
+		return gsp.verifyAndPin(m.Origin, m.PublicKey, d[:], m.Signature)
+	case gp.PrivateAck != nil:
+		m := gp.PrivateAck
+		d := m.Digest()
+		return gsp.verifyAndPin(m.Origin, m.PublicKey, d[:], m.Signature)
+	case gp.DataRequest != nil:
+		m := gp.DataRequest
+		d := m.Digest()
+		return gsp.verifyAndPin(m.Origin, m.PublicKey, d[:], m.Signature)
+	case gp.DataReply != nil:
+		m := gp.DataReply
+		d := m.Digest()
+		return gsp.verifyAndPin(m.Origin, m.PublicKey, d[:], m.Signature)
+	case gp.SearchRequest != nil:
+		m := gp.SearchRequest
+		d := m.Digest()
+		return gsp.verifyAndPin(m.Origin, m.PublicKey, d[:], m.Signature)
+	case gp.SearchReply != nil:
+		m := gp.SearchReply
+		d := m.Digest()
+		return gsp.verifyAndPin(m.Origin, m.PublicKey, d[:], m.Signature)
+	}
+	// simple messages, status packets and hellos have no origin to authenticate
+	return true
+}
+
+// verifyAndPin checks the signature of origin with its pinned key, pinning key on first use.
+// Warns when origin signs with another key than the pinned one : it restarted with a new
+// identity or someone impersonates it.
+func (gsp *Gossiper) verifyAndPin(origin string, key []byte, digest []byte, sig []byte) bool {
+	if gsp.Keys.VerifyAndPin(origin, key, digest, sig) {
+		return true
+	}
+	if pinned := gsp.Keys.Get(origin); pinned != nil && !bytes.Equal(pinned, key) {
+		netLog.Warnf("rejected a packet of %s signed with key %x instead of the pinned key %x", origin, key, pinned)
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package gossiper
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/vquelque/Peerster/clock"
+	"github.com/vquelque/Peerster/config"
+	"github.com/vquelque/Peerster/constant"
+	"github.com/vquelque/Peerster/message"
+	"github.com/vquelque/Peerster/socket"
+)
+
+// The simulations run in a synctest bubble : the clock is only advanced once every
+// gossiper is blocked, so that no wall clock time is needed to handle the packets.
+
+// simGossiper starts a gossiper named name at addr on the simulated network.
+func simGossiper(t *testing.T, net *socket.SimNetwork, clk clock.Clock, name string, addr string, peers string) *Gossiper {
+	cfg := config.Default()
+	cfg.Name = name
+	cfg.GossipAddr = addr
+	cfg.SetPeers(peers)
+	cfg.Timers.AntiEntropy = 1
+	cfg.Log.Trace = false
+	cfg.Files.KeyFile = constant.NoKeyFile
+	cfg.Seed = int64(len(name)*7919 + int(name[len(name)-1]))
+	gsp := NewGossiperWithSockets(net.NewSocket(addr), net.NewSocket(name+"-ui"), cfg, clk)
+	gsp.Start()
+	t.Cleanup(gsp.KillGossiper)
+	return gsp
+}
+
+// advanceUntil advances the clock by steps of 10ms until cond holds or max elapsed. The
+// gossipers handle the packets and the ticks of each step before the next one.
+func advanceUntil(clk *clock.Manual, max time.Duration, cond func() bool) bool {
+	for elapsed := time.Duration(0); elapsed < max; elapsed += 10 * time.Millisecond {
+		synctest.Wait()
+		if cond() {
+			return true
+		}
+		clk.Advance(10 * time.Millisecond)
+	}
+	synctest.Wait()
+	return cond()
+}
+
+// received checks that gsp received the rumors of origin before next.
+func received(gsp *Gossiper, origin string, next uint32) bool {
+	for _, ps := range gsp.VectorClock.StatusPacket().Want {
+		if ps.Identifier == origin {
+			return ps.NextID >= next
+		}
+	}
+	return false
+}
+
+func TestSimulatedNetworkConverges(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		clk := clock.NewManual(time.Unix(0, 0))
+		net := socket.NewSimNetwork(1, clk)
+		net.SetDefaultLink(socket.LinkConfig{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.2})
+		a := simGossiper(t, net, clk, "A", "10.0.0.1:5000", "10.0.0.2:5000")
+		b := simGossiper(t, net, clk, "B", "10.0.0.2:5000", "10.0.0.1:5000,10.0.0.3:5000")
+		c := simGossiper(t, net, clk, "C", "10.0.0.3:5000", "10.0.0.2:5000")
+
+		net.Partition([]string{"10.0.0.1:5000", "10.0.0.2:5000"}, []string{"10.0.0.3:5000"})
+		a.ProcessClientMessage(&message.Message{Text: "hello"})
+		if !advanceUntil(clk, 30*time.Second, func() bool { return received(b, "A", 2) }) {
+			t.Fatal("B did not receive the rumor of A")
+		}
+		advanceUntil(clk, 5*time.Second, func() bool { return false })
+		if received(c, "A", 2) {
+			t.Fatal("C received a rumor across the partition")
+		}
+
+		net.Heal()
+		c.ProcessClientMessage(&message.Message{Text: "back"})
+		converged := func() bool {
+			return received(c, "A", 2) && received(a, "C", 2) && received(b, "C", 2)
+		}
+		if !advanceUntil(clk, 60*time.Second, converged) {
+			t.Fatalf("not converged after the partition healed : A %v, B %v, C %v",
+				a.VectorClock.StatusPacket().Want, b.VectorClock.StatusPacket().Want, c.VectorClock.StatusPacket().Want)
+		}
+	})
+}
+
+func TestManyNodesConverge(t *testing.T) {
+	tests := []struct {
+		nodes  int
+		chords int //random links added to the ring
+		link   socket.LinkConfig
+	}{
+		{20, 0, socket.LinkConfig{Latency: 5 * time.Millisecond}},
+		{32, 16, socket.LinkConfig{Latency: 10 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.1, Duplicate: 0.05, Reorder: 0.1}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d nodes", tt.nodes), func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				clk := clock.NewManual(time.Unix(0, 0))
+				net := socket.NewSimNetwork(int64(tt.nodes), clk)
+				net.SetDefaultLink(tt.link)
+				addr := func(i int) string { return fmt.Sprintf("10.0.%d.%d:5000", i/250, i%250+1) }
+				neighbors := make([]map[int]bool, tt.nodes)
+				for i := range neighbors {
+					neighbors[i] = map[int]bool{(i + 1) % tt.nodes: true, (i + tt.nodes - 1) % tt.nodes: true}
+				}
+				rnd := rand.New(rand.NewSource(int64(tt.nodes)))
+				for c := 0; c < tt.chords; c++ {
+					i, j := rnd.Intn(tt.nodes), rnd.Intn(tt.nodes)
+					if i != j {
+						neighbors[i][j], neighbors[j][i] = true, true
+					}
+				}
+				gossipers := make([]*Gossiper, tt.nodes)
+				for i := range gossipers {
+					peers := ""
+					for j := range neighbors[i] {
+						peers += addr(j) + ","
+					}
+					gossipers[i] = simGossiper(t, net, clk, fmt.Sprintf("N%d", i), addr(i), peers)
+				}
+				for _, gsp := range gossipers {
+					gsp.ProcessClientMessage(&message.Message{Text: "hello from " + gsp.Name})
+				}
+				converged := func() bool {
+					for _, gsp := range gossipers {
+						for _, origin := range gossipers {
+							if !received(gsp, origin.Name, 2) {
+								return false
+							}
+						}
+					}
+					return true
+				}
+				if !advanceUntil(clk, time.Minute, converged) {
+					missing := 0
+					for _, gsp := range gossipers {
+						for _, origin := range gossipers {
+							if !received(gsp, origin.Name, 2) {
+								missing++
+							}
+						}
+					}
+					t.Fatalf("%d rumors missing after a simulated minute", missing)
+				}
+			})
+		})
+	}
+}
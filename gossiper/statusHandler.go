@@ -1,22 +1,64 @@
 package gossiper
 
 import (
-	"fmt"
 	"time"
 
+	"github.com/vquelque/Peerster/clock"
 	"github.com/vquelque/Peerster/message"
 )
 
 // Sends a status packet to the given address.
 func (gsp *Gossiper) sendStatusPacket(addr string) {
+	gsp.sendStatus(addr, false)
+}
+
+// sendStatus sends our status packet to addr, relative to the last one sent to it if addr
+// supports it. needFull asks addr to send us its whole vector next time.
+func (gsp *Gossiper) sendStatus(addr string, needFull bool) {
 	sp := gsp.VectorClock.StatusPacket()
+	heartbeat, echo, delay := gsp.Peers.Heartbeat(addr)
+	sp.Heartbeat, sp.Echo, sp.EchoDelay = heartbeat, echo, uint64(delay)
+	sp.NeedFull = needFull
+	if gsp.supports(addr, message.CapDeltaStatus) {
+		sp = gsp.statusDeltas.Encode(addr, sp)
+	}
+	switch {
+	case !sp.Delta:
+		gsp.Metrics.statusSent.With("full").Inc()
+	case len(sp.Want) == 0:
+		gsp.Metrics.statusSent.With("digest").Inc()
+	default:
+		gsp.Metrics.statusSent.With("delta").Inc()
+	}
 	gp := &GossipPacket{StatusPacket: sp}
 	gsp.send(gp, addr)
 }
 
+// decodeStatus replaces the status packet of sender by the whole vector it encodes.
+// Returns false if it cannot be decoded, after asking sender for its whole vector.
+// Called in the order the packets are received.
+func (gsp *Gossiper) decodeStatus(gp *GossipPacket, sender string) bool {
+	sp := gp.StatusPacket
+	if sp.NeedFull {
+		gsp.statusDeltas.Reset(sender)
+	}
+	full, ok := gsp.statusDeltas.Decode(sender, sp)
+	if !ok {
+		gsp.Metrics.statusResyncs.Inc()
+		gsp.sendStatus(sender, true)
+		return false
+	}
+	if sp.NeedFull {
+		gsp.sendStatusPacket(sender)
+	}
+	gp.StatusPacket = full
+	return true
+}
+
 // Processes incoming status packets.
 func (gsp *Gossiper) processStatusPacket(sp *message.StatusPacket, sender string) {
-	fmt.Print(sp.StringStatusWithSender(sender))
+	rumorLog.Tracef("%s", sp.StringStatusWithSender(sender))
+	gsp.Peers.ReceivedHeartbeat(sender, sp.Heartbeat, sp.Echo, time.Duration(sp.EchoDelay))
 
 	//reset anti entropy timer
 	select {
@@ -26,14 +68,20 @@ func (gsp *Gossiper) processStatusPacket(sp *message.StatusPacket, sender string
 	}
 
 	same, toAsk, toSend := gsp.VectorClock.CompareWithStatusPacket(*sp)
+	if same {
+		gsp.Metrics.inSync.Inc()
+	}
+	gsp.Metrics.statusDiff.Observe(float64(len(toAsk) + len(toSend)))
 	observerChan := gsp.WaitingForAck.GetObserver(sp, sender)
 	if observerChan != nil {
 		// A registered routine was expecting a status packet.
 		// Forward the result of the comparison to the routine to potentially
 		// trigger the coin toss.
 		// log.Print("OBSERVER FOUND")
+		// non blocking : the routine only expects one status packet
 		select {
 		case observerChan <- same:
+		default:
 		}
 	}
 	// if no registered channel, it is an anti-entropy status packet.
@@ -42,25 +90,72 @@ func (gsp *Gossiper) processStatusPacket(sp *message.StatusPacket, sender string
 
 }
 
-// Handles the anti entropy timer
+// Handles the anti entropy timer. Idle while the anti entropy timer is 0.
 func (gsp *Gossiper) startAntiEntropyHandler() {
-	antiEntropyDuration := time.Duration(gsp.AntiEntropyTimer) * time.Second
-	timer := time.NewTicker(antiEntropyDuration)
-	go func() {
+	gsp.spawn(func() {
+		var timer clock.Ticker
+		var tick <-chan time.Time
 		for {
+			timer, tick = gsp.resetTicker(timer, gsp.Config().Timers.AntiEntropy)
 			select {
-			case <-timer.C:
+			case <-tick:
 				// timer elapsed : send status packet to randomly chosen peer
 				// log.Println("No STATUS received : sending random STATUS")
 				randPeer := gsp.Peers.PickRandomPeer("")
 				if randPeer != "" {
+					gsp.Metrics.antiEntropyRounds.Inc()
 					gsp.sendStatusPacket(randPeer)
 				}
 			case <-gsp.ResetAntiEntropyTimer:
 				// timer reset : we received a status packet
 				//log.Println("Received STATUS : Resetting anti entropy timer")
-				timer = time.NewTicker(antiEntropyDuration)
+			case <-gsp.antiEntropyReload:
+			case <-gsp.ctx.Done():
+				gsp.resetTicker(timer, 0)
+				return
+			}
+		}
+	})
+}
+
+// resetTicker restarts t with a period of the given seconds, creating or stopping it
+// as needed, and returns it with its channel. The channel is nil when seconds is 0.
+func (gsp *Gossiper) resetTicker(t clock.Ticker, seconds int) (clock.Ticker, <-chan time.Time) {
+	if seconds <= 0 {
+		if t != nil {
+			t.Stop()
+		}
+		return nil, nil
+	}
+	d := time.Duration(seconds) * time.Second
+	if t == nil {
+		t = gsp.clock.NewTicker(d)
+	} else {
+		t.Reset(d)
+	}
+	return t, t.C()
+}
+
+// Handles the failure detector. Every peer gets at least one status packet per heartbeat
+// interval, and routes through dead peers are invalidated.
+func (gsp *Gossiper) startHeartbeatHandler() {
+	interval := time.Duration(gsp.Config().Timers.Heartbeat) * time.Second
+	timer := gsp.clock.NewTicker(interval)
+	gsp.spawn(func() {
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C():
+			case <-gsp.ctx.Done():
+				return
+			}
+			for _, peer := range gsp.Peers.CheckLiveness() {
+				gsp.Routing.InvalidateNeighbor(peer)
+			}
+			// dead peers are still probed so that they can come back
+			for _, peer := range gsp.Peers.NeedHeartbeat(interval / 2) {
+				gsp.sendStatusPacket(peer)
 			}
 		}
-	}()
+	})
 }
@@ -0,0 +1,97 @@
+package gossiper
+
+import (
+	"github.com/vquelque/Peerster/config"
+)
+
+// packet classes, each processed by its own pool of workers so that a flood of bulk
+// packets never delays the status packets and acks. There is no priority between the
+// classes : a packet only waits for the packets of its own class.
+const (
+	classControl = iota //status packets, acks and hellos
+	classGossip         //rumors, TLC and private messages
+	classSearch
+	classData   //data requests and replies
+	classClient //messages of the client and the web UI
+	classCount
+)
+
+var classNames = [classCount]string{"control", "gossip", "search", "data", "client"}
+
+// workerPool processes the packets of a class with a fixed number of workers.
+type workerPool struct {
+	workers int
+	queue   chan func()
+}
+
+// newWorkerPools creates the pools of each class of packets. The workers are started
+// with the gossiper.
+func newWorkerPools(cfg config.Workers) [classCount]*workerPool {
+	var pools [classCount]*workerPool
+	for class, pool := range [classCount]config.Pool{cfg.Control, cfg.Gossip, cfg.Search, cfg.Data, cfg.Client} {
+		pools[class] = &workerPool{workers: pool.Workers, queue: make(chan func(), pool.Queue)}
+	}
+	return pools
+}
+
+// startWorkers starts the workers of all the pools. They exit when the gossiper stops,
+// dropping the packets still queued.
+func (gsp *Gossiper) startWorkers() {
+	for _, pool := range gsp.pools {
+		queue := pool.queue
+		for i := 0; i < pool.workers; i++ {
+			gsp.spawn(func() {
+				for {
+					select {
+					case handle := <-queue:
+						handle()
+					case <-gsp.ctx.Done():
+						return
+					}
+				}
+			})
+		}
+	}
+}
+
+// dispatch queues the handler of the packet in the pool of its class. Never blocks : the
+// packet is dropped and counted if the queue is full.
+func (gsp *Gossiper) dispatch(gp *GossipPacket, handle func()) {
+	if !gsp.enqueue(packetClass(gp), handle) {
+		gsp.Metrics.packetsDropped.With(packetType(gp)).Inc()
+		netLog.Debugf("dropping %s packet : %s queue full", packetType(gp), classNames[packetClass(gp)])
+	}
+}
+
+// enqueue queues handle in the pool of class. Returns false if the queue is full.
+func (gsp *Gossiper) enqueue(class int, handle func()) bool {
+	select {
+	case gsp.pools[class].queue <- handle:
+		return true
+	default:
+		return false
+	}
+}
+
+// queuedPackets returns the number of packets waiting for a worker.
+func (gsp *Gossiper) queuedPackets() int {
+	queued := 0
+	for _, pool := range gsp.pools {
+		queued += len(pool.queue)
+	}
+	return queued
+}
+
+// packetClass returns the class of the packet, selecting its worker pool.
+func packetClass(gp *GossipPacket) int {
+	switch {
+	case gp.StatusPacket != nil, gp.Ack != nil, gp.PrivateAck != nil, gp.Hello != nil:
+		return classControl
+	case gp.SearchRequest != nil, gp.SearchReply != nil:
+		return classSearch
+	case gp.DataRequest != nil, gp.DataReply != nil:
+		return classData
+	default:
+		return classGossip
+	}
+}
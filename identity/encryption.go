@@ -0,0 +1,73 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+const x25519KeySize = 32
+
+// Encrypt encrypts plaintext for the owner of the X25519 key destKey. A fresh ephemeral key is
+// used for every message so that only the destination can derive the AES-GCM key.
+// ad is authenticated but not encrypted.
+func Encrypt(destKey []byte, plaintext []byte, ad []byte) (ephemeral []byte, nonce []byte, ciphertext []byte, err error) {
+	pub, err := ecdh.X25519().NewPublicKey(destKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	aead, err := newAEAD(shared, eph.PublicKey().Bytes(), destKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, nil, err
+	}
+	return eph.PublicKey().Bytes(), nonce, aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+// Decrypt decrypts a message encrypted with Encrypt for this identity.
+func (id *Identity) Decrypt(ephemeral []byte, nonce []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := id.decryptionKey.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(shared, ephemeral, id.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size %d", len(nonce))
+	}
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// newAEAD derives the AES-256-GCM key from the shared secret and both public keys.
+func newAEAD(shared []byte, ephemeral []byte, destKey []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("peerster private message"))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(destKey)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,79 @@
+package identity
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	dest, other := NewIdentity("B"), NewIdentity("C")
+	ad := []byte("A->B")
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("hello")},
+		{"large", bytes.Repeat([]byte("peerster"), 8192)},
+	}
+	for _, tt := range tests {
+		eph, nonce, ciphertext, err := Encrypt(dest.EncryptionKey, tt.plaintext, ad)
+		if err != nil {
+			t.Fatalf("%s : %v", tt.name, err)
+		}
+		if len(tt.plaintext) > 0 && bytes.Contains(ciphertext, tt.plaintext) {
+			t.Fatalf("%s : plaintext in the ciphertext", tt.name)
+		}
+		plaintext, err := dest.Decrypt(eph, nonce, ciphertext, ad)
+		if err != nil || !bytes.Equal(plaintext, tt.plaintext) {
+			t.Fatalf("%s : decrypted %q, %v", tt.name, plaintext, err)
+		}
+		if _, err := other.Decrypt(eph, nonce, ciphertext, ad); err == nil {
+			t.Fatalf("%s : decrypted by another identity", tt.name)
+		}
+		// every message has its own ephemeral key
+		eph2, _, ciphertext2, _ := Encrypt(dest.EncryptionKey, tt.plaintext, ad)
+		if bytes.Equal(eph, eph2) || bytes.Equal(ciphertext, ciphertext2) {
+			t.Fatalf("%s : ephemeral key reused", tt.name)
+		}
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	dest := NewIdentity("B")
+	ad := []byte("A->B")
+	eph, nonce, ciphertext, err := Encrypt(dest.EncryptionKey, []byte("hello"), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flip := func(b []byte, i int) []byte {
+		c := append([]byte{}, b...)
+		c[i] ^= 1
+		return c
+	}
+	tests := []struct {
+		name                  string
+		eph, nonce, cipher, a []byte
+	}{
+		{"ciphertext", eph, nonce, flip(ciphertext, 0), ad},
+		{"tag", eph, nonce, flip(ciphertext, len(ciphertext)-1), ad},
+		{"truncated ciphertext", eph, nonce, ciphertext[:len(ciphertext)-1], ad},
+		{"empty ciphertext", eph, nonce, nil, ad},
+		{"nonce", eph, flip(nonce, 0), ciphertext, ad},
+		{"short nonce", eph, nonce[:8], ciphertext, ad},
+		{"ephemeral key", flip(eph, 0), nonce, ciphertext, ad},
+		{"short ephemeral key", eph[:16], nonce, ciphertext, ad},
+		{"other origin", eph, nonce, ciphertext, []byte("C->B")},
+		{"missing additional data", eph, nonce, ciphertext, nil},
+	}
+	for _, tt := range tests {
+		if _, err := dest.Decrypt(tt.eph, tt.nonce, tt.cipher, tt.a); err == nil {
+			t.Fatalf("%s : decrypted", tt.name)
+		}
+	}
+	for _, key := range [][]byte{nil, dest.EncryptionKey[:31], append(dest.EncryptionKey, 0)} {
+		if _, _, _, err := Encrypt(key, []byte("hello"), ad); err == nil {
+			t.Fatalf("encrypted for a key of %d bytes", len(key))
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Identity binds the name of a gossiper to its Ed25519 key pair. It also owns an
+// X25519 key used by the other gossipers to encrypt private messages for it.
+type Identity struct {
+	Name          string
+	PublicKey     ed25519.PublicKey
+	EncryptionKey []byte //X25519 public key
+	privateKey    ed25519.PrivateKey
+	decryptionKey *ecdh.PrivateKey
+}
+
+// KeyStore keeps the public keys of the other gossipers. A key is pinned the first
+// time it is seen for a name and never replaced afterwards.
+type KeyStore struct {
+	keys           map[string]ed25519.PublicKey //name -> public key
+	encryptionKeys map[string][]byte            //name -> X25519 public key
+	lock           sync.RWMutex
+}
+
+// NewIdentity generates a new key pair for name.
+func NewIdentity(name string) *Identity {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	dec, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return newIdentity(name, priv, dec)
+}
+
+func newIdentity(name string, priv ed25519.PrivateKey, dec *ecdh.PrivateKey) *Identity {
+	return &Identity{
+		Name:          name,
+		PublicKey:     priv.Public().(ed25519.PublicKey),
+		EncryptionKey: dec.PublicKey().Bytes(),
+		privateKey:    priv,
+		decryptionKey: dec,
+	}
+}
+
+// LoadOrCreateIdentity loads the private key stored at path or generates and stores
+// a new one, so that the gossiper keeps its identity across restarts.
+func LoadOrCreateIdentity(name string, path string) (*Identity, error) {
+	// the file holds the Ed25519 private key followed by the X25519 private key
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(data) != ed25519.PrivateKeySize && len(data) != ed25519.PrivateKeySize+x25519KeySize {
+			return nil, fmt.Errorf("invalid private key in %s", path)
+		}
+		priv := ed25519.PrivateKey(data[:ed25519.PrivateKeySize])
+		if len(data) == ed25519.PrivateKeySize {
+			// key file without encryption key : generate it
+			dec, err := ecdh.X25519().GenerateKey(rand.Reader)
+			if err != nil {
+				return nil, err
+			}
+			id := newIdentity(name, priv, dec)
+			return id, id.store(path)
+		}
+		dec, err := ecdh.X25519().NewPrivateKey(data[ed25519.PrivateKeySize:])
+		if err != nil {
+			return nil, err
+		}
+		return newIdentity(name, priv, dec), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	id := NewIdentity(name)
+	return id, id.store(path)
+}
+
+func (id *Identity) store(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	data := append(append([]byte{}, id.privateKey...), id.decryptionKey.Bytes()...)
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Sign signs the given digest with the private key of the identity.
+func (id *Identity) Sign(digest []byte) []byte {
+	return ed25519.Sign(id.privateKey, digest)
+}
+
+// NewKeyStore creates an empty key store.
+func NewKeyStore() *KeyStore {
+	return &KeyStore{keys: make(map[string]ed25519.PublicKey), encryptionKeys: make(map[string][]byte), lock: sync.RWMutex{}}
+}
+
+// Pin binds key to name if name has no key yet. Returns false if name is
+// already bound to another key.
+func (ks *KeyStore) Pin(name string, key []byte) bool {
+	if len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	pinned, found := ks.keys[name]
+	if !found {
+		k := make(ed25519.PublicKey, len(key))
+		copy(k, key)
+		ks.keys[name] = k
+		return true
+	}
+	return bytes.Equal(pinned, key)
+}
+
+// Get returns the public key pinned for name, nil if unknown.
+func (ks *KeyStore) Get(name string) ed25519.PublicKey {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	return ks.keys[name]
+}
+
+// Verify checks that sig is a valid signature of digest by name.
+func (ks *KeyStore) Verify(name string, digest []byte, sig []byte) bool {
+	key := ks.Get(name)
+	if key == nil {
+		return false
+	}
+	return ed25519.Verify(key, digest, sig)
+}
+
+// VerifyAndPin checks sig with the key carried by the message and pins it on first use.
+func (ks *KeyStore) VerifyAndPin(name string, key []byte, digest []byte, sig []byte) bool {
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(key), digest, sig) {
+		return false
+	}
+	return ks.Pin(name, key)
+}
+
+// PinEncryptionKey binds the X25519 key to name if name has no encryption key yet.
+// The key must come from a message signed by name.
+func (ks *KeyStore) PinEncryptionKey(name string, key []byte) bool {
+	if len(key) != x25519KeySize {
+		return false
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	pinned, found := ks.encryptionKeys[name]
+	if !found {
+		ks.encryptionKeys[name] = append([]byte{}, key...)
+		return true
+	}
+	return bytes.Equal(pinned, key)
+}
+
+// GetEncryptionKey returns the X25519 key pinned for name, nil if unknown.
+func (ks *KeyStore) GetEncryptionKey(name string) []byte {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	return ks.encryptionKeys[name]
+}
+
+// GetAll returns a copy of all the pinned keys.
+func (ks *KeyStore) GetAll() map[string][]byte {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	keys := make(map[string][]byte, len(ks.keys))
+	for name, k := range ks.keys {
+		keys[name] = k
+	}
+	return keys
+}
@@ -0,0 +1,192 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %s", s)
+}
+
+// Logger writes the entries of one component of the gossiper.
+type Logger struct {
+	component string
+}
+
+// configuration shared by all the loggers
+var (
+	lock         sync.RWMutex
+	output       io.Writer = os.Stderr
+	traceOutput  io.Writer = os.Stdout
+	jsonFormat   bool
+	defaultLevel = LevelInfo
+	levels       = make(map[string]Level) //component -> level overriding the default one
+	components   = make(map[string]bool)
+)
+
+type entry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Component string `json:"component"`
+	Msg       string `json:"msg"`
+}
+
+// New returns the logger of the given component.
+func New(component string) *Logger {
+	lock.Lock()
+	defer lock.Unlock()
+	components[component] = true
+	return &Logger{component: component}
+}
+
+// SetOutput sets the writer of the log entries. Defaults to stderr.
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+	output = w
+}
+
+// SetTraceOutput sets the writer of the protocol trace. Defaults to stdout, nil disables it.
+func SetTraceOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+	traceOutput = w
+}
+
+// SetJSON switches between text and JSON log entries. It does not change the protocol
+// trace, which is always written as plain text lines.
+func SetJSON(enabled bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	jsonFormat = enabled
+}
+
+// SetLevel sets the minimum level of the entries logged by component. An empty
+// component sets the default level of all the components without their own level.
+func SetLevel(component string, level Level) {
+	lock.Lock()
+	defer lock.Unlock()
+	if component == "" {
+		defaultLevel = level
+		return
+	}
+	levels[component] = level
+}
+
+// GetLevels returns the level of every known component. The default level is under "".
+func GetLevels() map[string]string {
+	lock.RLock()
+	defer lock.RUnlock()
+	all := map[string]string{"": defaultLevel.String()}
+	for c := range components {
+		all[c] = levelOf(c).String()
+	}
+	return all
+}
+
+// caller must hold the lock
+func levelOf(component string) Level {
+	if l, found := levels[component]; found {
+		return l
+	}
+	return defaultLevel
+}
+
+// Enabled checks if entries of the given level are logged by l.
+func (l *Logger) Enabled(level Level) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return level >= levelOf(l.component)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+}
+
+// Tracef writes a protocol trace line, as expected by the grading scripts, to the trace
+// sink. The line is also logged at debug level.
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	lock.RLock()
+	w := traceOutput
+	lock.RUnlock()
+	if w != nil {
+		io.WriteString(w, line)
+	}
+	l.log(LevelDebug, "%s", strings.TrimSpace(line))
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	lock.RLock()
+	defer lock.RUnlock()
+	if level < levelOf(l.component) || output == nil {
+		return
+	}
+	e := entry{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Level:     level.String(),
+		Component: l.component,
+		Msg:       strings.TrimRight(fmt.Sprintf(format, args...), " \n"),
+	}
+	if jsonFormat {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		output.Write(append(data, '\n'))
+		return
+	}
+	fmt.Fprintf(output, "%s %-5s [%s] %s\n", e.Time, strings.ToUpper(e.Level), e.Component, e.Msg)
+}
@@ -1,63 +1,168 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/vquelque/Peerster/config"
 	"github.com/vquelque/Peerster/constant"
 	"github.com/vquelque/Peerster/gossiper"
 	"github.com/vquelque/Peerster/server"
-	"github.com/vquelque/Peerster/utils"
 )
 
-const defaultAntiEntropy = 10 //in seconds
-const defaultRTimer = 0       //in seconds
+// time given to the in-flight handlers to finish on SIGINT or SIGTERM
+const shutdownTimeout = 10 * time.Second
 
 func main() {
-	uiPort := flag.Int("UIPort", 8080, "Port for the UI client (default 8080)")
-	gossipAddr := flag.String("gossipAddr", "", "ip:port for the gossiper")
-	name := flag.String("name", "", "Name of the gossiper")
-	peersList := flag.String("peers", "", "Comma separated list of peers of the form ip:port")
-	simple := flag.Bool("simple", false, "Run gossiper in simple broadcast mode")
-	antiEntropy := flag.Int("antiEntropy", 10, "Anti entropy timer value in seconds (default to 10sec)")
-	startUIServer := flag.Bool("uisrv", false, "set to true to start the UI server on the UI port")
-	rtimerFlag := flag.Int("rtimer", 0, "time between sending two route rumor messages")
-	hw3ex2Flag := flag.Bool("hw3ex2", false, "HW3 EX2 Blockchain flag")
-	hw3ex3Flag := flag.Bool("hw3ex3", false, "HW3 EX3 Blockchain flag")
-	hw3ex4Flag := flag.Bool("hw3ex4", false, "HW3 EX4 Blockchain flag")
-	ackAfllFlag := flag.Bool("ackAll", false, "ACKALL Flag")
-	peersNumber := flag.Uint64("N", 0, "Number of peers in the Network")
-	stubbornTimeoutFlag := flag.Int("stubbornTimeout", 0, "stubbornTimeout")
-	hoplimitFlag := flag.Int("hoplimit", -1, "TLC hoplimit")
+	configFile := flag.String("config", "", "JSON configuration file. The other flags override it")
+	profile := flag.String("profile", "", "profile of the configuration file to apply")
+	flag.Int("UIPort", 8080, "Port for the UI client (default 8080)")
+	flag.String("gossipAddr", "", "ip:port for the gossiper")
+	flag.String("name", "", "Name of the gossiper")
+	flag.String("peers", "", "Comma separated list of peers of the form ip:port")
+	flag.Bool("simple", false, "Run gossiper in simple broadcast mode")
+	flag.Int("antiEntropy", constant.DefaultAntiEntropy, "Anti entropy timer value in seconds (default to 10sec)")
+	flag.Bool("uisrv", false, "set to true to start the UI server on the UI port")
+	flag.Int("rtimer", 0, "time between sending two route rumor messages")
+	flag.Bool("hw3ex2", false, "HW3 EX2 Blockchain flag")
+	flag.Bool("hw3ex3", false, "HW3 EX3 Blockchain flag")
+	flag.Bool("hw3ex4", false, "HW3 EX4 Blockchain flag")
+	flag.Bool("ackAll", false, "ACKALL Flag")
+	flag.Uint64("N", 0, "Number of peers in the Network")
+	flag.Int("stubbornTimeout", constant.DefaultStubbornTimeout, "stubbornTimeout")
+	flag.Int("hoplimit", constant.DefaultHopLimit, "TLC hoplimit")
+	flag.String("dataDir", "", "directory where shared and downloaded chunks are persisted. Keep them in memory if empty")
+	flag.Int("downloadWindow", constant.DefaultDownloadWindow, "number of chunk requests in flight per download")
+	flag.Int("heartbeat", constant.DefaultHeartbeatInterval, "interval in seconds between two heartbeats of the peers failure detector. 0 to disable")
+	flag.String("transport", constant.TransportUDP, "transport used to reach the peers : udp or tcp. TCP gossipers also accept UDP packets")
+	flag.String("logLevel", "info", "minimum level of the logs written to stderr : debug, info, warn or error")
+	flag.Bool("logJSON", false, "write the logs to stderr as JSON objects. The protocol trace on stdout stays plain text")
+	flag.Bool("trace", true, "write the protocol trace to stdout")
+	flag.Bool("cacheChunks", false, "also keep chunks in memory when using -dataDir")
+	flag.String("keyFile", "", "file of the identity key. Defaults to identity.key in -dataDir, else to ~/.peerster/<name>.key. \""+constant.NoKeyFile+"\" for a new identity at every start")
+	flag.String("chunking", constant.ChunkingFixed, "how the shared files are cut into chunks : fixed or cdc (content defined, to share chunks between versions of a file)")
+	flag.Int("compressThreshold", constant.CompressThreshold, "packets larger than this many bytes are compressed for the peers supporting it. 0 to disable")
+	flag.Int64("seed", 0, "seed of the random choices of the gossiper. 0 to seed from the clock")
 
 	flag.Parse()
-	antiEntropyTimer := *antiEntropy
-	if antiEntropyTimer < 0 {
-		antiEntropyTimer = defaultAntiEntropy
+	// the configuration is loaded again when reloaded at runtime
+	loadConfig := func() (*config.Config, error) {
+		cfg, err := config.Load(*configFile, *profile)
+		if err != nil {
+			return nil, err
+		}
+		// only the flags given on the command line override the configuration file
+		flag.Visit(func(f *flag.Flag) {
+			applyFlag(cfg, f)
+		})
+		return cfg, cfg.Validate()
 	}
-	rtimer := *rtimerFlag
-	if rtimer < 0 {
-		rtimer = defaultRTimer
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
-	stubbornTimeout := *stubbornTimeoutFlag
-	if stubbornTimeout <= 0 {
-		stubbornTimeout = constant.DefaultStubbornTimeout
-	}
-	var hoplimit uint32
-	if *hoplimitFlag < 0 {
-		hoplimit = constant.DefaultHopLimit
-	} else {
-		hoplimit = uint32(*hoplimitFlag)
-	}
-	additionalFlags := &utils.AdditionalFlags{HW3ex2: *hw3ex2Flag, PeersNumber: *peersNumber, StubbornTimeout: stubbornTimeout, HW3ex3: *hw3ex3Flag, AckAll: *ackAfllFlag, HW3ex4: *hw3ex4Flag}
-	gossiper := gossiper.NewGossiper(*gossipAddr, *name, *uiPort, *peersList, *simple, antiEntropyTimer, rtimer, hoplimit, additionalFlags)
+	cfg.ApplyLog()
+	gossiper := gossiper.NewGossiper(cfg)
+	gossiper.SetConfigLoader(loadConfig)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				gossiper.ReloadConfig()
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := gossiper.Stop(ctx); err != nil {
+				log.Print(err)
+			}
+			cancel()
+			return
+		}
+	}()
 	//starts UI server if flag is set
-	if *startUIServer {
-		uiServer := server.StartUIServer(*uiPort, gossiper)
-		defer uiServer.Shutdown(nil)
+	if cfg.UIServer {
+		server.StartUIServer(cfg.UIPort, gossiper)
 	}
 
 	gossiper.Start()
-	defer gossiper.KillGossiper()
 	gossiper.Active.Wait()
 
 }
+
+// applyFlag overrides the configuration with a flag given on the command line. Negative
+// timers and hop limits keep the configured value.
+func applyFlag(cfg *config.Config, f *flag.Flag) {
+	value := f.Value.(flag.Getter).Get()
+	switch f.Name {
+	case "UIPort":
+		cfg.UIPort = value.(int)
+	case "gossipAddr":
+		cfg.GossipAddr = value.(string)
+	case "name":
+		cfg.Name = value.(string)
+	case "peers":
+		cfg.SetPeers(value.(string))
+	case "simple":
+		cfg.Simple = value.(bool)
+	case "antiEntropy":
+		if value.(int) >= 0 {
+			cfg.Timers.AntiEntropy = value.(int)
+		}
+	case "uisrv":
+		cfg.UIServer = value.(bool)
+	case "rtimer":
+		if value.(int) >= 0 {
+			cfg.Timers.RTimer = value.(int)
+		}
+	case "hw3ex2":
+		cfg.Consensus.HW3ex2 = value.(bool)
+	case "hw3ex3":
+		cfg.Consensus.HW3ex3 = value.(bool)
+	case "hw3ex4":
+		cfg.Consensus.HW3ex4 = value.(bool)
+	case "ackAll":
+		cfg.Consensus.AckAll = value.(bool)
+	case "N":
+		cfg.Consensus.PeersNumber = value.(uint64)
+	case "stubbornTimeout":
+		if value.(int) > 0 {
+			cfg.Consensus.StubbornTimeout = value.(int)
+		}
+	case "hoplimit":
+		if value.(int) >= 0 {
+			cfg.Consensus.HopLimit = uint32(value.(int))
+		}
+	case "dataDir":
+		cfg.Files.DataDir = value.(string)
+	case "keyFile":
+		cfg.Files.KeyFile = value.(string)
+	case "downloadWindow":
+		cfg.Files.DownloadWindow = value.(int)
+	case "heartbeat":
+		cfg.Timers.Heartbeat = value.(int)
+	case "transport":
+		cfg.Transport = value.(string)
+	case "logLevel":
+		cfg.Log.Level = value.(string)
+	case "logJSON":
+		cfg.Log.JSON = value.(bool)
+	case "trace":
+		cfg.Log.Trace = value.(bool)
+	case "cacheChunks":
+		cfg.Files.CacheChunks = value.(bool)
+	case "chunking":
+		cfg.Files.Chunking = value.(string)
+	case "compressThreshold":
+		if value.(int) >= 0 {
+			cfg.Compress = value.(int)
+		}
+	case "seed":
+		cfg.Seed = value.(int64)
+	}
+}
@@ -18,9 +18,13 @@ type SimpleMessage struct {
 
 //RumorMessage represents a type of Peerster message to be gossiped.
 type RumorMessage struct {
-	Origin string
-	ID     uint32
-	Text   string
+	Origin        string
+	ID            uint32
+	Text          string
+	PublicKey     []byte //public key of origin. Learned by the peers on first use
+	EncryptionKey []byte //X25519 key of origin used to encrypt private messages
+	Signature     []byte
+	HopCount      uint32 //distance to origin, incremented by each relay. Not signed
 }
 
 //Wrapper for RumorMessage/TLCMessage
@@ -37,7 +41,14 @@ type PeerStatus struct {
 
 //StatusPacket is exchanged between peers to exchange their vector clocks.
 type StatusPacket struct {
-	Want []PeerStatus
+	Want      []PeerStatus
+	Heartbeat uint64 //send time of the packet (ns), echoed back by the receiver
+	Echo      uint64 //last heartbeat received from the destination
+	EchoDelay uint64 //time the echoed heartbeat was held (ns)
+	Delta     bool   //Want only holds the origins changed since the vector of digest Base
+	Base      []byte
+	Digest    []byte //of the whole vector, set in the deltas
+	NeedFull  bool   //a delta of the destination could not be decoded : the next status sent to us must be full
 }
 
 //PrivateMessage between 2 peers
@@ -47,6 +58,31 @@ type PrivateMessage struct {
 	Text        string
 	Destination string
 	HopLimit    uint32
+	PublicKey   []byte //public key of origin, pinned on first use like the one of the rumors
+	Signature   []byte
+}
+
+// PrivateAck acknowledges the delivery of the private message ID sent by Destination.
+type PrivateAck struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	ID          uint32
+	PublicKey   []byte
+	Signature   []byte
+}
+
+// EncryptedPrivateMessage carries a PrivateMessage encrypted for Destination.
+// Relays only see the routing fields.
+type EncryptedPrivateMessage struct {
+	Origin       string
+	Destination  string
+	HopLimit     uint32
+	EphemeralKey []byte //X25519 key of the sender for this message
+	Nonce        []byte
+	Ciphertext   []byte //protobuf encoded PrivateMessage
+	PublicKey    []byte
+	Signature    []byte
 }
 
 type DataRequest struct {
@@ -54,6 +90,8 @@ type DataRequest struct {
 	Destination string
 	HopLimit    uint32
 	HashValue   []byte //hash of chunk or metafile if file request
+	PublicKey   []byte
+	Signature   []byte
 }
 
 type DataReply struct {
@@ -62,12 +100,16 @@ type DataReply struct {
 	HopLimit    uint32
 	HashValue   []byte
 	Data        []byte
+	PublicKey   []byte
+	Signature   []byte
 }
 
 type SearchRequest struct {
-	Origin   string
-	Budget   uint64
-	Keywords []string
+	Origin    string
+	Budget    uint64
+	Keywords  []string
+	PublicKey []byte
+	Signature []byte //budget is not signed as it is split by the relays
 }
 
 type SearchReply struct {
@@ -75,6 +117,8 @@ type SearchReply struct {
 	Destination string
 	HopLimit    uint32
 	Results     []*SearchResult
+	PublicKey   []byte
+	Signature   []byte
 }
 
 type SearchResult struct {
@@ -102,6 +146,8 @@ type TLCMessage struct {
 	TxBlock     BlockPublish
 	VectorClock *StatusPacket
 	Fitness     float32
+	PublicKey   []byte
+	Signature   []byte
 }
 
 type TLCAck *PrivateMessage
@@ -146,13 +192,26 @@ func NewPrivateMessage(origin string, text string, destination string, hoplimit
 	}
 	return &PrivateMessage{
 		Origin:      origin,
-		ID:          0, //no sequencing for private messages
+		ID:          0, //set by the sender when delivery is acknowledged
 		Text:        text,
 		Destination: destination,
 		HopLimit:    hoplimit,
 	}
 }
 
+// NewPrivateAck acknowledges the private message with given ID received from destination
+func NewPrivateAck(origin string, destination string, id uint32, hoplimit uint32) *PrivateAck {
+	if hoplimit == 0 {
+		hoplimit = constant.DefaultHopLimit //default hoplimit
+	}
+	return &PrivateAck{
+		Origin:      origin,
+		Destination: destination,
+		HopLimit:    hoplimit,
+		ID:          id,
+	}
+}
+
 // NewRouteRumorMessage creates a route rumor message used to updating routing table
 // entries of a peer. It is simply a rumor message with empty text field
 func NewRouteRumorMessage(origin string, ID uint32) *RumorMessage {
@@ -0,0 +1,57 @@
+package message
+
+// Capabilities are the optional features of the protocol supported by a gossiper, as flags.
+type Capabilities uint64
+
+const (
+	CapTLC              Capabilities = 1 << iota //TLC messages and acks
+	CapEncryptedPrivate                          //encrypted private messages and their acks
+	CapTCP                                       //TCP transport, with a fallback to UDP
+	CapCompression                               //compressed packets
+	CapDeltaStatus                               //status packets encoded relative to the last one exchanged
+)
+
+// BaselineCapabilities are assumed for the peers which never sent a hello, running the
+// original protocol.
+const BaselineCapabilities = CapTLC
+
+var capabilityNames = []struct {
+	c    Capabilities
+	name string
+}{
+	{CapTLC, "tlc"},
+	{CapEncryptedPrivate, "encrypted_private"},
+	{CapTCP, "tcp"},
+	{CapCompression, "compression"},
+	{CapDeltaStatus, "delta_status"},
+}
+
+// Hello advertises the protocol version and the capabilities of a gossiper to a peer. A
+// hello is answered once with Reply set.
+type Hello struct {
+	Version      uint32
+	Capabilities Capabilities
+	Reply        bool
+}
+
+// CompressedPacket carries the flate compressed encoding of a gossip packet, sent to the
+// peers advertising CapCompression.
+type CompressedPacket struct {
+	Data []byte
+}
+
+// Has checks if all the capabilities of f are in c.
+func (c Capabilities) Has(f Capabilities) bool {
+	return c&f == f
+}
+
+// Names returns the names of the known capabilities in c.
+func (c Capabilities) Names() []string {
+	names := make([]string, 0)
+	for _, n := range capabilityNames {
+		if c.Has(n.c) {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
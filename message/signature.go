@@ -0,0 +1,166 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+
+	"github.com/vquelque/Peerster/utils"
+)
+
+// The digests below are signed by the origin of the messages. They cover every field
+// except the signature and the fields updated by the relays, which no signature can
+// protect : the hop limit, the hop count of the rumors and the budget of the search
+// requests. A relay may change them, so they must never decide anything more than how
+// far a packet travels.
+
+// Digest returns the digest of the rumor message signed by its origin
+func (msg *RumorMessage) Digest() utils.SHA256 {
+	h := sha256.New()
+	writeString(h, "RUMOR")
+	writeString(h, msg.Origin)
+	binary.Write(h, binary.LittleEndian, msg.ID)
+	writeString(h, msg.Text)
+	writeBytes(h, msg.PublicKey)
+	writeBytes(h, msg.EncryptionKey)
+	return sum(h)
+}
+
+// Digest returns the digest of the private message signed by its origin
+func (msg *PrivateMessage) Digest() utils.SHA256 {
+	h := sha256.New()
+	writeString(h, "PRIVATE")
+	writeString(h, msg.Origin)
+	binary.Write(h, binary.LittleEndian, msg.ID)
+	writeString(h, msg.Text)
+	writeString(h, msg.Destination)
+	writeBytes(h, msg.PublicKey)
+	return sum(h)
+}
+
+// TLCAckDigest returns the digest of the TLC ack signed by its origin. Distinct from the
+// digest of a private message so that an ack signature can't be replayed as a message.
+func TLCAckDigest(ack TLCAck) utils.SHA256 {
+	h := sha256.New()
+	writeString(h, "TLCACK")
+	writeString(h, ack.Origin)
+	binary.Write(h, binary.LittleEndian, ack.ID)
+	writeString(h, ack.Destination)
+	writeBytes(h, ack.PublicKey)
+	return sum(h)
+}
+
+// Digest returns the digest of the private ack signed by its origin
+func (ack *PrivateAck) Digest() utils.SHA256 {
+	h := sha256.New()
+	writeString(h, "PRIVATEACK")
+	writeString(h, ack.Origin)
+	writeString(h, ack.Destination)
+	binary.Write(h, binary.LittleEndian, ack.ID)
+	writeBytes(h, ack.PublicKey)
+	return sum(h)
+}
+
+// Digest returns the digest of the encrypted private message signed by its origin
+func (msg *EncryptedPrivateMessage) Digest() utils.SHA256 {
+	h := sha256.New()
+	writeString(h, "ENCPRIVATE")
+	writeString(h, msg.Origin)
+	writeString(h, msg.Destination)
+	writeBytes(h, msg.EphemeralKey)
+	writeBytes(h, msg.Nonce)
+	writeBytes(h, msg.Ciphertext)
+	writeBytes(h, msg.PublicKey)
+	return sum(h)
+}
+
+// Digest returns the digest of the data request signed by its origin
+func (dr *DataRequest) Digest() utils.SHA256 {
+	h := sha256.New()
+	writeString(h, "DATAREQUEST")
+	writeString(h, dr.Origin)
+	writeString(h, dr.Destination)
+	writeBytes(h, dr.HashValue)
+	writeBytes(h, dr.PublicKey)
+	return sum(h)
+}
+
+// Digest returns the digest of the data reply signed by its origin
+func (r *DataReply) Digest() utils.SHA256 {
+	h := sha256.New()
+	writeString(h, "DATAREPLY")
+	writeString(h, r.Origin)
+	writeString(h, r.Destination)
+	writeBytes(h, r.HashValue)
+	writeBytes(h, r.Data)
+	writeBytes(h, r.PublicKey)
+	return sum(h)
+}
+
+// Digest returns the digest of the search request signed by its origin
+func (sr *SearchRequest) Digest() utils.SHA256 {
+	h := sha256.New()
+	writeString(h, "SEARCHREQUEST")
+	writeString(h, sr.Origin)
+	binary.Write(h, binary.LittleEndian, uint32(len(sr.Keywords)))
+	for _, kw := range sr.Keywords {
+		writeString(h, kw)
+	}
+	writeBytes(h, sr.PublicKey)
+	return sum(h)
+}
+
+// Digest returns the digest of the search reply signed by its origin
+func (r *SearchReply) Digest() utils.SHA256 {
+	h := sha256.New()
+	writeString(h, "SEARCHREPLY")
+	writeString(h, r.Origin)
+	writeString(h, r.Destination)
+	binary.Write(h, binary.LittleEndian, uint32(len(r.Results)))
+	for _, res := range r.Results {
+		writeString(h, res.FileName)
+		writeBytes(h, res.MetafileHash)
+		binary.Write(h, binary.LittleEndian, uint32(len(res.ChunkMap)))
+		binary.Write(h, binary.LittleEndian, res.ChunkMap)
+		binary.Write(h, binary.LittleEndian, res.ChunkCount)
+	}
+	writeBytes(h, r.PublicKey)
+	return sum(h)
+}
+
+// Digest returns the digest of the TLC message signed by its origin
+func (tlcmsg *TLCMessage) Digest() utils.SHA256 {
+	h := sha256.New()
+	writeString(h, "TLC")
+	writeString(h, tlcmsg.Origin)
+	binary.Write(h, binary.LittleEndian, tlcmsg.ID)
+	binary.Write(h, binary.LittleEndian, int64(tlcmsg.Confirmed))
+	bh := tlcmsg.TxBlock.Hash()
+	h.Write(bh[:])
+	binary.Write(h, binary.LittleEndian, tlcmsg.TxBlock.Transaction.Size)
+	if tlcmsg.VectorClock != nil {
+		binary.Write(h, binary.LittleEndian, uint32(len(tlcmsg.VectorClock.Want)))
+		for _, ps := range tlcmsg.VectorClock.Want {
+			writeString(h, ps.Identifier)
+			binary.Write(h, binary.LittleEndian, ps.NextID)
+		}
+	}
+	binary.Write(h, binary.LittleEndian, tlcmsg.Fitness)
+	writeBytes(h, tlcmsg.PublicKey)
+	return sum(h)
+}
+
+// length prefixed so that the concatenation of fields is unambiguous
+func writeString(h hash.Hash, s string) {
+	writeBytes(h, []byte(s))
+}
+
+func writeBytes(h hash.Hash, b []byte) {
+	binary.Write(h, binary.LittleEndian, uint32(len(b)))
+	h.Write(b)
+}
+
+func sum(h hash.Hash) (out utils.SHA256) {
+	copy(out[:], h.Sum(nil))
+	return
+}
@@ -0,0 +1,46 @@
+package message
+
+import "testing"
+
+func TestEncryptedPrivateDigest(t *testing.T) {
+	base := EncryptedPrivateMessage{
+		Origin:       "A",
+		Destination:  "B",
+		HopLimit:     10,
+		EphemeralKey: []byte{1, 2},
+		Nonce:        []byte{3, 4},
+		Ciphertext:   []byte{5, 6},
+		PublicKey:    []byte{7, 8},
+		Signature:    []byte{9},
+	}
+	tests := []struct {
+		name   string
+		modify func(m *EncryptedPrivateMessage)
+		signed bool
+	}{
+		{"origin", func(m *EncryptedPrivateMessage) { m.Origin = "C" }, true},
+		{"destination", func(m *EncryptedPrivateMessage) { m.Destination = "C" }, true},
+		{"ephemeral key", func(m *EncryptedPrivateMessage) { m.EphemeralKey = []byte{1, 3} }, true},
+		{"nonce", func(m *EncryptedPrivateMessage) { m.Nonce = []byte{3} }, true},
+		{"ciphertext", func(m *EncryptedPrivateMessage) { m.Ciphertext = []byte{5, 6, 0} }, true},
+		{"public key", func(m *EncryptedPrivateMessage) { m.PublicKey = nil }, true},
+		{"bytes moved between fields", func(m *EncryptedPrivateMessage) {
+			m.EphemeralKey, m.Nonce = []byte{1, 2, 3}, []byte{4}
+		}, true},
+		{"hop limit", func(m *EncryptedPrivateMessage) { m.HopLimit = 1 }, false},
+		{"signature", func(m *EncryptedPrivateMessage) { m.Signature = nil }, false},
+	}
+	for _, tt := range tests {
+		m := base
+		tt.modify(&m)
+		if changed := m.Digest() != base.Digest(); changed != tt.signed {
+			t.Errorf("%s : digest changed %v", tt.name, changed)
+		}
+	}
+	// the signature of another kind of message cannot be replayed
+	pm := PrivateMessage{Origin: "A", Destination: "B", PublicKey: base.PublicKey}
+	ack := PrivateAck{Origin: "A", Destination: "B", PublicKey: base.PublicKey}
+	if pm.Digest() == ack.Digest() || pm.Digest() == base.Digest() || ack.Digest() == base.Digest() {
+		t.Fatal("digests of distinct messages collide")
+	}
+}
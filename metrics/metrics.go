@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds the metrics of a gossiper and writes them in the Prometheus text
+// exposition format.
+type Registry struct {
+	metrics []metric
+	lock    sync.RWMutex
+}
+
+type metric struct {
+	name  string
+	help  string
+	typ   string
+	write func(w io.Writer, name string)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	value uint64
+}
+
+// CounterVec is a set of counters distinguished by the value of one label.
+type CounterVec struct {
+	label    string
+	counters map[string]*Counter
+	lock     sync.RWMutex
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	buckets []float64 //upper bounds, sorted
+	counts  []uint64
+	sum     float64
+	count   uint64
+	lock    sync.Mutex
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make([]metric, 0), lock: sync.RWMutex{}}
+}
+
+func (r *Registry) register(name string, help string, typ string, write func(w io.Writer, name string)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, metric{name: name, help: help, typ: typ, write: write})
+}
+
+// NewCounter registers a new counter.
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s %d\n", name, c.Get())
+	})
+	return c
+}
+
+// NewCounterVec registers a new set of counters with the given label.
+func (r *Registry) NewCounterVec(name string, help string, label string) *CounterVec {
+	cv := &CounterVec{label: label, counters: make(map[string]*Counter)}
+	r.register(name, help, "counter", cv.write)
+	return cv
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by f at each scrape.
+func (r *Registry) NewGaugeFunc(name string, help string, f func() float64) {
+	r.register(name, help, "gauge", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(f()))
+	})
+}
+
+// NewHistogram registers a new histogram with the given bucket upper bounds.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+	h := &Histogram{buckets: b, counts: make([]uint64, len(b))}
+	r.register(name, help, "histogram", h.write)
+	return h
+}
+
+// WriteText writes all the metrics in the text exposition format.
+func (r *Registry) WriteText(w io.Writer) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, m := range r.metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+		m.write(w, m.name)
+	}
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Get returns the current value of the counter.
+func (c *Counter) Get() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// With returns the counter for the given label value.
+func (cv *CounterVec) With(value string) *Counter {
+	cv.lock.RLock()
+	c, found := cv.counters[value]
+	cv.lock.RUnlock()
+	if found {
+		return c
+	}
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+	c, found = cv.counters[value]
+	if !found {
+		c = &Counter{}
+		cv.counters[value] = c
+	}
+	return c
+}
+
+func (cv *CounterVec) write(w io.Writer, name string) {
+	cv.lock.RLock()
+	defer cv.lock.RUnlock()
+	values := make([]string, 0, len(cv.counters))
+	for v := range cv.counters {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, cv.label, v, cv.counters[v].Get())
+	}
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/vquelque/Peerster/constant"
 	"github.com/vquelque/Peerster/message"
 	"github.com/vquelque/Peerster/utils"
 )
@@ -16,7 +17,7 @@ type Observer struct {
 }
 
 type FileObserver struct {
-	waitingForData map[utils.SHA256]chan *message.DataReply
+	waitingForData map[utils.SHA256]map[chan *message.DataReply]bool //chunk hash -> requests waiting for it
 	lock           sync.RWMutex
 }
 
@@ -25,6 +26,11 @@ type SearchObserver struct {
 	lock            sync.RWMutex
 }
 
+type PrivateAckObserver struct {
+	waitingForAck map[string]chan bool
+	lock          sync.RWMutex
+}
+
 type TLCAckObserver struct {
 	waitingForAck map[string]chan message.TLCAck
 	lock          sync.RWMutex
@@ -38,7 +44,7 @@ func Init() *Observer {
 func (obs *Observer) Register(sender string) chan bool {
 	obs.lock.Lock()
 	defer obs.lock.Unlock()
-	ackChan := make(chan bool)
+	ackChan := make(chan bool, 1)
 	obs.waitingForAck[sender] = ackChan
 	return ackChan
 }
@@ -64,31 +70,46 @@ func (obs *Observer) GetObserver(sp *message.StatusPacket, peer string) chan boo
 }
 
 func InitFileObserver() *FileObserver {
-	obs := &FileObserver{make(map[utils.SHA256]chan *message.DataReply), sync.RWMutex{}}
+	obs := &FileObserver{make(map[utils.SHA256]map[chan *message.DataReply]bool), sync.RWMutex{}}
 	return obs
 }
 
+// RegisterFileObserver returns a new channel receiving the replies for the hash. Several
+// requests can wait for the same hash : each one gets its own channel.
 func (obs *FileObserver) RegisterFileObserver(caller utils.SHA256) chan *message.DataReply {
 	obs.lock.Lock()
 	defer obs.lock.Unlock()
-	ch := make(chan *message.DataReply)
-	obs.waitingForData[caller] = ch
+	// buffered so that a late duplicate reply never blocks the packet handler
+	ch := make(chan *message.DataReply, 1)
+	if obs.waitingForData[caller] == nil {
+		obs.waitingForData[caller] = make(map[chan *message.DataReply]bool)
+	}
+	obs.waitingForData[caller][ch] = true
 	return ch
 }
 
-func (obs *FileObserver) UnregisterFileObserver(caller utils.SHA256) {
+// UnregisterFileObserver removes the channel returned by RegisterFileObserver.
+func (obs *FileObserver) UnregisterFileObserver(caller utils.SHA256, ch chan *message.DataReply) {
 	obs.lock.Lock()
 	defer obs.lock.Unlock()
-	delete(obs.waitingForData, caller)
-
+	delete(obs.waitingForData[caller], ch)
+	if len(obs.waitingForData[caller]) == 0 {
+		delete(obs.waitingForData, caller)
+	}
 }
 
 func (obs *FileObserver) SendDataToObserver(caller utils.SHA256, chunk *message.DataReply) error {
 	obs.lock.RLock()
 	defer obs.lock.RUnlock()
-	ackChan, found := obs.waitingForData[caller]
-	if found && ackChan != nil {
-		ackChan <- chunk
+	observers, found := obs.waitingForData[caller]
+	if found {
+		for ackChan := range observers {
+			select {
+			case ackChan <- chunk:
+			default:
+				// observer already has a pending reply
+			}
+		}
 		return nil
 	}
 	return fmt.Errorf("No observer found for this reply")
@@ -102,7 +123,7 @@ func InitSearchObserver() *SearchObserver {
 func (obs *SearchObserver) RegisterSearchObserver(sr *message.SearchRequest) chan *message.SearchReply {
 	obs.lock.Lock()
 	defer obs.lock.Unlock()
-	ch := make(chan *message.SearchReply)
+	ch := make(chan *message.SearchReply, constant.ChannelSize)
 	obs.waitingForReply[sr] = ch
 	return ch
 }
@@ -113,6 +134,8 @@ func (obs *SearchObserver) UnregisterSearchObserver(sr *message.SearchRequest) {
 	delete(obs.waitingForReply, sr)
 }
 
+// SendMatchToSearchObserver sends the reply to the searches matching keyword. Never
+// blocks : the reply is dropped for the searches not keeping up.
 func (obs *SearchObserver) SendMatchToSearchObserver(r *message.SearchReply, keyword string) {
 	obs.lock.RLock()
 	defer obs.lock.RUnlock()
@@ -122,12 +145,46 @@ func (obs *SearchObserver) SendMatchToSearchObserver(r *message.SearchReply, key
 			// log.Printf("KEYWORD : %s. REPLY KEYWORD %s", keywords, keyword)
 			if strings.Contains(keyword, k) {
 				// log.Printf("GOT OBSERVER FOR SR with KEYWORD %s", keyword)
-				m <- r
+				select {
+				case m <- r:
+				default:
+				}
 			}
 		}
 	}
 }
 
+func InitPrivateAckObserver() *PrivateAckObserver {
+	return &PrivateAckObserver{waitingForAck: make(map[string]chan bool)}
+}
+
+// RegisterPrivateAckObserver registers a channel waiting for the ack of private message id sent to dest
+func (obs *PrivateAckObserver) RegisterPrivateAckObserver(dest string, id uint32) chan bool {
+	obs.lock.Lock()
+	defer obs.lock.Unlock()
+	ch := make(chan bool, 1)
+	obs.waitingForAck[fmt.Sprintf("%s:%d", dest, id)] = ch
+	return ch
+}
+
+func (obs *PrivateAckObserver) UnregisterPrivateAckObserver(dest string, id uint32) {
+	obs.lock.Lock()
+	defer obs.lock.Unlock()
+	delete(obs.waitingForAck, fmt.Sprintf("%s:%d", dest, id))
+}
+
+func (obs *PrivateAckObserver) SendAckToObserver(ack *message.PrivateAck) {
+	obs.lock.RLock()
+	defer obs.lock.RUnlock()
+	ackChan, found := obs.waitingForAck[fmt.Sprintf("%s:%d", ack.Origin, ack.ID)]
+	if found {
+		select {
+		case ackChan <- true:
+		default:
+		}
+	}
+}
+
 func InitTLCAckObserver() *TLCAckObserver {
 	return &TLCAckObserver{waitingForAck: make(map[string]chan message.TLCAck)}
 }
@@ -135,7 +192,7 @@ func InitTLCAckObserver() *TLCAckObserver {
 func (obs *TLCAckObserver) RegisterTLCAckObserver(tlcmsg *message.TLCMessage) chan message.TLCAck {
 	obs.lock.Lock()
 	defer obs.lock.Unlock()
-	ch := make(chan message.TLCAck)
+	ch := make(chan message.TLCAck, constant.ChannelSize)
 	obs.waitingForAck[TLCAckObserverIdentifier(tlcmsg)] = ch
 	return ch
 }
@@ -152,13 +209,18 @@ func (obs *TLCAckObserver) UnregisterTLCAckObservers(tlcmsg *message.TLCMessage)
 	delete(obs.waitingForAck, id)
 }
 
+// SendTLCToAckObserver sends the ack to the routine waiting for it. Never blocks : the
+// ack is dropped if the routine is not keeping up.
 func (obs *TLCAckObserver) SendTLCToAckObserver(r message.TLCAck) {
 	obs.lock.RLock()
 	defer obs.lock.RUnlock()
 	id := fmt.Sprintf("%s:%d", r.Destination, r.ID)
 	ackChan, found := obs.waitingForAck[id]
 	if found && ackChan != nil {
-		ackChan <- r
+		select {
+		case ackChan <- r:
+		default:
+		}
 	}
 }
 
@@ -5,49 +5,310 @@ import (
 	"math/rand"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/vquelque/Peerster/clock"
+	"github.com/vquelque/Peerster/message"
+	"github.com/vquelque/Peerster/utils"
+)
+
+// PeerState is the state of a peer as seen by the failure detector.
+type PeerState int
+
+const (
+	Alive   PeerState = iota
+	Suspect           //no packet received for a while
+	Dead              //not selected anymore for gossiping
 )
 
+func (s PeerState) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	default:
+		return "dead"
+	}
+}
+
+// PeerInfo is the liveness information exposed for a peer.
+type PeerInfo struct {
+	Address  string
+	State    string
+	LastSeen time.Time
+	RTT      time.Duration
+	Version  uint32   //protocol version advertised in the hello of the peer. 0 if unknown
+	Features []string //capabilities advertised by the peer. Empty if unknown
+}
+
+type peer struct {
+	static     bool      //given on the command line : never evicted
+	lastSeen   time.Time //last time a packet was received from the peer
+	state      PeerState
+	rtt        time.Duration //moving average of the round trip time
+	heartbeat  uint64        //last heartbeat received from the peer, to echo back
+	receivedAt time.Time     //reception time of heartbeat
+	lastSent   time.Time     //last time we sent a heartbeat to the peer
+	version    uint32        //0 until the peer sent a hello
+	caps       message.Capabilities
+	helloSent  time.Time //last time we sent a hello to the peer
+}
+
+// BannedPeer is a peer whose packets are ignored until a given time.
+type BannedPeer struct {
+	Address string
+	Until   time.Time
+	Reason  string
+}
+
 type Peers struct {
-	peers map[string]bool
-	lock  sync.RWMutex
+	peers          map[string]*peer
+	banned         map[string]*BannedPeer //address -> ban. Expired bans are removed lazily
+	suspectTimeout time.Duration
+	deadTimeout    time.Duration
+	evictTimeout   time.Duration
+	clock          clock.Clock
+	rand           *rand.Rand //picks the peers to gossip with
+	lock           sync.RWMutex
 }
 
-func NewPeersSet(peersStr string) *Peers {
-	peersSet := &Peers{peers: make(map[string]bool), lock: sync.RWMutex{}}
+// NewPeersSet creates the set of the comma separated peers. A nil clock uses the real time,
+// and a nil rnd a source seeded from it.
+func NewPeersSet(peersStr string, clk clock.Clock, rnd *rand.Rand) *Peers {
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	if rnd == nil {
+		rnd = utils.NewRand(clk.Now().UnixNano())
+	}
+	peersSet := &Peers{peers: make(map[string]*peer), banned: make(map[string]*BannedPeer), clock: clk, rand: rnd, lock: sync.RWMutex{}}
 	peersSet.lock.Lock()
 	defer peersSet.lock.Unlock()
 	peers := strings.Split(peersStr, ",")
-	for _, peer := range peers {
-		_, ok := peersSet.peers[peer]
-		if peer != "" && !ok {
-			peersSet.peers[peer] = true
+	for _, p := range peers {
+		_, ok := peersSet.peers[p]
+		if p != "" && !ok {
+			peersSet.peers[p] = &peer{static: true, lastSeen: peersSet.clock.Now()}
 		}
 	}
 	return peersSet
 }
 
-func (peersSet *Peers) Add(peer string) {
+// SetTimeouts configures the failure detector. A peer silent for suspect is suspected, for
+// dead is considered dead, and dead peers not given on the command line are evicted after
+// evict. A zero timeout disables the corresponding transition.
+func (peersSet *Peers) SetTimeouts(suspect time.Duration, dead time.Duration, evict time.Duration) {
+	peersSet.lock.Lock()
+	defer peersSet.lock.Unlock()
+	peersSet.suspectTimeout = suspect
+	peersSet.deadTimeout = dead
+	peersSet.evictTimeout = evict
+}
+
+// SetStatic replaces the peers given on the command line by list. The peers learned from
+// the network are kept. Returns the peers added and removed.
+func (peersSet *Peers) SetStatic(list []string) (added []string, removed []string) {
+	peersSet.lock.Lock()
+	defer peersSet.lock.Unlock()
+	static := make(map[string]bool)
+	for _, p := range list {
+		static[p] = true
+		info, ok := peersSet.peers[p]
+		if !ok {
+			peersSet.peers[p] = &peer{static: true, lastSeen: peersSet.clock.Now()}
+			added = append(added, p)
+			continue
+		}
+		info.static = true
+	}
+	for p, info := range peersSet.peers {
+		if info.static && !static[p] {
+			delete(peersSet.peers, p)
+			removed = append(removed, p)
+		}
+	}
+	return added, removed
+}
+
+func (peersSet *Peers) Add(p string) {
+	peersSet.lock.Lock()
+	defer peersSet.lock.Unlock()
+	_, ok := peersSet.peers[p]
+	if !ok {
+		peersSet.peers[p] = &peer{lastSeen: peersSet.clock.Now()}
+	}
+}
+
+// Seen records that a packet was just received from p, adding it if unknown.
+func (peersSet *Peers) Seen(p string) {
+	peersSet.lock.Lock()
+	defer peersSet.lock.Unlock()
+	info, ok := peersSet.peers[p]
+	if !ok {
+		peersSet.peers[p] = &peer{lastSeen: peersSet.clock.Now()}
+		return
+	}
+	info.lastSeen = peersSet.clock.Now()
+	info.state = Alive
+}
+
+// ReceivedHeartbeat records the heartbeat carried by a status packet from p. echo is one
+// of our own heartbeats sent back by p after holding it for delay.
+func (peersSet *Peers) ReceivedHeartbeat(p string, heartbeat uint64, echo uint64, delay time.Duration) {
+	peersSet.lock.Lock()
+	defer peersSet.lock.Unlock()
+	info, ok := peersSet.peers[p]
+	if !ok {
+		return
+	}
+	now := peersSet.clock.Now()
+	if heartbeat != 0 {
+		info.heartbeat = heartbeat
+		info.receivedAt = now
+	}
+	if echo == 0 {
+		return
+	}
+	rtt := now.Sub(time.Unix(0, int64(echo))) - delay
+	if rtt < 0 || (peersSet.deadTimeout > 0 && rtt > peersSet.deadTimeout) {
+		// bogus or too old to be meaningful
+		return
+	}
+	if info.rtt == 0 {
+		info.rtt = rtt
+	} else {
+		info.rtt = (7*info.rtt + rtt) / 8
+	}
+}
+
+// Heartbeat returns the heartbeat fields of the next status packet sent to p : our
+// current time, and the last heartbeat of p with the time we held it.
+func (peersSet *Peers) Heartbeat(p string) (heartbeat uint64, echo uint64, delay time.Duration) {
+	peersSet.lock.Lock()
+	defer peersSet.lock.Unlock()
+	now := peersSet.clock.Now()
+	heartbeat = uint64(now.UnixNano())
+	info, ok := peersSet.peers[p]
+	if !ok {
+		return heartbeat, 0, 0
+	}
+	info.lastSent = now
+	if info.heartbeat != 0 {
+		echo = info.heartbeat
+		delay = now.Sub(info.receivedAt)
+		// echo each heartbeat once
+		info.heartbeat = 0
+	}
+	return heartbeat, echo, delay
+}
+
+// RTT returns the moving average of the round trip time to p, 0 if not measured yet.
+func (peersSet *Peers) RTT(p string) time.Duration {
+	peersSet.lock.RLock()
+	defer peersSet.lock.RUnlock()
+	info, ok := peersSet.peers[p]
+	if !ok {
+		return 0
+	}
+	return info.rtt
+}
+
+// SetCapabilities records the protocol version and the capabilities advertised by p.
+func (peersSet *Peers) SetCapabilities(p string, version uint32, caps message.Capabilities) {
 	peersSet.lock.Lock()
 	defer peersSet.lock.Unlock()
-	_, ok := peersSet.peers[peer]
+	info, ok := peersSet.peers[p]
 	if !ok {
-		peersSet.peers[peer] = true
+		return
+	}
+	info.version = version
+	info.caps = caps
+}
+
+// Capabilities returns the protocol version and the capabilities advertised by p. known is
+// false if p never sent a hello.
+func (peersSet *Peers) Capabilities(p string) (version uint32, caps message.Capabilities, known bool) {
+	peersSet.lock.RLock()
+	defer peersSet.lock.RUnlock()
+	info, ok := peersSet.peers[p]
+	if !ok || info.version == 0 {
+		return 0, 0, false
+	}
+	return info.version, info.caps, true
+}
+
+// NeedHello checks if a hello must be sent to p : its capabilities are unknown and no hello
+// was sent to it for d. The hello is then recorded as sent.
+func (peersSet *Peers) NeedHello(p string, d time.Duration) bool {
+	peersSet.lock.Lock()
+	defer peersSet.lock.Unlock()
+	info, ok := peersSet.peers[p]
+	if !ok || info.version != 0 {
+		return false
+	}
+	now := peersSet.clock.Now()
+	if !info.helloSent.IsZero() && now.Sub(info.helloSent) < d {
+		return false
+	}
+	info.helloSent = now
+	return true
+}
+
+// CheckLiveness updates the state of the peers according to the time they were last
+// seen. Returns the peers that just died.
+func (peersSet *Peers) CheckLiveness() []string {
+	peersSet.lock.Lock()
+	defer peersSet.lock.Unlock()
+	died := make([]string, 0)
+	now := peersSet.clock.Now()
+	for addr, info := range peersSet.peers {
+		silence := now.Sub(info.lastSeen)
+		switch {
+		case peersSet.deadTimeout > 0 && silence > peersSet.deadTimeout:
+			if info.state != Dead {
+				info.state = Dead
+				died = append(died, addr)
+			}
+			if !info.static && peersSet.evictTimeout > 0 && silence > peersSet.deadTimeout+peersSet.evictTimeout {
+				delete(peersSet.peers, addr)
+			}
+		case peersSet.suspectTimeout > 0 && silence > peersSet.suspectTimeout:
+			info.state = Suspect
+		default:
+			info.state = Alive
+		}
+	}
+	return died
+}
+
+// NeedHeartbeat returns the peers to which no heartbeat was sent for at least d.
+func (peersSet *Peers) NeedHeartbeat(d time.Duration) []string {
+	peersSet.lock.RLock()
+	defer peersSet.lock.RUnlock()
+	peerList := make([]string, 0)
+	now := peersSet.clock.Now()
+	for addr, info := range peersSet.peers {
+		if now.Sub(info.lastSent) >= d {
+			peerList = append(peerList, addr)
+		}
 	}
+	return peerList
 }
 
-func (peersSet *Peers) Delete(peer string) {
+func (peersSet *Peers) Delete(p string) {
 	peersSet.lock.Lock()
 	defer peersSet.lock.Unlock()
-	_, ok := peersSet.peers[peer]
+	_, ok := peersSet.peers[p]
 	if ok {
-		delete(peersSet.peers, peer)
+		delete(peersSet.peers, p)
 	}
 }
 
-func (peersSet *Peers) CheckPeerPresent(peer string) bool {
+func (peersSet *Peers) CheckPeerPresent(p string) bool {
 	peersSet.lock.RLock()
 	defer peersSet.lock.RUnlock()
-	_, ok := peersSet.peers[peer]
+	_, ok := peersSet.peers[p]
 	return ok
 }
 
@@ -61,30 +322,17 @@ func (peersSet *Peers) PrintPeers() string {
 		peersString += peer
 		index++
 	}
-	return fmt.Sprintf("PEERS : " + peersString)
+	return fmt.Sprintf("PEERS : %s", peersString)
 }
 
+// PickRandomPeer picks a peer which is not dead at random in the set except the peer given
+// as argument. Returns an empty string if there is no such peer.
 func (peersSet *Peers) PickRandomPeer(sender string) string {
-	peersSet.lock.RLock()
-	defer peersSet.lock.RUnlock()
-	//pick a peer at random in the set except the peer given as argument
-	//returns nil if no other peer int the set
-	if peersSet.Size() == 0 {
-		return ""
-	}
-	slice := peersSet.GetAllPeers()
-	i1 := rand.Intn(len(slice))
-	p1 := slice[i1]
-
-	if p1 == sender {
-		if len(slice) > 1 {
-			i2 := rand.Intn(len(slice))
-			p2 := slice[i2]
-			return p2
-		}
+	slice := peersSet.GetAllPeersExcept(sender)
+	if len(slice) == 0 {
 		return "" //no other peers known
 	}
-	return p1
+	return slice[peersSet.rand.Intn(len(slice))]
 }
 
 func (peerSet *Peers) GetAllPeers() []string {
@@ -97,18 +345,90 @@ func (peerSet *Peers) GetAllPeers() []string {
 	return peerList
 }
 
+// GetAllPeersExcept returns the peers which are neither dead nor banned, except the given one.
 func (peerSet *Peers) GetAllPeersExcept(except string) []string {
 	peerSet.lock.RLock()
 	defer peerSet.lock.RUnlock()
 	peerList := make([]string, 0)
-	for peer := range peerSet.peers {
-		if peer != except {
+	now := peerSet.clock.Now()
+	for peer, info := range peerSet.peers {
+		if ban, banned := peerSet.banned[peer]; banned && now.Before(ban.Until) {
+			continue
+		}
+		if peer != except && info.state != Dead {
 			peerList = append(peerList, peer)
 		}
 	}
 	return peerList
 }
 
+// GetAllPeersInfo returns the liveness information of all the peers.
+func (peerSet *Peers) GetAllPeersInfo() []PeerInfo {
+	peerSet.lock.RLock()
+	defer peerSet.lock.RUnlock()
+	infos := make([]PeerInfo, 0, len(peerSet.peers))
+	for addr, info := range peerSet.peers {
+		pi := PeerInfo{Address: addr, State: info.state.String(), LastSeen: info.lastSeen, RTT: info.rtt, Features: []string{}}
+		if info.version != 0 {
+			pi.Version = info.version
+			pi.Features = info.caps.Names()
+		}
+		infos = append(infos, pi)
+	}
+	return infos
+}
+
+// Ban ignores the packets of the peer at address p for d.
+func (peerSet *Peers) Ban(p string, d time.Duration, reason string) {
+	peerSet.lock.Lock()
+	defer peerSet.lock.Unlock()
+	peerSet.banned[p] = &BannedPeer{Address: p, Until: peerSet.clock.Now().Add(d), Reason: reason}
+}
+
+// Unban lifts the ban of p. Returns false if p was not banned.
+func (peerSet *Peers) Unban(p string) bool {
+	peerSet.lock.Lock()
+	defer peerSet.lock.Unlock()
+	_, found := peerSet.banned[p]
+	delete(peerSet.banned, p)
+	return found
+}
+
+// IsBanned checks if the packets of p are ignored.
+func (peerSet *Peers) IsBanned(p string) bool {
+	peerSet.lock.RLock()
+	ban, found := peerSet.banned[p]
+	peerSet.lock.RUnlock()
+	if !found {
+		return false
+	}
+	if peerSet.clock.Now().Before(ban.Until) {
+		return true
+	}
+	peerSet.lock.Lock()
+	if peerSet.banned[p] == ban {
+		delete(peerSet.banned, p)
+	}
+	peerSet.lock.Unlock()
+	return false
+}
+
+// GetBanned returns the peers currently banned.
+func (peerSet *Peers) GetBanned() []BannedPeer {
+	peerSet.lock.Lock()
+	defer peerSet.lock.Unlock()
+	banned := make([]BannedPeer, 0, len(peerSet.banned))
+	now := peerSet.clock.Now()
+	for addr, ban := range peerSet.banned {
+		if !now.Before(ban.Until) {
+			delete(peerSet.banned, addr)
+			continue
+		}
+		banned = append(banned, *ban)
+	}
+	return banned
+}
+
 func (peerSet *Peers) Size() int {
 	peerSet.lock.RLock()
 	defer peerSet.lock.RUnlock()
@@ -3,32 +3,74 @@ package routing
 import (
 	"fmt"
 	"sync"
+	"time"
 
-	"github.com/vquelque/Peerster/message"
+	"github.com/vquelque/Peerster/clock"
+	"github.com/vquelque/Peerster/constant"
 )
 
+// Route is an entry of the routing table. Seq is the ID of the latest rumor of
+// the origin that was used to set the route, Hops the distance to the origin.
+type Route struct {
+	NextHop string
+	Seq     uint32
+	Hops    uint32
+	Updated time.Time
+}
+
 // Routing struct is a RoutingTable
 type Routing struct {
-	routes map[string]string //key -> Origin, value -> address:portnumber
-	lock   sync.RWMutex
+	routes          map[string]*Route    //key -> Origin, value -> route via address:portnumber
+	neighbors       map[string]time.Time //neighbor address -> last time we received a packet from it
+	routeTimeout    time.Duration
+	neighborTimeout time.Duration
+	latency         func(addr string) time.Duration //measured round trip time to a neighbor. 0 if unknown
+	clock           clock.Clock
+	lock            sync.RWMutex
 }
 
-// RoutingTable returns a new routing table with routing for direct neighbors
-func NewRoutingTable() *Routing {
+// RoutingTable returns a new routing table with routing for direct neighbors. A nil clock
+// uses the real time.
+func NewRoutingTable(clk clock.Clock) *Routing {
+	if clk == nil {
+		clk = clock.Real{}
+	}
 	rt := &Routing{
-		routes: make(map[string]string),
-		lock:   sync.RWMutex{},
+		routes:          make(map[string]*Route),
+		neighbors:       make(map[string]time.Time),
+		routeTimeout:    time.Duration(constant.RouteTimeout) * time.Second,
+		neighborTimeout: time.Duration(constant.NeighborTimeout) * time.Second,
+		latency:         func(string) time.Duration { return 0 },
+		clock:           clk,
+		lock:            sync.RWMutex{},
 	}
 	return rt
 }
 
+// SetTimeouts sets the route and neighbor timeouts. A zero timeout disables the
+// corresponding expiry.
+func (rt *Routing) SetTimeouts(routeTimeout time.Duration, neighborTimeout time.Duration) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.routeTimeout = routeTimeout
+	rt.neighborTimeout = neighborTimeout
+}
+
+// SetLatency sets the source of the round trip times to the neighbors, used to choose
+// between the routes advertised by the same rumor.
+func (rt *Routing) SetLatency(latency func(addr string) time.Duration) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.latency = latency
+}
+
 // AddRoute add a route to the routing table
 // In fact, nextHopAddr is the next hop for origin and is also the peer from which
 // we received the rumor message.
 func (rt *Routing) AddRoute(origin string, nextHopAddr string) {
 	rt.lock.Lock()
 	defer rt.lock.Unlock()
-	rt.routes[origin] = nextHopAddr
+	rt.routes[origin] = &Route{NextHop: nextHopAddr, Hops: 1, Updated: rt.clock.Now()}
 }
 
 // DeleteRoute deletes a route from the routing table
@@ -41,28 +83,95 @@ func (rt *Routing) DeleteRoute(origin string) {
 func (rt *Routing) PrintUpdate(origin string) string {
 	rt.lock.RLock()
 	defer rt.lock.RUnlock()
-	return fmt.Sprintf("DSDV %s %s", origin, rt.routes[origin])
+	nextHop := ""
+	if r, found := rt.routes[origin]; found {
+		nextHop = r.NextHop
+	}
+	return fmt.Sprintf("DSDV %s %s", origin, nextHop)
 }
 
 func (rt *Routing) Contains(origin string) bool {
 	rt.lock.RLock()
 	defer rt.lock.RUnlock()
-	_, ok := rt.routes[origin]
-	return ok
+	r, ok := rt.routes[origin]
+	return ok && rt.isValid(r)
 }
 
+// GetRoute returns the next hop for origin, empty if there is no valid route.
 func (rt *Routing) GetRoute(origin string) string {
 	rt.lock.RLock()
 	defer rt.lock.RUnlock()
-	return rt.routes[origin]
+	r, found := rt.routes[origin]
+	if !found || !rt.isValid(r) {
+		return ""
+	}
+	return r.NextHop
 }
 
-func (rt *Routing) UpdateRoute(msg *message.RumorMessage, sender string) {
+// UpdateRoute updates the route to origin with a rumor of sequence number seq received
+// from sender, hops away from origin. A newer sequence number always wins. For the same
+// sequence number the route goes through the neighbor with the lowest measured round
+// trip time : the first copy received came through the fastest path at that time, so the
+// route only switches to a neighbor clearly faster than the current next hop. The hop
+// count is not signed, as the relays increment it, so it is only informative and never
+// used to choose a route. Invalid routes are always replaced.
+// Returns true if the route changed.
+func (rt *Routing) UpdateRoute(origin string, seq uint32, hops uint32, sender string) bool {
 	rt.lock.Lock()
 	defer rt.lock.Unlock()
-	origin := msg.Origin
-	// print("update route for " + origin + " : " + sender)
-	rt.routes[origin] = sender
+	now := rt.clock.Now()
+	r, found := rt.routes[origin]
+	switch {
+	case !found || !rt.isValid(r) || seq > r.Seq:
+		changed := !found || r.NextHop != sender
+		rt.routes[origin] = &Route{NextHop: sender, Seq: seq, Hops: hops, Updated: now}
+		return changed
+	case seq == r.Seq && r.NextHop == sender:
+		// same route advertised again : refresh it
+		r.Updated = now
+	case seq == r.Seq && rt.faster(sender, r.NextHop):
+		rt.routes[origin] = &Route{NextHop: sender, Seq: seq, Hops: hops, Updated: now}
+		return true
+	}
+	return false
+}
+
+// faster checks if the round trip time to the neighbor at addr is known and lower than
+// constant.RouteSwitchRatio of the one to the neighbor at current. Caller must hold the
+// lock.
+func (rt *Routing) faster(addr string, current string) bool {
+	rtt, currentRTT := rt.latency(addr), rt.latency(current)
+	return rtt > 0 && currentRTT > 0 && float64(rtt) < constant.RouteSwitchRatio*float64(currentRTT)
+}
+
+// NeighborSeen records that a packet was just received from the neighbor at addr.
+func (rt *Routing) NeighborSeen(addr string) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.neighbors[addr] = rt.clock.Now()
+}
+
+// InvalidateNeighbor removes all the routes going through the neighbor at addr.
+func (rt *Routing) InvalidateNeighbor(addr string) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	delete(rt.neighbors, addr)
+	for origin, r := range rt.routes {
+		if r.NextHop == addr {
+			delete(rt.routes, origin)
+		}
+	}
+}
+
+// isValid checks that the route did not expire and that its next hop is still alive.
+// Caller must hold the lock.
+func (rt *Routing) isValid(r *Route) bool {
+	now := rt.clock.Now()
+	if rt.routeTimeout > 0 && now.Sub(r.Updated) > rt.routeTimeout {
+		return false
+	}
+	lastSeen, found := rt.neighbors[r.NextHop]
+	return rt.neighborTimeout <= 0 || !found || now.Sub(lastSeen) <= rt.neighborTimeout
 }
 
 func (rt *Routing) String() string {
@@ -70,8 +179,11 @@ func (rt *Routing) String() string {
 	defer rt.lock.RUnlock()
 	str := "Routing table :"
 	for origin, route := range rt.routes {
+		if !rt.isValid(route) {
+			continue
+		}
 		str += "\n"
-		str += origin + " : " + route
+		str += fmt.Sprintf("%s : %s (%d hops)", origin, route.NextHop, route.Hops)
 	}
 	return str
 }
@@ -82,7 +194,22 @@ func (rt *Routing) GetAllRoutes() map[string]string {
 	defer rt.lock.RUnlock()
 	allRoutes := make(map[string]string)
 	for origin, route := range rt.routes {
-		allRoutes[origin] = route
+		if rt.isValid(route) {
+			allRoutes[origin] = route.NextHop
+		}
+	}
+	return allRoutes
+}
+
+// GetAllRouteEntries returns a copy of all the valid routes
+func (rt *Routing) GetAllRouteEntries() map[string]Route {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+	allRoutes := make(map[string]Route)
+	for origin, route := range rt.routes {
+		if rt.isValid(route) {
+			allRoutes[origin] = *route
+		}
 	}
 	return allRoutes
 }
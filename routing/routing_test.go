@@ -0,0 +1,60 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vquelque/Peerster/clock"
+)
+
+func TestUpdateRoute(t *testing.T) {
+	rtts := map[string]time.Duration{"fast": 10 * time.Millisecond, "slow": 100 * time.Millisecond, "close": 90 * time.Millisecond}
+	tests := []struct {
+		name    string
+		seq     uint32
+		sender  string
+		changed bool
+		nextHop string
+	}{
+		{"first route", 2, "slow", true, "slow"},
+		{"same route", 2, "slow", false, "slow"},
+		{"older rumor", 1, "fast", false, "slow"},
+		{"not clearly faster", 2, "close", false, "slow"},
+		{"faster for the same rumor", 2, "fast", true, "fast"},
+		{"slower for the same rumor", 2, "slow", false, "fast"},
+		{"not measured", 2, "unknown", false, "fast"},
+		{"newer rumor", 3, "slow", true, "slow"},
+		{"newer rumor not measured", 4, "unknown", true, "unknown"},
+		{"faster than not measured", 4, "fast", false, "unknown"},
+	}
+	rt := NewRoutingTable(nil)
+	rt.SetLatency(func(addr string) time.Duration { return rtts[addr] })
+	for _, tt := range tests {
+		if changed := rt.UpdateRoute("origin", tt.seq, 3, tt.sender); changed != tt.changed {
+			t.Fatalf("%s : changed %v", tt.name, changed)
+		}
+		if nextHop := rt.GetRoute("origin"); nextHop != tt.nextHop {
+			t.Fatalf("%s : next hop %s, want %s", tt.name, nextHop, tt.nextHop)
+		}
+	}
+}
+
+func TestRouteExpiry(t *testing.T) {
+	clk := clock.NewManual(time.Unix(0, 0))
+	rt := NewRoutingTable(clk)
+	rt.UpdateRoute("origin", 1, 1, "a")
+	rt.InvalidateNeighbor("a")
+	if rt.Contains("origin") || rt.GetRoute("origin") != "" {
+		t.Fatal("route kept through an invalidated neighbor")
+	}
+	// an invalid route is replaced even by an older rumor
+	rt.UpdateRoute("origin", 5, 1, "b")
+	rt.SetTimeouts(time.Minute, 0)
+	clk.Advance(2 * time.Minute)
+	if rt.GetRoute("origin") != "" {
+		t.Fatal("expired route served")
+	}
+	if rt.UpdateRoute("origin", 1, 1, "c"); rt.GetRoute("origin") != "c" {
+		t.Fatalf("expired route not replaced : %s", rt.GetRoute("origin"))
+	}
+}
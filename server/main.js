@@ -8,7 +8,10 @@ $(document).ready(function() {
     $.getJSON("/peers", function(data) {
       var items = [];
       $.each(data, function(key, val) {
-        items.push("<li id='" + key + "' class='peerItem'>" + val + "</li>");
+        items.push(
+          "<li id='" + key + "' class='peerItem'>" + val.Address +
+            " (" + val.State + ")</li>"
+        );
       });
       $(".peerList").html(items.join(""));
     });
@@ -14,7 +14,8 @@ $(document).ready(function() {
           val.Origin +
           "<br>" +
           "<strong> MESSAGE : </strong>" +
-          val.Text;
+          val.Text +
+          (val.Status ? " <em>(" + val.Status + ")</em>" : "");
         items.push(
           "<li id='" + key + "' class='msgItem'>" + text(str) + "</li>"
         );
@@ -7,24 +7,29 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/vquelque/Peerster/gossiper"
+	"github.com/vquelque/Peerster/logger"
 	"github.com/vquelque/Peerster/message"
 	"github.com/vquelque/Peerster/utils"
 )
 
+var serverLog = logger.New("server")
+
 func peersListHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
-			peerList := gsp.Peers.GetAllPeers()
+			peerList := gsp.Peers.GetAllPeersInfo()
 			peerListJSON, err := json.Marshal(peerList)
 			if err != nil {
-				log.Print("Error sending peers list as JSON")
+				serverLog.Errorf("Error sending peers list as JSON")
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
@@ -75,7 +80,7 @@ func msgHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
 			}
 			messageText := r.FormValue("message")
 			cliMsg := &message.Message{Text: messageText}
-			go gsp.ProcessClientMessage(cliMsg)
+			gsp.ProcessClientMessageAsync(cliMsg)
 		default:
 			fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
 		}
@@ -171,7 +176,7 @@ func privateMsgHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
 			peer := r.FormValue("peer")
 			messageText := r.FormValue("message")
 			cliMsg := &message.Message{Text: messageText, Destination: peer}
-			go gsp.ProcessClientMessage(cliMsg)
+			gsp.ProcessClientMessageAsync(cliMsg)
 			http.Redirect(w, r, r.Header.Get("/privateMsg?peer="+peer), 302)
 		default:
 			fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
@@ -183,21 +188,21 @@ func fileUploadHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "POST":
-			filename, err := fileUploadHelper(r)
+			filename, err := fileUploadHelper(r, gsp.Config().Files.SharedDir)
 			if err != nil {
 				http.Error(w, "Invalid Data", http.StatusBadRequest)
 				return
 				//checking whether any error occurred retrieving image
 			}
 			cliMsg := &message.Message{File: filename}
-			go gsp.ProcessClientMessage(cliMsg)
+			gsp.ProcessClientMessageAsync(cliMsg)
 			http.Redirect(w, r, r.Header.Get("/"), 302)
 		}
 	})
 }
 
 //this function returns the filename of the saved file or an error if it occurs
-func fileUploadHelper(r *http.Request) (string, error) {
+func fileUploadHelper(r *http.Request, dir string) (string, error) {
 	r.ParseMultipartForm(5 << 20)              //limit file size to 5 MB
 	file, handler, err := r.FormFile("myFile") //retrieve the file from form data
 	if err != nil {
@@ -205,7 +210,7 @@ func fileUploadHelper(r *http.Request) (string, error) {
 	}
 	defer file.Close() //close the file when we finish
 	//this is path which  we want to store the file
-	f, err := os.OpenFile("_SharedFiles/"+handler.Filename, os.O_WRONLY|os.O_CREATE, 0666)
+	f, err := os.OpenFile(filepath.Join(dir, handler.Filename), os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return "", err
 	}
@@ -228,12 +233,12 @@ func fileDownloadHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
 			filename := r.FormValue("filename")
 			metahash, err := hex.DecodeString(strMetahash)
 			if err != nil || len(metahash) != sha256.Size {
-				log.Print("Unable to parse hash")
+				serverLog.Warnf("Unable to parse hash")
 				http.Redirect(w, r, r.Header.Get("/"), 302)
 				return
 			}
 			cliMsg := &message.Message{File: filename, Destination: peer, Request: metahash}
-			go gsp.ProcessClientMessage(cliMsg)
+			gsp.ProcessClientMessageAsync(cliMsg)
 		}
 	})
 }
@@ -253,7 +258,7 @@ func fileSearchHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
 			}
 			keywords := strings.Split(keywordStr, ",")
 			cliMsg := &message.Message{Keywords: keywords, Budget: budget}
-			go gsp.ProcessClientMessage(cliMsg)
+			gsp.ProcessClientMessageAsync(cliMsg)
 			http.Redirect(w, r, r.Header.Get("/"), 302)
 		}
 	})
@@ -268,7 +273,7 @@ func searchResultsHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
 			filesJSON, err := json.Marshal(dFiles)
 			gsp.UIStorage.DownloadableFiles.Lock.RUnlock()
 			if err != nil {
-				fmt.Printf("ERROR PARSING FILE MAP")
+				serverLog.Errorf("ERROR PARSING FILE MAP : %v", err)
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
@@ -278,6 +283,158 @@ func searchResultsHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
 	})
 }
 
+func downloadProgressHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			gsp.UIStorage.DownloadsUIStorage.Lock.RLock()
+			progressJSON, err := json.Marshal(gsp.UIStorage.DownloadsUIStorage.Progress)
+			gsp.UIStorage.DownloadsUIStorage.Lock.RUnlock()
+			if err != nil {
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(progressJSON)
+		}
+	})
+}
+
+func metricsHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			w.WriteHeader(http.StatusOK)
+			gsp.Metrics.Registry.WriteText(w)
+		default:
+			fmt.Fprintf(w, "Sorry, only GET method is supported.")
+		}
+	})
+}
+
+// logLevelHandler returns the log level of every component. The level of a component,
+// or the default one if the component is empty, can be changed with a POST from a local
+// client, see localOnly.
+func logLevelHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			levelsJSON, err := json.Marshal(logger.GetLevels())
+			if err != nil {
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(levelsJSON)
+		case "POST":
+			if !isLocal(w, r) {
+				return
+			}
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid Data", http.StatusBadRequest)
+				return
+			}
+			level, err := logger.ParseLevel(r.FormValue("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.SetLevel(r.FormValue("component"), level)
+			serverLog.Infof("log level of %q set to %s", r.FormValue("component"), level)
+			w.WriteHeader(http.StatusOK)
+		default:
+			fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
+		}
+	})
+}
+
+// configHandler returns the current configuration of the gossiper. A POST reloads the
+// configuration and returns the settings applied and the ones requiring a restart.
+// It is only served to local clients, see localOnly.
+func configHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		switch r.Method {
+		case "GET":
+			data = gsp.Config()
+		case "POST":
+			report, err := gsp.ReloadConfig()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data = report
+		default:
+			fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
+			return
+		}
+		dataJSON, err := json.Marshal(data)
+		if err != nil {
+			serverLog.Errorf("%v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(dataJSON)
+	})
+}
+
+// localOnly serves the requests of h coming from the loopback interface and refuses the
+// other ones : the UI server listens on all the interfaces.
+func localOnly(h http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLocal(w, r) {
+			return
+		}
+		h(w, r)
+	})
+}
+
+// isLocal checks if the request comes from the loopback interface, and refuses it otherwise.
+func isLocal(w http.ResponseWriter, r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		serverLog.Warnf("Refused %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "only available from localhost", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// bannedPeersHandler returns the peers banned for exceeding the limits. A POST from
+// localhost lifts the ban of the peer given in the form.
+func bannedPeersHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			bannedJSON, err := json.Marshal(gsp.Peers.GetBanned())
+			if err != nil {
+				serverLog.Errorf("%v", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(bannedJSON)
+		case "POST":
+			if !isLocal(w, r) {
+				return
+			}
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid Data", http.StatusBadRequest)
+				return
+			}
+			if !gsp.Peers.Unban(r.FormValue("peer")) {
+				http.Error(w, "peer not banned", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
+		}
+	})
+}
+
 func confirmedRumorsHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -295,7 +452,7 @@ func confirmedRumorsHandler(gsp *gossiper.Gossiper) http.HandlerFunc {
 	})
 }
 
-// StartUIServer starts the UI server
+// StartUIServer starts the UI server. It is shut down when the gossiper stops.
 func StartUIServer(UIPort int, gsp *gossiper.Gossiper) *http.Server {
 
 	UIPortStr := ":" + strconv.Itoa(UIPort)
@@ -310,16 +467,22 @@ func StartUIServer(UIPort int, gsp *gossiper.Gossiper) *http.Server {
 	mux.HandleFunc("/downloadFile", fileDownloadHandler(gsp))
 	mux.HandleFunc("/searchFile", fileSearchHandler(gsp))
 	mux.HandleFunc("/searchResults", searchResultsHandler(gsp))
+	mux.HandleFunc("/downloadProgress", downloadProgressHandler(gsp))
+	mux.HandleFunc("/metrics", metricsHandler(gsp))
+	mux.HandleFunc("/logLevel", logLevelHandler())
+	mux.HandleFunc("/admin/config", localOnly(configHandler(gsp)))
+	mux.HandleFunc("/bannedPeers", bannedPeersHandler(gsp))
 	mux.HandleFunc("/confirmedRumors", confirmedRumorsHandler(gsp))
 	mux.HandleFunc("/roundNumber", roundNumberHandler(gsp))
 	mux.HandleFunc("/proofsForRound", proofForRoundHandler(gsp))
 	server := &http.Server{Addr: UIPortStr, Handler: mux}
+	serverLog.Infof("UI server started at address 127.0.0.1%s", UIPortStr)
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 			return
 		}
-		fmt.Printf("UI server started at address 127.0.0.1:%s", UIPortStr)
 	}()
+	gsp.OnShutdown(server.Shutdown)
 	return server
 }
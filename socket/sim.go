@@ -0,0 +1,224 @@
+package socket
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/vquelque/Peerster/clock"
+)
+
+// simInboxSize is the number of undelivered packets a simulated socket buffers
+// before dropping new ones, like a full UDP receive buffer would.
+const simInboxSize = 1024
+
+// LinkConfig describes the behaviour of a directed link of the simulated network.
+type LinkConfig struct {
+	Latency   time.Duration // base one-way delay
+	Jitter    time.Duration // random delay added on top of the latency, in [0, Jitter)
+	Loss      float64       // probability that a packet is dropped
+	Duplicate float64       // probability that a packet is delivered twice
+	Reorder   float64       // probability that a packet is held back so later packets overtake it
+}
+
+type link struct {
+	from string
+	to   string
+}
+
+// SimNetwork is an in-memory network connecting SimSockets. All random decisions
+// (loss, duplication, jitter, reordering) are drawn from a seeded source.
+type SimNetwork struct {
+	sockets     map[string]*SimSocket
+	defaultLink LinkConfig
+	links       map[link]LinkConfig
+	partition   map[string]int //address -> partition group. Nodes in different groups can't talk.
+	rand        *rand.Rand
+	clock       clock.Clock
+	lock        sync.RWMutex
+}
+
+// SimSocket implements the socket interface on top of a SimNetwork.
+type SimSocket struct {
+	address string
+	network *SimNetwork
+	inbox   chan simPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+type simPacket struct {
+	data   []byte
+	sender string
+}
+
+// NewSimNetwork creates a new simulated network. A nil clock uses the real time.
+func NewSimNetwork(seed int64, clk clock.Clock) *SimNetwork {
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	return &SimNetwork{
+		sockets:   make(map[string]*SimSocket),
+		links:     make(map[link]LinkConfig),
+		partition: make(map[string]int),
+		rand:      rand.New(rand.NewSource(seed)),
+		clock:     clk,
+		lock:      sync.RWMutex{},
+	}
+}
+
+// NewSocket attaches a new socket with the given address to the network.
+func (n *SimNetwork) NewSocket(addr string) *SimSocket {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	s := &SimSocket{
+		address: addr,
+		network: n,
+		inbox:   make(chan simPacket, simInboxSize),
+		closed:  make(chan struct{}),
+	}
+	n.sockets[addr] = s
+	return s
+}
+
+// SetDefaultLink sets the configuration used by links without a specific configuration.
+func (n *SimNetwork) SetDefaultLink(cfg LinkConfig) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.defaultLink = cfg
+}
+
+// SetLink sets the configuration of the directed link from -> to.
+func (n *SimNetwork) SetLink(from string, to string, cfg LinkConfig) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.links[link{from, to}] = cfg
+}
+
+// Partition splits the network in the given groups. Each address not listed is
+// isolated in its own group until Heal is called.
+func (n *SimNetwork) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.partition[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *SimNetwork) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partition = make(map[string]int)
+}
+
+// Clock returns the clock used by the network.
+func (n *SimNetwork) Clock() clock.Clock {
+	return n.clock
+}
+
+// connected returns whether from and to are in the same group of the partition.
+// The caller must hold the lock.
+func (n *SimNetwork) connected(from string, to string) bool {
+	if len(n.partition) == 0 {
+		return true
+	}
+	fromGroup, listedFrom := n.partition[from]
+	toGroup, listedTo := n.partition[to]
+	return listedFrom && listedTo && fromGroup == toGroup
+}
+
+// send schedules the delivery of data from -> to according to the link configuration.
+func (n *SimNetwork) send(data []byte, from string, to string) {
+	n.lock.Lock()
+	dest, found := n.sockets[to]
+	if !found || !n.connected(from, to) {
+		n.lock.Unlock()
+		return
+	}
+	cfg, found := n.links[link{from, to}]
+	if !found {
+		cfg = n.defaultLink
+	}
+	if n.rand.Float64() < cfg.Loss {
+		n.lock.Unlock()
+		return
+	}
+	copies := 1
+	if n.rand.Float64() < cfg.Duplicate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = cfg.Latency
+		if cfg.Jitter > 0 {
+			delays[i] += time.Duration(n.rand.Int63n(int64(cfg.Jitter)))
+		}
+		if n.rand.Float64() < cfg.Reorder {
+			// hold the packet back long enough for the next ones to overtake it
+			delays[i] += cfg.Latency + cfg.Jitter + time.Millisecond
+		}
+	}
+	n.lock.Unlock()
+
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	for _, d := range delays {
+		pkt := simPacket{data: buf, sender: from}
+		n.clock.AfterFunc(d, func() { dest.deliver(pkt) })
+	}
+}
+
+func (socket *SimSocket) deliver(pkt simPacket) {
+	select {
+	case <-socket.closed:
+		return
+	default:
+	}
+	select {
+	case socket.inbox <- pkt:
+	default:
+		// inbox full : drop like a UDP socket would
+	}
+}
+
+// Address returns the address of the socket on the simulated network
+func (socket *SimSocket) Address() string {
+	return socket.address
+}
+
+// Send data to the given address of the simulated network
+func (socket *SimSocket) Send(data []byte, addr string) {
+	select {
+	case <-socket.closed:
+		return
+	default:
+	}
+	socket.network.send(data, socket.address, addr)
+}
+
+// Receive blocks until a packet is delivered to the socket. Returns empty data
+// once the socket is closed.
+func (socket *SimSocket) Receive() ([]byte, string) {
+	select {
+	case pkt := <-socket.inbox:
+		return pkt.data, pkt.sender
+	case <-socket.closed:
+		return nil, ""
+	}
+}
+
+// Close detaches the socket from the network
+func (socket *SimSocket) Close() {
+	socket.once.Do(func() {
+		close(socket.closed)
+		socket.network.lock.Lock()
+		defer socket.network.lock.Unlock()
+		if socket.network.sockets[socket.address] == socket {
+			delete(socket.network.sockets, socket.address)
+		}
+	})
+}
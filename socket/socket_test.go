@@ -0,0 +1,41 @@
+package socket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCloseUnblocksReceive(t *testing.T) {
+	tests := []struct {
+		name   string
+		socket func() Socket
+	}{
+		{"udp", func() Socket { return NewUDPSocket("127.0.0.1:0") }},
+		{"tcp", func() Socket { return NewTCPSocket("127.0.0.1:0") }},
+		{"sim", func() Socket { return NewSimNetwork(1, nil).NewSocket("10.0.0.1:5000") }},
+	}
+	for _, tt := range tests {
+		s := tt.socket()
+		done := make(chan string, 1)
+		go func() {
+			_, sender := s.Receive()
+			done <- sender
+		}()
+		time.Sleep(50 * time.Millisecond)
+		s.Close()
+		select {
+		case sender := <-done:
+			if sender != "" {
+				t.Fatalf("%s : received from %s once closed", tt.name, sender)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s : Receive still blocked after Close", tt.name)
+		}
+		// closing again and sending are harmless once closed
+		s.Close()
+		s.Send([]byte("late"), "127.0.0.1:1")
+		if _, sender := s.Receive(); sender != "" {
+			t.Fatalf("%s : received from %s once closed", tt.name, sender)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package socket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxFrameSize is the maximum size of a packet sent over a TCP connection. The largest
+// packets of the protocol are the data replies, which carry a chunk of at most 32KB,
+// and the search replies : larger frames are refused before being allocated.
+const MaxFrameSize = 256 << 10
+
+// tcpMaxHelloSize is the maximum size of the first frame of a connection.
+const tcpMaxHelloSize = 256
+
+// tcpHello prefixes the first frame of every connection, followed by the listening
+// address of the dialer. Peers answering anything else are reached over UDP. The
+// address is not trusted : the sender of the frames is the IP address of the
+// connection with the port announced in the hello.
+const tcpHello = "PEERSTER/1 "
+
+const tcpDialTimeout = time.Second
+const tcpHelloTimeout = 5 * time.Second
+const tcpWriteTimeout = 5 * time.Second
+
+// tcpInboxSize is the number of received packets buffered before the readers block.
+const tcpInboxSize = 1024
+
+// tcpMaxInbound is the number of inbound connections served at once. The connections
+// accepted over it are closed at once, each one costing a reading goroutine.
+const tcpMaxInbound = 256
+
+// tcpRetryDelay is the time after which a peer which refused a TCP connection is
+// tried again over TCP.
+const tcpRetryDelay = time.Minute
+
+type received struct {
+	data   []byte
+	sender string
+}
+
+type tcpConn struct {
+	conn   net.Conn
+	writer *bufio.Writer
+	lock   sync.Mutex //serializes the writes
+}
+
+// TCPSocket implements the socket interface over TCP connections with length-prefixed
+// frames, so that packets are not limited by the size of a datagram. Connections are
+// kept open and reused for all the packets exchanged with a peer. It also listens for
+// UDP packets on the same port, and falls back to UDP for peers not accepting TCP
+// connections, so that TCP and UDP gossipers interoperate.
+type TCPSocket struct {
+	address  string
+	listener net.Listener
+	udp      *UDPSocket
+	conns    map[string]*tcpConn  //peer address -> pooled outbound connection
+	dialing  map[string]bool      //peer addresses being dialed
+	open     map[net.Conn]bool    //all the connections, pooled or not
+	udpOnly  map[string]time.Time //peer address -> time the TCP connection failed
+	inbound  int                  //inbound connections served, at most tcpMaxInbound
+	admit    func(remote string) bool
+	inbox    chan *received
+	closed   chan struct{}
+	loops    sync.WaitGroup //reading goroutines, waited for on Close
+	lock     sync.Mutex
+}
+
+// NewTCPSocket creates a new TCP socket listening on addr for both TCP and UDP.
+func NewTCPSocket(addr string) *TCPSocket {
+	listener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &TCPSocket{
+		address:  listener.Addr().String(),
+		listener: listener,
+		udp:      NewUDPSocket(listener.Addr().String()),
+		conns:    make(map[string]*tcpConn),
+		dialing:  make(map[string]bool),
+		open:     make(map[net.Conn]bool),
+		udpOnly:  make(map[string]time.Time),
+		inbox:    make(chan *received, tcpInboxSize),
+		closed:   make(chan struct{}),
+	}
+	s.loops.Add(2)
+	go s.acceptLoop()
+	go s.udpLoop()
+	return s
+}
+
+// Address returns the formated string address of the socket
+func (s *TCPSocket) Address() string {
+	return s.address
+}
+
+// Send data to the given address, over TCP if the peer accepts it and over UDP otherwise.
+// Send never waits for a connection : while the peer is dialed in the background, the
+// packets are sent over UDP.
+func (s *TCPSocket) Send(data []byte, addr string) {
+	if len(data) > MaxFrameSize {
+		netLog.Warnf("packet of %d bytes too large for %s", len(data), addr)
+		return
+	}
+	if !s.isUDPOnly(addr) {
+		if c := s.getConn(addr); c != nil {
+			if err := c.writeFrame(data); err == nil {
+				return
+			}
+			// broken connection : dial again for the next packets
+			s.removeConn(addr, c)
+			s.getConn(addr)
+		}
+	}
+	if len(data) > MaxBufferSize {
+		netLog.Warnf("packet of %d bytes too large for UDP peer %s", len(data), addr)
+		return
+	}
+	s.udp.Send(data, addr)
+}
+
+// SetAdmit sets the check of the address of the inbound connections before they are
+// served. The connections refused are closed.
+func (s *TCPSocket) SetAdmit(admit func(remote string) bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.admit = admit
+}
+
+// Receive data from the given socket. Returns an empty sender once the socket is closed.
+func (s *TCPSocket) Receive() ([]byte, string) {
+	select {
+	case r := <-s.inbox:
+		return r.data, r.sender
+	case <-s.closed:
+		return nil, ""
+	}
+}
+
+// Close the listener and all the connections, and waits for the reading goroutines to exit.
+func (s *TCPSocket) Close() {
+	s.lock.Lock()
+	select {
+	case <-s.closed:
+		s.lock.Unlock()
+		return
+	default:
+	}
+	close(s.closed)
+	s.listener.Close()
+	s.udp.Close()
+	for conn := range s.open {
+		conn.Close()
+	}
+	s.open = make(map[net.Conn]bool)
+	s.conns = make(map[string]*tcpConn)
+	s.lock.Unlock()
+	s.loops.Wait()
+}
+
+// track registers a new connection and its reading goroutine. Returns false, after
+// closing conn, if the socket is closed.
+// caller must hold the lock
+func (s *TCPSocket) track(conn net.Conn) bool {
+	select {
+	case <-s.closed:
+		conn.Close()
+		return false
+	default:
+	}
+	s.open[conn] = true
+	s.loops.Add(1)
+	return true
+}
+
+func (s *TCPSocket) isUDPOnly(addr string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	failedAt, found := s.udpOnly[addr]
+	if found && time.Since(failedAt) > tcpRetryDelay {
+		delete(s.udpOnly, addr)
+		return false
+	}
+	return found
+}
+
+// getConn returns the pooled connection to addr. If there is none, it starts dialing
+// addr in the background and returns nil.
+func (s *TCPSocket) getConn(addr string) *tcpConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c, found := s.conns[addr]; found {
+		return c
+	}
+	if s.dialing[addr] {
+		return nil
+	}
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	s.dialing[addr] = true
+	s.loops.Add(1)
+	go s.dial(addr)
+	return nil
+}
+
+// dial connects to addr and pools the connection, or marks addr as UDP only if the
+// peer does not accept TCP connections.
+func (s *TCPSocket) dial(addr string) {
+	defer s.loops.Done()
+	conn, err := net.DialTimeout("tcp4", addr, tcpDialTimeout)
+	s.lock.Lock()
+	delete(s.dialing, addr)
+	if err != nil {
+		s.udpOnly[addr] = time.Now()
+		s.lock.Unlock()
+		return
+	}
+	if !s.track(conn) {
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
+	c := newTCPConn(conn)
+	if err := c.writeFrame([]byte(tcpHello + s.address)); err != nil {
+		s.removeConn(addr, c)
+		s.loops.Done() //registered by track for readLoop
+		return
+	}
+	s.lock.Lock()
+	s.conns[addr] = c
+	s.lock.Unlock()
+	s.readLoop(c, addr)
+}
+
+func (s *TCPSocket) removeConn(addr string, c *tcpConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conns[addr] == c {
+		delete(s.conns, addr)
+	}
+	delete(s.open, c.conn)
+	c.conn.Close()
+}
+
+func (s *TCPSocket) acceptLoop() {
+	defer s.loops.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			netLog.Errorf("%v", err)
+			continue
+		}
+		s.lock.Lock()
+		admit, full := s.admit, s.inbound >= tcpMaxInbound
+		s.lock.Unlock()
+		if full || (admit != nil && !admit(conn.RemoteAddr().String())) {
+			netLog.Debugf("refused connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		s.lock.Lock()
+		tracked := s.track(conn)
+		if tracked {
+			s.inbound++
+		}
+		s.lock.Unlock()
+		if !tracked {
+			return
+		}
+		go s.handshake(conn)
+	}
+}
+
+// handshake reads the address of the dialer and the packets it sends. Inbound
+// connections are never pooled : packets to the dialer go through our own outbound
+// connection.
+func (s *TCPSocket) handshake(conn net.Conn) {
+	defer s.loops.Done()
+	defer func() {
+		s.lock.Lock()
+		s.inbound--
+		s.lock.Unlock()
+	}()
+	c := newTCPConn(conn)
+	conn.SetReadDeadline(time.Now().Add(tcpHelloTimeout))
+	reader := bufio.NewReader(conn)
+	hello, err := readFrame(reader, tcpMaxHelloSize)
+	if err != nil || !strings.HasPrefix(string(hello), tcpHello) {
+		s.removeConn("", c)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	addr, err := senderAddress(strings.TrimPrefix(string(hello), tcpHello), conn.RemoteAddr())
+	if err != nil {
+		netLog.Warnf("refused connection from %s : %v", conn.RemoteAddr(), err)
+		s.removeConn("", c)
+		return
+	}
+	s.lock.Lock()
+	delete(s.udpOnly, addr)
+	s.lock.Unlock()
+	s.read(reader, c, "", addr)
+}
+
+// senderAddress returns the address of the dialer of a connection : the IP address of
+// the connection and the port announced in its hello. The announced IP address must be
+// the one of the connection, or unspecified if the dialer listens on all interfaces.
+func senderAddress(hello string, remote net.Addr) (string, error) {
+	host, port, err := net.SplitHostPort(hello)
+	if err != nil {
+		return "", err
+	}
+	remoteHost, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return "", err
+	}
+	ip, remoteIP := net.ParseIP(host), net.ParseIP(remoteHost)
+	if ip == nil || remoteIP == nil || (!ip.IsUnspecified() && !ip.Equal(remoteIP)) {
+		return "", fmt.Errorf("announced address %s does not match", hello)
+	}
+	return net.JoinHostPort(remoteIP.String(), port), nil
+}
+
+func (s *TCPSocket) readLoop(c *tcpConn, addr string) {
+	defer s.loops.Done()
+	s.read(bufio.NewReader(c.conn), c, addr, addr)
+}
+
+// read delivers the frames of c with the given sender. pooled is the address the
+// connection is pooled under, empty for inbound connections.
+func (s *TCPSocket) read(reader *bufio.Reader, c *tcpConn, pooled string, sender string) {
+	defer s.removeConn(pooled, c)
+	for {
+		data, err := readFrame(reader, MaxFrameSize)
+		if err != nil {
+			return
+		}
+		select {
+		case s.inbox <- &received{data: data, sender: sender}:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *TCPSocket) udpLoop() {
+	defer s.loops.Done()
+	for {
+		data, sender := s.udp.Receive()
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+		if len(data) == 0 {
+			continue
+		}
+		select {
+		case s.inbox <- &received{data: data, sender: sender}:
+		default:
+			// inbox full : drop the datagram
+		}
+	}
+}
+
+func newTCPConn(conn net.Conn) *tcpConn {
+	return &tcpConn{conn: conn, writer: bufio.NewWriter(conn)}
+}
+
+// writeFrame writes the length of data as a 4 bytes big endian integer followed by data.
+func (c *tcpConn) writeFrame(data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := c.writer.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(data); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// readFrame reads a frame written by writeFrame, refusing frames larger than max.
+func readFrame(reader *bufio.Reader, max uint32) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > max {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the maximum size", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,145 @@
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func frame(size uint32, data []byte) []byte {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], size)
+	return append(header[:], data...)
+}
+
+func receiveTimeout(t *testing.T, s Socket) ([]byte, string) {
+	type result struct {
+		data   []byte
+		sender string
+	}
+	ch := make(chan result, 1)
+	go func() {
+		data, sender := s.Receive()
+		ch <- result{data, sender}
+	}()
+	select {
+	case r := <-ch:
+		return r.data, r.sender
+	case <-time.After(3 * time.Second):
+		t.Fatal("nothing received")
+	}
+	return nil, ""
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		max   uint32
+		want  []byte
+		ok    bool
+	}{
+		{"empty frame", frame(0, nil), 16, []byte{}, true},
+		{"frame", frame(5, []byte("hello")), 16, []byte("hello"), true},
+		{"max size", frame(16, make([]byte, 16)), 16, make([]byte, 16), true},
+		{"oversized", frame(17, make([]byte, 17)), 16, nil, false},
+		{"oversized header only", frame(1<<31, nil), MaxFrameSize, nil, false},
+		{"truncated header", []byte{0, 0}, 16, nil, false},
+		{"truncated data", frame(5, []byte("hel")), 16, nil, false},
+		{"no frame", nil, 16, nil, false},
+	}
+	for _, tt := range tests {
+		data, err := readFrame(bufio.NewReader(bytes.NewReader(tt.input)), tt.max)
+		if (err == nil) != tt.ok || !bytes.Equal(data, tt.want) {
+			t.Fatalf("%s : %d bytes, %v", tt.name, len(data), err)
+		}
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newTCPConn(client)
+	frames := [][]byte{{}, []byte("hello"), bytes.Repeat([]byte("x"), MaxFrameSize)}
+	go func() {
+		for _, data := range frames {
+			c.writeFrame(data)
+		}
+		client.Close()
+	}()
+	reader := bufio.NewReader(server)
+	for i, want := range frames {
+		data, err := readFrame(reader, MaxFrameSize)
+		if err != nil || !bytes.Equal(data, want) {
+			t.Fatalf("frame %d : %d bytes, %v", i, len(data), err)
+		}
+	}
+	if _, err := readFrame(reader, MaxFrameSize); err == nil {
+		t.Fatal("frame read after the connection was closed")
+	}
+}
+
+func TestSenderAddress(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	tests := []struct {
+		hello string
+		want  string //empty if refused
+	}{
+		{"10.0.0.1:5000", "10.0.0.1:5000"},
+		{"0.0.0.0:5000", "10.0.0.1:5000"},
+		{"10.0.0.2:5000", ""},
+		{"127.0.0.1:5000", ""},
+		{"localhost:5000", ""},
+		{"10.0.0.1", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		addr, err := senderAddress(tt.hello, remote)
+		if addr != tt.want || (err == nil) != (tt.want != "") {
+			t.Fatalf("hello %q : %s, %v", tt.hello, addr, err)
+		}
+	}
+}
+
+func TestTCPSocketRefusesBadConnections(t *testing.T) {
+	a, b := NewTCPSocket("127.0.0.1:0"), NewTCPSocket("127.0.0.1:0")
+	defer a.Close()
+	defer b.Close()
+	big := bytes.Repeat([]byte("x"), MaxBufferSize+1)
+	a.Send(big, b.Address())
+	time.Sleep(200 * time.Millisecond) //the first packets go over UDP while dialing
+	a.Send(big, b.Address())
+	if data, sender := receiveTimeout(t, b); !bytes.Equal(data, big) || sender != a.Address() {
+		t.Fatalf("received %d bytes from %s", len(data), sender)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"spoofed hello", frame(uint32(len(tcpHello)+14), []byte(tcpHello+"10.1.2.3:27001"))},
+		{"oversized hello", frame(tcpMaxHelloSize+1, bytes.Repeat([]byte("y"), tcpMaxHelloSize+1))},
+		{"no hello prefix", frame(14, []byte("127.0.0.1:5000"))},
+		{"oversized frame", append(frame(uint32(len(tcpHello)+9), []byte(tcpHello+"0.0.0.0:1")), frame(MaxFrameSize+1, nil)...)},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp4", b.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(tt.input)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+			t.Fatalf("%s : connection not closed, %v", tt.name, err)
+		}
+		conn.Close()
+	}
+	b.Close()
+	if _, sender := b.Receive(); sender != "" {
+		t.Fatal("received once closed")
+	}
+}
@@ -1,14 +1,18 @@
 package socket
 
 import (
+	"errors"
 	"log"
 	"net"
 
+	"github.com/vquelque/Peerster/logger"
 	"github.com/vquelque/Peerster/utils"
 )
 
 const MaxBufferSize = 65535
 
+var netLog = logger.New("net")
+
 // Socket is a generic interface representing a socket
 type Socket interface {
 	Address() string
@@ -43,18 +47,21 @@ func (socket *UDPSocket) Send(data []byte, addr string) {
 	udpAddr := utils.ToUDPAddr(addr)
 	if udpAddr != nil {
 		_, err := socket.connection.WriteTo(data, udpAddr)
-		if err != nil {
-			log.Print(err)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			netLog.Errorf("%v", err)
 		}
 	}
 }
 
-//Receive data from the given socket
+//Receive data from the given socket. Returns an empty sender once the socket is closed.
 func (socket *UDPSocket) Receive() ([]byte, string) {
 	buf := make([]byte, MaxBufferSize)
 	bytesRead, source, err := socket.connection.ReadFromUDP(buf)
+	if errors.Is(err, net.ErrClosed) {
+		return nil, ""
+	}
 	if err != nil {
-		log.Print(err)
+		netLog.Errorf("%v", err)
 	}
 	return buf[:bytesRead], source.String()
 }
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+)
+
+// Chunker cuts a file into chunks of a fixed size, or at boundaries defined by its content
+// so that an edit of the file only changes the chunks around it. The content defined
+// boundaries are found with the gear rolling hash of FastCDC, with normalized chunking :
+// a chunk is at least min bytes long, preferably cut after avg bytes and at most max.
+type Chunker struct {
+	r     *bufio.Reader
+	min   int
+	avg   int
+	max   int
+	cdc   bool
+	maskS uint64 //harder to match, before avg bytes
+	maskL uint64 //easier to match, after avg bytes
+}
+
+// gear maps each byte to a random value. It is fixed so that every gossiper cuts the same
+// content at the same boundaries.
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	seed := uint64(0x5045455253544552)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// NewFixedChunker cuts r into chunks of size bytes, the last one being shorter.
+func NewFixedChunker(r io.Reader, size int) *Chunker {
+	return &Chunker{r: bufio.NewReaderSize(r, size), min: size, avg: size, max: size}
+}
+
+// NewCDCChunker cuts r at content defined boundaries into chunks of min to max bytes, of
+// avg bytes on average.
+func NewCDCChunker(r io.Reader, min int, avg int, max int) *Chunker {
+	n := bits.Len(uint(avg)) - 1 //log2 of avg
+	return &Chunker{
+		r:     bufio.NewReaderSize(r, max),
+		min:   min,
+		avg:   avg,
+		max:   max,
+		cdc:   true,
+		maskS: topBits(n + 1),
+		maskL: topBits(n - 1),
+	}
+}
+
+// Next returns the next chunk, or io.EOF once the whole file is cut.
+func (c *Chunker) Next() ([]byte, error) {
+	data, err := c.r.Peek(c.max)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	n := len(data)
+	if c.cdc {
+		n = c.cut(data)
+	}
+	chunk := make([]byte, n)
+	copy(chunk, data[:n])
+	if _, err := c.r.Discard(n); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+	var fp uint64 = 0
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// topBits returns a mask of the n most significant bits, which depend on the 64 last bytes
+// hashed.
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << uint(64-n)
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunksOf(t *testing.T, c *Chunker) [][]byte {
+	chunks := make([][]byte, 0)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestFixedChunker(t *testing.T) {
+	tests := []struct {
+		size   int
+		chunks int
+		last   int
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{8192, 1, 8192},
+		{8193, 2, 1},
+		{3*8192 + 5, 4, 5},
+	}
+	for _, tt := range tests {
+		data := randomData(1, tt.size)
+		chunks := chunksOf(t, NewFixedChunker(bytes.NewReader(data), 8192))
+		if len(chunks) != tt.chunks || !bytes.Equal(bytes.Join(chunks, nil), data) {
+			t.Fatalf("%d bytes : %d chunks", tt.size, len(chunks))
+		}
+		if tt.chunks > 0 && len(chunks[len(chunks)-1]) != tt.last {
+			t.Fatalf("%d bytes : last chunk of %d bytes", tt.size, len(chunks[len(chunks)-1]))
+		}
+	}
+}
+
+func TestCDCChunkerBoundaries(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		min, avg, max int
+	}{
+		{"empty", nil, 2048, 8192, 32768},
+		{"shorter than min", randomData(1, 1000), 2048, 8192, 32768},
+		{"min", randomData(2, 2048), 2048, 8192, 32768},
+		{"random", randomData(3, 1<<20), 2048, 8192, 32768},
+		{"small chunks", randomData(4, 1<<18), 64, 256, 1024},
+		{"min is avg", randomData(5, 1<<18), 4096, 4096, 16384},
+		{"constant", bytes.Repeat([]byte{7}, 100000), 2048, 8192, 32768},
+		{"zeros", make([]byte, 100000), 2048, 8192, 32768},
+	}
+	for _, tt := range tests {
+		chunks := chunksOf(t, NewCDCChunker(bytes.NewReader(tt.data), tt.min, tt.avg, tt.max))
+		if !bytes.Equal(bytes.Join(chunks, nil), tt.data) {
+			t.Fatalf("%s : chunks do not rebuild the data", tt.name)
+		}
+		for i, c := range chunks {
+			if len(c) > tt.max || len(c) == 0 || (len(c) < tt.min && i != len(chunks)-1) {
+				t.Fatalf("%s : chunk %d of %d bytes", tt.name, i, len(c))
+			}
+		}
+		// every gossiper cuts the same content at the same boundaries
+		again := chunksOf(t, NewCDCChunker(bytes.NewReader(tt.data), tt.min, tt.avg, tt.max))
+		if len(again) != len(chunks) {
+			t.Fatalf("%s : %d then %d chunks", tt.name, len(chunks), len(again))
+		}
+		if len(tt.data) >= 1<<18 {
+			if avg := len(tt.data) / len(chunks); avg < tt.avg/2 || avg > 2*tt.avg {
+				t.Fatalf("%s : chunks of %d bytes on average", tt.name, avg)
+			}
+		}
+	}
+}
+
+func TestCDCChunkerSharesChunksAfterEdit(t *testing.T) {
+	data := randomData(6, 1<<20)
+	tests := []struct {
+		name   string
+		edited []byte
+	}{
+		{"insert at the start", append([]byte("inserted"), data...)},
+		{"insert in the middle", append(append(append([]byte{}, data[:1<<19]...), "inserted"...), data[1<<19:]...)},
+		{"delete in the middle", append(append([]byte{}, data[:1<<19]...), data[1<<19+100:]...)},
+		{"append", append(append([]byte{}, data...), "appended"...)},
+	}
+	known := make(map[[32]byte]bool)
+	for _, c := range chunksOf(t, NewCDCChunker(bytes.NewReader(data), 2048, 8192, 32768)) {
+		known[sha256.Sum256(c)] = true
+	}
+	for _, tt := range tests {
+		chunks := chunksOf(t, NewCDCChunker(bytes.NewReader(tt.edited), 2048, 8192, 32768))
+		changed := 0
+		for _, c := range chunks {
+			if !known[sha256.Sum256(c)] {
+				changed++
+			}
+		}
+		// only the chunks around the edit change
+		if changed > 3 {
+			t.Fatalf("%s : %d of %d chunks changed", tt.name, changed, len(chunks))
+		}
+	}
+}
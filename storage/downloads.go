@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/vquelque/Peerster/utils"
+)
+
+// DownloadSession is a download in progress. It is persisted so that the
+// download can be resumed after a restart.
+type DownloadSession struct {
+	Metahash   utils.SHA256
+	Filename   string
+	Peer       string              //peer used when no chunk sources are known
+	Sources    map[uint64][]string //chunk index -> peers having the chunk. nil if downloading from Peer
+	ChunkCount uint64
+	Completed  []byte `json:"-"` //bitmap of the chunks already downloaded and verified. Grows with them
+}
+
+// DownloadSessions stores the download sessions. Sessions are kept in memory only
+// if dir is empty.
+type DownloadSessions struct {
+	sessions map[utils.SHA256]*DownloadSession
+	running  map[utils.SHA256]bool //downloads in progress in this process. Not persisted
+	dir      string
+	lock     sync.RWMutex
+}
+
+const sessionExtension = ".json"
+const bitmapExtension = ".bitmap"
+
+// NewDownloadSessions creates the session storage and reloads the sessions persisted in dir.
+func NewDownloadSessions(dir string) (*DownloadSessions, error) {
+	ds := &DownloadSessions{sessions: make(map[utils.SHA256]*DownloadSession), running: make(map[utils.SHA256]bool), dir: dir, lock: sync.RWMutex{}}
+	if dir == "" {
+		return ds, nil
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), sessionExtension) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s := &DownloadSession{}
+		if err := json.Unmarshal(data, s); err != nil {
+			storageLog.Warnf("Ignoring corrupted download session %s : %v", e.Name(), err)
+			continue
+		}
+		s.Completed = make([]byte, 0)
+		bitmap, err := ioutil.ReadFile(ds.bitmapPath(s.Metahash))
+		if err == nil && uint64(len(bitmap)) <= bitmapSize(s.ChunkCount) {
+			s.Completed = bitmap
+		}
+		ds.sessions[s.Metahash] = s
+	}
+	return ds, nil
+}
+
+// Acquire marks the file as being downloaded. Returns false if it already is, so that a
+// file is only downloaded once at a time. Release must be called when the download ends.
+func (ds *DownloadSessions) Acquire(metahash utils.SHA256) bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if ds.running[metahash] {
+		return false
+	}
+	ds.running[metahash] = true
+	return true
+}
+
+// Release marks the download of the file as ended, successful or not.
+func (ds *DownloadSessions) Release(metahash utils.SHA256) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	delete(ds.running, metahash)
+}
+
+// Start registers a new download session, or returns the existing one for this metahash.
+func (ds *DownloadSessions) Start(metahash utils.SHA256, filename string, peer string, sources map[uint64][]string, chunkCount uint64) *DownloadSession {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if s, found := ds.sessions[metahash]; found && s.ChunkCount == chunkCount {
+		return s
+	}
+	s := &DownloadSession{
+		Metahash:   metahash,
+		Filename:   filename,
+		Peer:       peer,
+		Sources:    sources,
+		ChunkCount: chunkCount,
+		Completed:  make([]byte, 0),
+	}
+	ds.sessions[metahash] = s
+	if ds.dir != "" {
+		data, err := json.Marshal(s)
+		if err == nil {
+			err = writeFileAtomic(ds.sessionPath(metahash), data)
+		}
+		if err == nil {
+			err = writeFileAtomic(ds.bitmapPath(metahash), s.Completed)
+		}
+		if err != nil {
+			storageLog.Errorf("%v", err)
+		}
+	}
+	return s
+}
+
+// MarkCompleted records that the chunk at index was downloaded and verified.
+func (ds *DownloadSessions) MarkCompleted(metahash utils.SHA256, index uint64) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	s, found := ds.sessions[metahash]
+	if !found || index >= s.ChunkCount {
+		return
+	}
+	// the chunk count comes from the metafile : only allocate for the chunks verified
+	for uint64(len(s.Completed)) <= index/8 {
+		s.Completed = append(s.Completed, 0)
+	}
+	s.Completed[index/8] |= 1 << (index % 8)
+	if ds.dir != "" {
+		if err := writeByteAt(ds.bitmapPath(metahash), s.Completed[index/8], int64(index/8)); err != nil {
+			storageLog.Errorf("%v", err)
+		}
+	}
+}
+
+// writeByteAt updates the byte at offset of the file in place, so that marking a chunk
+// does not rewrite the whole bitmap. A lost update only makes the chunk download again.
+func writeByteAt(path string, b byte, offset int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt([]byte{b}, offset)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// IsCompleted returns true if the chunk at index was already downloaded.
+func (ds *DownloadSessions) IsCompleted(metahash utils.SHA256, index uint64) bool {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+	s, found := ds.sessions[metahash]
+	if !found || index >= s.ChunkCount || index/8 >= uint64(len(s.Completed)) {
+		return false
+	}
+	return s.Completed[index/8]&(1<<(index%8)) != 0
+}
+
+// Remove deletes a finished session.
+func (ds *DownloadSessions) Remove(metahash utils.SHA256) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	delete(ds.sessions, metahash)
+	if ds.dir != "" {
+		os.Remove(ds.sessionPath(metahash))
+		os.Remove(ds.bitmapPath(metahash))
+	}
+}
+
+// GetAll returns all the unfinished sessions.
+func (ds *DownloadSessions) GetAll() []*DownloadSession {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+	sessions := make([]*DownloadSession, 0, len(ds.sessions))
+	for _, s := range ds.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (ds *DownloadSessions) sessionPath(metahash utils.SHA256) string {
+	return filepath.Join(ds.dir, hex.EncodeToString(metahash[:])+sessionExtension)
+}
+
+func (ds *DownloadSessions) bitmapPath(metahash utils.SHA256) string {
+	return filepath.Join(ds.dir, hex.EncodeToString(metahash[:])+bitmapExtension)
+}
+
+func bitmapSize(chunkCount uint64) uint64 {
+	return (chunkCount + 7) / 8
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/vquelque/Peerster/utils"
+)
+
+func TestDownloadSessionsResume(t *testing.T) {
+	tests := []struct {
+		chunks    uint64
+		completed []uint64
+	}{
+		{1, []uint64{0}},
+		{10, []uint64{9}},
+		{10, []uint64{0, 3, 8}},
+		{1 << 20, []uint64{17, 1<<20 - 1}},
+		{12, []uint64{12, 400}}, //out of range
+	}
+	for i, tt := range tests {
+		dir := t.TempDir()
+		ds, err := NewDownloadSessions(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metahash := utils.SHA256{byte(i + 1)}
+		ds.Start(metahash, "f", "A", map[uint64][]string{0: {"A"}, 9: {"B"}}, tt.chunks)
+		for _, c := range tt.completed {
+			ds.MarkCompleted(metahash, c)
+		}
+		resumed, err := NewDownloadSessions(dir)
+		if err != nil || len(resumed.GetAll()) != 1 || resumed.GetAll()[0].Sources[9][0] != "B" {
+			t.Fatalf("%d chunks : sessions %v, %v", tt.chunks, resumed.GetAll(), err)
+		}
+		// the bitmap only grows with the chunks completed
+		if s := resumed.GetAll()[0]; uint64(len(s.Completed)) > bitmapSize(tt.completed[len(tt.completed)-1]+1) {
+			t.Fatalf("%d chunks : bitmap of %d bytes", tt.chunks, len(s.Completed))
+		}
+		for c := uint64(0); c < tt.chunks && c < 1000; c++ {
+			want := false
+			for _, d := range tt.completed {
+				want = want || c == d
+			}
+			if resumed.IsCompleted(metahash, c) != want {
+				t.Fatalf("%d chunks : chunk %d completed %v", tt.chunks, c, !want)
+			}
+		}
+		resumed.Remove(metahash)
+		if removed, _ := NewDownloadSessions(dir); len(removed.GetAll()) != 0 {
+			t.Fatalf("%d chunks : session not removed", tt.chunks)
+		}
+	}
+}
@@ -1,21 +1,26 @@
 package storage
 
 import (
-	"crypto/sha256"
-	"log"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
+	"github.com/vquelque/Peerster/logger"
 	"github.com/vquelque/Peerster/utils"
 )
 
 type File struct {
 	Name         string
 	MetafileHash utils.SHA256
-	ChunkCount   uint64
+	ChunkCount   uint64 //number of files of a directory
 	Completed    bool
 	Size         int64
+	Directory    bool //MetafileHash is the hash of the manifest of the directory
 }
 
 type Metafile []byte
@@ -26,10 +31,14 @@ type Chunk struct {
 }
 
 type FileStorage struct {
-	files     map[utils.SHA256]*File    //metahash -> File
-	chunks    map[utils.SHA256]*Chunk   //chunk hash -> chunk
-	metafiles map[utils.SHA256]Metafile //metafile hash -> metafile
+	files     map[utils.SHA256]*File          //metahash -> File
+	chunks    map[utils.SHA256]*Chunk         //chunk hash -> chunk
+	metafiles map[utils.SHA256]Metafile       //metafile hash -> metafile
+	located   map[utils.SHA256]*chunkLocation //chunk hash -> chunk of a downloaded file
+	dir       string                          //data directory. Empty for a memory only storage
+	cache     bool                            //keep chunks in memory when stored on disk
 	lock      sync.RWMutex
+	indexLock sync.Mutex //serializes the writes of the file index, done without holding lock
 }
 
 type ToDownload struct {
@@ -38,11 +47,18 @@ type ToDownload struct {
 	lock    sync.RWMutex
 }
 
+const chunksDirectory = "chunks"
+const metafilesDirectory = "metafiles"
+const filesIndex = "files.json"
+
+var storageLog = logger.New("storage")
+
 func NewFileStorage() *FileStorage {
 	return &FileStorage{
 		files:     make(map[utils.SHA256]*File),
 		chunks:    make(map[utils.SHA256]*Chunk),
 		metafiles: make(map[utils.SHA256]Metafile),
+		located:   make(map[utils.SHA256]*chunkLocation),
 		lock:      sync.RWMutex{},
 	}
 }
@@ -55,33 +71,83 @@ func NewToDownload() *ToDownload {
 	}
 }
 
+// NewDiskFileStorage creates a file storage persisted under dir. Chunks and metafiles are
+// content addressed by their SHA256 and the file index is reloaded from disk.
+// If cache is set, chunks are also kept in memory.
+func NewDiskFileStorage(dir string, cache bool) (*FileStorage, error) {
+	for _, d := range []string{dir, filepath.Join(dir, chunksDirectory), filepath.Join(dir, metafilesDirectory)} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	fs := NewFileStorage()
+	fs.dir = dir
+	fs.cache = cache
+	index, err := ioutil.ReadFile(filepath.Join(dir, filesIndex))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(index) > 0 {
+		files := make(map[string]*File)
+		if err := json.Unmarshal(index, &files); err != nil {
+			return nil, fmt.Errorf("corrupted file index in %s : %v", dir, err)
+		}
+		for _, f := range files {
+			fs.files[f.MetafileHash] = f
+		}
+	}
+	return fs, nil
+}
+
 //StoreFile stores file and associated metafile
 func (fs *FileStorage) StoreFile(f *File, metafile []byte) {
 	fs.lock.Lock()
-	defer fs.lock.Unlock()
 	fs.files[f.MetafileHash] = f
-	fs.metafiles[f.MetafileHash] = metafile
+	fs.storeMetafile(f.MetafileHash, metafile)
+	fs.lock.Unlock()
+	if fs.dir != "" {
+		fs.writeMetafile(f.MetafileHash, metafile)
+		if err := fs.writeIndex(); err != nil {
+			storageLog.Errorf("%v", err)
+		}
+	}
 }
 
-// StoreChunk stores chunnk
-func (fs *FileStorage) StoreChunk(c *Chunk) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-	fs.chunks[c.Hash] = c
+// StoreChunk stores chunnk. A chunk shared by several files is stored once : returns false
+// if it already was.
+func (fs *FileStorage) StoreChunk(c *Chunk) bool {
+	fs.lock.RLock()
+	stored := fs.hasStoredChunk(c.Hash)
+	fs.lock.RUnlock()
+	if stored {
+		return false
+	}
+	if fs.dir != "" {
+		// content addressed : concurrent writes of a chunk write the same data
+		if err := writeFileAtomic(fs.chunkPath(c.Hash), c.Data); err != nil {
+			storageLog.Errorf("%v", err)
+		}
+	}
+	if fs.dir == "" || fs.cache {
+		fs.lock.Lock()
+		fs.chunks[c.Hash] = c
+		fs.lock.Unlock()
+	}
+	return true
 }
 
 func (fs *FileStorage) GetChunkOrMeta(hash utils.SHA256) []byte {
 	fs.lock.RLock()
 	defer fs.lock.RUnlock()
-	meta, mfound := fs.metafiles[hash]
-	chunk, cfound := fs.chunks[hash]
+	meta, mfound := fs.getMetafile(hash)
+	chunk, cfound := fs.getChunk(hash)
 	//	log.Printf("GETTING CHUNK %x  FOUND %s ", hash, cfound)
 	if mfound {
 		return meta
 	} else if cfound {
-		return chunk.Data
+		return chunk
 	} else if cfound && mfound {
-		log.Print("Hash problem : meta and chunk found for this hash")
+		storageLog.Warnf("Hash problem : meta and chunk found for this hash")
 	}
 	return nil
 }
@@ -99,7 +165,7 @@ func (fs *FileStorage) GetFile(hash utils.SHA256) *File {
 func (fs *FileStorage) GetMetafile(hash utils.SHA256) Metafile {
 	fs.lock.RLock()
 	defer fs.lock.RUnlock()
-	f, found := fs.metafiles[hash]
+	f, found := fs.getMetafile(hash)
 	if !found {
 		return nil
 	}
@@ -108,21 +174,13 @@ func (fs *FileStorage) GetMetafile(hash utils.SHA256) Metafile {
 
 func (fs *FileStorage) StoreMetafile(metahash utils.SHA256, meta Metafile) {
 	fs.lock.Lock()
-	defer fs.lock.Unlock()
-	_, found := fs.metafiles[metahash]
+	_, found := fs.getMetafile(metahash)
 	if !found {
-		fs.metafiles[metahash] = make(Metafile, len(meta))
-		copy(fs.metafiles[metahash], meta)
+		fs.storeMetafile(metahash, meta)
 	}
-}
-
-func (fs *FileStorage) WriteChunksToFile(chunks []utils.SHA256, file *os.File) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-	defer file.Close()
-	for _, h := range chunks {
-		data := fs.chunks[h]
-		file.Write(data.Data)
+	fs.lock.Unlock()
+	if !found && fs.dir != "" {
+		fs.writeMetafile(metahash, meta)
 	}
 }
 
@@ -139,37 +197,166 @@ func (fs *FileStorage) SearchForFile(keyword string) []*File {
 	return matchingFiles
 }
 
+// ChunkCount returns the number of chunks of the file. A directory is downloaded as a
+// single chunk : its manifest.
 func (fs *FileStorage) ChunkCount(metahash utils.SHA256) uint64 {
 	fs.lock.RLock()
 	defer fs.lock.RUnlock()
-	meta := fs.metafiles[metahash]
-	count := uint64(len(meta) / sha256.Size)
+	meta, _ := fs.getMetafile(metahash)
+	if IsManifest(meta) {
+		return 1
+	}
+	count, _ := ChunkCountOf(meta)
 	return count
 }
 
+// ChunkMap returns the indexes (starting at 1) of the chunks of the file that are stored.
+// The chunks below the nodes of a metafile tree that are not stored yet are left out.
 func (fs *FileStorage) ChunkMap(metahash utils.SHA256) []uint64 {
 	fs.lock.RLock()
 	defer fs.lock.RUnlock()
 	chunks := make([]uint64, 0)
-	meta := fs.metafiles[metahash]
-	numChunks := len(meta) / sha256.Size //number of chunks
-	var chunksHash []utils.SHA256
-	for i := 0; i < numChunks; i++ {
-		j := i * sha256.Size
-		k := j + sha256.Size
-		var hash utils.SHA256
-		copy(hash[:], meta[j:k])
-		chunksHash = append(chunksHash, hash)
-	}
-	for c, m := range chunksHash {
-		_, found := fs.chunks[m]
-		if found {
-			chunks = append(chunks, uint64(c+1))
+	meta, _ := fs.getMetafile(metahash)
+	if IsManifest(meta) {
+		return []uint64{1}
+	}
+	addStored := func(first uint64, chunksHash []utils.SHA256) error {
+		for c, m := range chunksHash {
+			if fs.hasChunk(m) {
+				chunks = append(chunks, first+uint64(c+1))
+			}
 		}
+		return nil
+	}
+	if !IsTree(meta) {
+		addStored(0, SplitHashes(meta))
+		return chunks
+	}
+	getNode := func(hash utils.SHA256) (Metafile, error) {
+		node, _ := fs.getMetafile(hash)
+		return node, nil
+	}
+	if err := WalkTree(meta, getNode, addStored); err != nil {
+		storageLog.Warnf("cannot read the metafile tree %x : %v", metahash, err)
 	}
 	return chunks
 }
 
+// getChunk returns the chunk data from memory or disk, or from the downloaded file holding
+// it. Caller must hold the lock.
+func (fs *FileStorage) getChunk(hash utils.SHA256) ([]byte, bool) {
+	chunk, found := fs.chunks[hash]
+	if found {
+		return chunk.Data, true
+	}
+	if fs.dir != "" {
+		data, err := ioutil.ReadFile(fs.chunkPath(hash))
+		if err == nil {
+			return data, true
+		}
+	}
+	return fs.readLocated(hash)
+}
+
+// hasChunk checks if the chunk is stored or written in a downloaded file without reading
+// it. Caller must hold the lock.
+func (fs *FileStorage) hasChunk(hash utils.SHA256) bool {
+	if _, found := fs.located[hash]; found {
+		return true
+	}
+	return fs.hasStoredChunk(hash)
+}
+
+// hasStoredChunk checks if the chunk is stored in memory or on disk. Caller must hold the
+// lock.
+func (fs *FileStorage) hasStoredChunk(hash utils.SHA256) bool {
+	if _, found := fs.chunks[hash]; found {
+		return true
+	}
+	if fs.dir == "" {
+		return false
+	}
+	_, err := os.Stat(fs.chunkPath(hash))
+	return err == nil
+}
+
+// getMetafile returns the metafile from memory or disk. Caller must hold the lock.
+func (fs *FileStorage) getMetafile(hash utils.SHA256) (Metafile, bool) {
+	meta, found := fs.metafiles[hash]
+	if found || fs.dir == "" {
+		return meta, found
+	}
+	data, err := ioutil.ReadFile(fs.metafilePath(hash))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// storeMetafile keeps a copy of the metafile in memory. Caller must hold the write lock.
+// Metafiles are small so they are always kept in memory, and written to disk by
+// writeMetafile once the lock is released.
+func (fs *FileStorage) storeMetafile(hash utils.SHA256, meta Metafile) {
+	fs.metafiles[hash] = make(Metafile, len(meta))
+	copy(fs.metafiles[hash], meta)
+}
+
+// writeMetafile persists the metafile. Must be called without holding the lock.
+func (fs *FileStorage) writeMetafile(hash utils.SHA256, meta Metafile) {
+	if err := writeFileAtomic(fs.metafilePath(hash), meta); err != nil {
+		storageLog.Errorf("%v", err)
+	}
+}
+
+func (fs *FileStorage) chunkPath(hash utils.SHA256) string {
+	h := hex.EncodeToString(hash[:])
+	return filepath.Join(fs.dir, chunksDirectory, h[:2], h)
+}
+
+func (fs *FileStorage) metafilePath(hash utils.SHA256) string {
+	return filepath.Join(fs.dir, metafilesDirectory, hex.EncodeToString(hash[:]))
+}
+
+// writeIndex persists the current file index. Must be called without holding the lock :
+// the index is only read locked while encoded, and the writes are serialized so that
+// the last one written is always the most recent.
+func (fs *FileStorage) writeIndex() error {
+	fs.indexLock.Lock()
+	defer fs.indexLock.Unlock()
+	fs.lock.RLock()
+	files := make(map[string]*File, len(fs.files))
+	for h, f := range fs.files {
+		files[hex.EncodeToString(h[:])] = f
+	}
+	index, err := json.Marshal(files)
+	fs.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(fs.dir, filesIndex), index)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path so that
+// readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 func (td *ToDownload) AddFileToDownload(metahash utils.SHA256, filename string, chunks map[uint64][]string) {
 	td.lock.Lock()
 	defer td.lock.Unlock()
@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vquelque/Peerster/message"
+)
+
+// History is an append-only on-disk log of the rumors and TLC messages of each origin
+// and of the private conversations with each peer. It is replayed at startup so that the
+// gossiper keeps its sequence numbers and its chat history across restarts. Nothing is
+// persisted if dir is empty. Once closed, the records appended are dropped.
+type History struct {
+	dir    string
+	files  map[string]*os.File //log path -> file opened for appending
+	logged map[string]uint32   //origin -> ID of its last logged rumor
+	closed bool
+	lock   sync.Mutex
+}
+
+// RumorRecord is an entry of the log of an origin.
+type RumorRecord struct {
+	Received time.Time
+	Packet   message.RumorPacket
+}
+
+// PrivateRecord is an entry of the log of a private conversation. A record without
+// message updates the delivery status of the message ID we sent.
+type PrivateRecord struct {
+	Message *message.PrivateMessage `json:",omitempty"`
+	ID      uint32                  `json:",omitempty"`
+	Status  string                  `json:",omitempty"`
+}
+
+const rumorsDirectory = "rumors"
+const privateDirectory = "private"
+const logExtension = ".log"
+const lastRouteRumorFile = "lastRouteRumor"
+
+// NewHistory creates the history stored in dir.
+func NewHistory(dir string) (*History, error) {
+	h := &History{dir: dir, files: make(map[string]*os.File), logged: make(map[string]uint32), lock: sync.Mutex{}}
+	if dir == "" {
+		return h, nil
+	}
+	for _, d := range []string{rumorsDirectory, privateDirectory} {
+		if err := os.MkdirAll(filepath.Join(dir, d), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// AppendRumor appends a rumor or TLC message to the log of its origin, unless a later
+// message of the origin was already logged. Route rumors are not logged : they carry no
+// text and are sent periodically, so the logs would grow forever. The ID of our own last
+// route rumor is kept by SetLastRouteRumor instead.
+func (h *History) AppendRumor(pkt *message.RumorPacket) {
+	origin, id, rumor := pkt.GetDetails()
+	if h.dir == "" || rumor && pkt.RumorMessage.Text == "" {
+		return
+	}
+	h.lock.Lock()
+	if id <= h.logged[origin] {
+		h.lock.Unlock()
+		return
+	}
+	h.logged[origin] = id
+	h.lock.Unlock()
+	h.append(h.logPath(rumorsDirectory, origin), &RumorRecord{Received: time.Now(), Packet: *pkt})
+}
+
+// AppendPrivate appends a private message exchanged with peer to the conversation log.
+// status is the delivery status of the messages we send, empty for received ones.
+func (h *History) AppendPrivate(peer string, msg *message.PrivateMessage, status string) {
+	h.append(h.logPath(privateDirectory, peer), &PrivateRecord{Message: msg, ID: msg.ID, Status: status})
+}
+
+// AppendPrivateStatus records the new delivery status of the message id sent to peer.
+func (h *History) AppendPrivateStatus(peer string, id uint32, status string) {
+	h.append(h.logPath(privateDirectory, peer), &PrivateRecord{ID: id, Status: status})
+}
+
+// SetLastRouteRumor records the ID of the last route rumor we sent, so that our IDs
+// are not reused after a restart.
+func (h *History) SetLastRouteRumor(id uint32) {
+	if h.dir == "" {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return
+	}
+	data := []byte(strconv.FormatUint(uint64(id), 10))
+	if err := writeFileAtomic(filepath.Join(h.dir, rumorsDirectory, lastRouteRumorFile), data); err != nil {
+		storageLog.Errorf("%v", err)
+	}
+}
+
+// LastRouteRumor returns the ID of the last route rumor we sent, 0 if none was recorded.
+func (h *History) LastRouteRumor() uint32 {
+	if h.dir == "" {
+		return 0
+	}
+	data, err := ioutil.ReadFile(filepath.Join(h.dir, rumorsDirectory, lastRouteRumorFile))
+	if err != nil {
+		return 0
+	}
+	id, err := strconv.ParseUint(string(data), 10, 32)
+	if err != nil {
+		storageLog.Warnf("Ignoring corrupted route rumor ID : %v", err)
+		return 0
+	}
+	return uint32(id)
+}
+
+// Rumors returns the logged rumors and TLC messages of all the origins, in the order
+// they were received. The messages of an origin are always kept in the order of its log.
+func (h *History) Rumors() ([]*message.RumorPacket, error) {
+	logs := make(map[string][]*RumorRecord)
+	total := 0
+	err := h.readAll(rumorsDirectory, func(origin string, line []byte) error {
+		r := &RumorRecord{}
+		if err := json.Unmarshal(line, r); err != nil {
+			return err
+		}
+		logs[origin] = append(logs[origin], r)
+		total++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.lock.Lock()
+	for origin, records := range logs {
+		for _, r := range records {
+			if _, id, _ := r.Packet.GetDetails(); id > h.logged[origin] {
+				h.logged[origin] = id
+			}
+		}
+	}
+	h.lock.Unlock()
+	origins := make([]string, 0, len(logs))
+	for origin := range logs {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	// merge the logs by reception time
+	pkts := make([]*message.RumorPacket, 0, total)
+	for len(pkts) < total {
+		first := -1
+		for i, origin := range origins {
+			if len(logs[origin]) == 0 {
+				continue
+			}
+			if first < 0 || logs[origin][0].Received.Before(logs[origins[first]][0].Received) {
+				first = i
+			}
+		}
+		origin := origins[first]
+		pkts = append(pkts, &logs[origin][0].Packet)
+		logs[origin] = logs[origin][1:]
+	}
+	return pkts, nil
+}
+
+// Private returns the logged records of the conversation with each peer.
+func (h *History) Private() (map[string][]*PrivateRecord, error) {
+	conversations := make(map[string][]*PrivateRecord)
+	err := h.readAll(privateDirectory, func(peer string, line []byte) error {
+		r := &PrivateRecord{}
+		if err := json.Unmarshal(line, r); err != nil {
+			return err
+		}
+		conversations[peer] = append(conversations[peer], r)
+		return nil
+	})
+	return conversations, err
+}
+
+// Close flushes and closes the log files. The later appends are dropped, so that the
+// handlers still running after a timed out Stop of the gossiper cannot reopen them.
+func (h *History) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for path, f := range h.files {
+		f.Sync()
+		f.Close()
+		delete(h.files, path)
+	}
+}
+
+// logPath returns the path of the log of name. Names are hex encoded as they are
+// chosen by the peers.
+func (h *History) logPath(directory string, name string) string {
+	return filepath.Join(h.dir, directory, hex.EncodeToString([]byte(name))+logExtension)
+}
+
+func (h *History) append(path string, record interface{}) {
+	if h.dir == "" {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		storageLog.Errorf("%v", err)
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return
+	}
+	f, found := h.files[path]
+	if !found {
+		f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			storageLog.Errorf("%v", err)
+			return
+		}
+		h.files[path] = f
+		if !endsWithNewline(f) {
+			// a crash interrupted the last write : start a new record
+			f.Write([]byte{'\n'})
+		}
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		storageLog.Errorf("%v", err)
+	}
+}
+
+func endsWithNewline(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return true
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return true
+	}
+	return last[0] == '\n'
+}
+
+// readAll calls f for each record of each log of the directory with the name of the log.
+// A truncated last record, left by a crash during a write, is ignored.
+func (h *History) readAll(directory string, f func(name string, line []byte) error) error {
+	if h.dir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(h.dir, directory, "*"+logExtension))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		name, err := hex.DecodeString(strings.TrimSuffix(filepath.Base(path), logExtension))
+		if err != nil {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for scanner.Scan() {
+			if err := f(string(name), scanner.Bytes()); err != nil {
+				storageLog.Warnf("Ignoring corrupted record in %s : %v", path, err)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/vquelque/Peerster/message"
+)
+
+func rumorPacket(origin string, id uint32, text string) *message.RumorPacket {
+	return &message.RumorPacket{RumorMessage: message.NewRumorMessage(origin, id, text)}
+}
+
+func TestHistoryAppendsOnce(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AppendRumor(rumorPacket("A", 1, "a1"))
+	h.AppendRumor(rumorPacket("A", 2, "")) //route rumor
+	h.AppendRumor(rumorPacket("A", 3, "a3"))
+	h.AppendRumor(rumorPacket("B", 2, "b2"))
+	h.AppendRumor(rumorPacket("A", 3, "a3"))
+	h.Close()
+
+	// every restart replays the log and receives the same rumors again
+	for restart := 0; restart < 3; restart++ {
+		h, err = NewHistory(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rumors, err := h.Rumors()
+		if err != nil || len(rumors) != 3 {
+			t.Fatalf("restart %d : %d rumors, %v", restart, len(rumors), err)
+		}
+		for _, pkt := range rumors {
+			h.AppendRumor(pkt)
+		}
+		h.AppendRumor(rumorPacket("B", 1, "b1"))
+		h.Close()
+	}
+}
+
+func TestRumorStorageSkip(t *testing.T) {
+	rs := NewRumorStorage()
+	rs.Store(rumorPacket("A", 1, "a1"))
+	rs.Skip("A", 4)
+	rs.Store(rumorPacket("A", 4, "a4"))
+	rs.Skip("B", 2)
+	rs.Store(rumorPacket("B", 2, "b2"))
+	rs.Skip("A", 2) //already stored
+	rs.Store(rumorPacket("A", 5, "a5"))
+
+	tests := []struct {
+		origin string
+		id     uint32
+		text   string
+	}{
+		{"A", 1, "a1"},
+		{"A", 2, ""},
+		{"A", 3, ""},
+		{"A", 4, "a4"},
+		{"A", 5, "a5"},
+		{"A", 6, ""},
+		{"B", 1, ""},
+		{"B", 2, "b2"},
+	}
+	for _, tt := range tests {
+		pkt := rs.Get(tt.origin, tt.id)
+		if (pkt == nil) != (tt.text == "") || pkt != nil && pkt.RumorMessage.Text != tt.text {
+			t.Fatalf("rumor %d of %s : %v", tt.id, tt.origin, pkt)
+		}
+	}
+	if all := rs.GetAll(); len(all) != 4 || all[3].RumorMessage.Text != "a5" {
+		t.Fatalf("all rumors %v", all)
+	}
+}
+
+func TestHistoryDropsAppendsOnceClosed(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AppendRumor(rumorPacket("A", 1, "a1"))
+	h.SetLastRouteRumor(3)
+	h.Close()
+	// handlers still running after a timed out stop
+	h.AppendRumor(rumorPacket("A", 2, "a2"))
+	h.AppendRumor(rumorPacket("B", 1, "b1"))
+	h.AppendPrivate("B", &message.PrivateMessage{Origin: "A", Destination: "B", ID: 1, Text: "hi"}, "sent")
+	h.SetLastRouteRumor(9)
+	h.Close()
+
+	h, err = NewHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	rumors, err := h.Rumors()
+	if err != nil || len(rumors) != 1 || rumors[0].RumorMessage.Text != "a1" {
+		t.Fatalf("%d rumors after close, %v", len(rumors), err)
+	}
+	if private, err := h.Private(); err != nil || len(private) != 0 {
+		t.Fatalf("%d conversations after close, %v", len(private), err)
+	}
+	if id := h.LastRouteRumor(); id != 3 {
+		t.Fatalf("last route rumor %d, want 3", id)
+	}
+}
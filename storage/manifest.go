@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/dedis/protobuf"
+)
+
+// Manifest describes a shared directory : the files of the tree with their metahash. It is
+// stored and exchanged as the metafile of the directory, and addressed by its hash.
+type Manifest struct {
+	Entries []ManifestEntry
+}
+
+// ManifestEntry is a file of a shared directory.
+type ManifestEntry struct {
+	Path     string //relative to the directory, slash separated
+	Size     int64
+	Metahash []byte
+}
+
+// manifestMagic starts the encoding of the manifests, so that they are told apart from the
+// metafiles of the files.
+const manifestMagic = "PEERSTER-MANIFEST/1\n"
+
+// Encode returns the metafile of the manifest.
+func (m *Manifest) Encode() (Metafile, error) {
+	data, err := protobuf.Encode(m)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(manifestMagic), data...), nil
+}
+
+// IsManifest checks if the metafile is the manifest of a directory.
+func IsManifest(meta Metafile) bool {
+	return bytes.HasPrefix(meta, []byte(manifestMagic))
+}
+
+// DecodeManifest decodes the manifest of a directory. The paths of the entries are
+// checked so that the tree cannot be written outside of the directory.
+func DecodeManifest(meta Metafile) (*Manifest, error) {
+	if !IsManifest(meta) {
+		return nil, fmt.Errorf("not a manifest")
+	}
+	m := &Manifest{}
+	if err := protobuf.Decode(meta[len(manifestMagic):], m); err != nil {
+		return nil, fmt.Errorf("corrupted manifest : %v", err)
+	}
+	paths := make(map[string]bool, len(m.Entries))
+	for _, e := range m.Entries {
+		if !validEntryPath(e.Path) {
+			return nil, fmt.Errorf("invalid path %q in manifest", e.Path)
+		}
+		if paths[e.Path] {
+			return nil, fmt.Errorf("duplicate path %q in manifest", e.Path)
+		}
+		paths[e.Path] = true
+		if len(e.Metahash) != sha256.Size || e.Size < 0 {
+			return nil, fmt.Errorf("invalid entry %q in manifest", e.Path)
+		}
+	}
+	return m, nil
+}
+
+// validEntryPath checks that p is a clean relative path staying inside the directory.
+func validEntryPath(p string) bool {
+	if p == "" || p != path.Clean(p) || path.IsAbs(p) || strings.Contains(p, "\\") {
+		return false
+	}
+	return p != "." && p != ".." && !strings.HasPrefix(p, "../")
+}
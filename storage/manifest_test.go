@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestValidEntryPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		valid bool
+	}{
+		{"a", true},
+		{"a/b.txt", true},
+		{"..a", true},
+		{"a/..b/c", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../a", false},
+		{"a/../../b", false},
+		{"a/../b", false}, //not clean
+		{"a/./b", false},
+		{"a//b", false},
+		{"a/", false},
+		{"/etc/passwd", false},
+		{"a\\..\\..\\b", false},
+		{"C:\\a", false},
+	}
+	for _, tt := range tests {
+		if validEntryPath(tt.path) != tt.valid {
+			t.Errorf("path %q : valid %v", tt.path, !tt.valid)
+		}
+	}
+}
+
+func TestDecodeManifest(t *testing.T) {
+	hash := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		name    string
+		entries []ManifestEntry
+		ok      bool
+	}{
+		{"empty directory", nil, true},
+		{"tree", []ManifestEntry{{"a", 3, hash}, {"b/c", 0, hash}, {"b/d/e", 1 << 40, hash}}, true},
+		{"escaping path", []ManifestEntry{{"a", 3, hash}, {"../a", 3, hash}}, false},
+		{"absolute path", []ManifestEntry{{"/a", 3, hash}}, false},
+		{"duplicate path", []ManifestEntry{{"a/b", 3, hash}, {"a/b", 4, hash}}, false},
+		{"short metahash", []ManifestEntry{{"a", 3, hash[:31]}}, false},
+		{"missing metahash", []ManifestEntry{{"a", 3, nil}}, false},
+		{"negative size", []ManifestEntry{{"a", -1, hash}}, false},
+	}
+	for _, tt := range tests {
+		meta, err := (&Manifest{Entries: tt.entries}).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsManifest(meta) {
+			t.Fatalf("%s : not a manifest", tt.name)
+		}
+		m, err := DecodeManifest(meta)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%s : %v", tt.name, err)
+		}
+		if err == nil && len(m.Entries) != len(tt.entries) {
+			t.Fatalf("%s : %d entries decoded", tt.name, len(m.Entries))
+		}
+	}
+
+	meta, _ := (&Manifest{Entries: []ManifestEntry{{"a", 3, hash}}}).Encode()
+	for _, bad := range []Metafile{nil, hash, meta[:len(manifestMagic)-1], meta[:len(meta)-5]} {
+		if _, err := DecodeManifest(bad); err == nil {
+			t.Fatalf("metafile %x decoded", bad)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/vquelque/Peerster/constant"
+	"github.com/vquelque/Peerster/utils"
+)
+
+// A file of up to constant.MetafileFanout chunks has a flat metafile : the hashes of its
+// chunks. A larger file has a Merkle-tree metafile. Its root lists the hashes of the nodes
+// below it, each node listing up to constant.MetafileFanout hashes of the nodes of the
+// level below. The nodes of level 1 list the hashes of the chunks. Every node fits in a
+// single data reply and is requested by its hash when needed.
+
+// treeMagic starts the roots of the Merkle-tree metafiles, followed by the level of the
+// root and the number of chunks of the file.
+const treeMagic = "PEERSTER-TREE/1\n"
+const treeHeaderSize = len(treeMagic) + 1 + 8
+
+// maxTreeLevel is the height of the trees of constant.MaxFileChunks chunks.
+const maxTreeLevel = 3
+
+// TreeRoot is the decoded root of a Merkle-tree metafile.
+type TreeRoot struct {
+	Level      uint8 //the nodes of level 1 list the chunks
+	ChunkCount uint64
+	Children   []utils.SHA256
+}
+
+// BuildMetafile returns the metafile of the file made of chunks, and the nodes of its tree
+// if it has more than constant.MetafileFanout chunks.
+func BuildMetafile(chunks []utils.SHA256) (Metafile, []Metafile) {
+	if len(chunks) <= constant.MetafileFanout {
+		return joinHashes(chunks), nil
+	}
+	nodes := make([]Metafile, 0)
+	hashes := chunks
+	var level uint8 = 0
+	for len(hashes) > constant.MetafileFanout {
+		parents := make([]utils.SHA256, 0, len(hashes)/constant.MetafileFanout+1)
+		for i := 0; i < len(hashes); i += constant.MetafileFanout {
+			end := i + constant.MetafileFanout
+			if end > len(hashes) {
+				end = len(hashes)
+			}
+			node := joinHashes(hashes[i:end])
+			nodes = append(nodes, node)
+			parents = append(parents, sha256.Sum256(node))
+		}
+		hashes = parents
+		level++
+	}
+	root := make(Metafile, treeHeaderSize, treeHeaderSize+len(hashes)*sha256.Size)
+	copy(root, treeMagic)
+	root[len(treeMagic)] = level + 1
+	binary.LittleEndian.PutUint64(root[len(treeMagic)+1:], uint64(len(chunks)))
+	return append(root, joinHashes(hashes)...), nodes
+}
+
+// IsTree checks if the metafile is the root of a Merkle-tree metafile.
+func IsTree(meta Metafile) bool {
+	return bytes.HasPrefix(meta, []byte(treeMagic))
+}
+
+// DecodeTreeRoot decodes the root of a Merkle-tree metafile. The level and the number of
+// children must match the number of chunks, of at most constant.MaxFileChunks.
+func DecodeTreeRoot(meta Metafile) (*TreeRoot, error) {
+	if !IsTree(meta) || len(meta) < treeHeaderSize {
+		return nil, fmt.Errorf("not a metafile tree")
+	}
+	r := &TreeRoot{
+		Level:      meta[len(treeMagic)],
+		ChunkCount: binary.LittleEndian.Uint64(meta[len(treeMagic)+1:]),
+	}
+	// a tree is only as high as needed for its chunks : files of up to
+	// constant.MetafileFanout chunks have a flat metafile
+	if r.Level < 2 || r.Level > maxTreeLevel || r.ChunkCount > constant.MaxFileChunks ||
+		r.ChunkCount <= treeSpan(r.Level-1) || r.ChunkCount > treeSpan(r.Level) {
+		return nil, fmt.Errorf("invalid metafile tree of level %d with %d chunks", r.Level, r.ChunkCount)
+	}
+	children, err := decodeTreeNode(meta[treeHeaderSize:], r.Level, 0, r.ChunkCount)
+	if err != nil {
+		return nil, err
+	}
+	r.Children = children
+	return r, nil
+}
+
+// WalkTree visits the chunks of the Merkle-tree metafile root in order. getNode returns the
+// node of a hash, or nil to skip the chunks below it. visit is called with the hashes of
+// the chunks listed by each node of level 1, and the index of the first one.
+func WalkTree(root Metafile, getNode func(utils.SHA256) (Metafile, error), visit func(first uint64, chunks []utils.SHA256) error) error {
+	r, err := DecodeTreeRoot(root)
+	if err != nil {
+		return err
+	}
+	return walkNode(r.Children, r.Level, 0, r.ChunkCount, getNode, visit)
+}
+
+// walkNode visits the chunks below the children of a node of level covering the chunks
+// from first.
+func walkNode(children []utils.SHA256, level uint8, first uint64, count uint64, getNode func(utils.SHA256) (Metafile, error), visit func(uint64, []utils.SHA256) error) error {
+	if level == 1 {
+		return visit(first, children)
+	}
+	span := treeSpan(level - 1)
+	for i, h := range children {
+		start := first + uint64(i)*span
+		node, err := getNode(h)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			continue
+		}
+		grandchildren, err := decodeTreeNode(node, level-1, start, count)
+		if err != nil {
+			return err
+		}
+		if err := walkNode(grandchildren, level-1, start, count, getNode, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeTreeNode returns the children of the node of level covering the chunks from first,
+// checking that it has one child per node of the level below.
+func decodeTreeNode(node Metafile, level uint8, first uint64, count uint64) ([]utils.SHA256, error) {
+	chunks := count - first
+	if chunks > treeSpan(level) {
+		chunks = treeSpan(level)
+	}
+	below := treeSpan(level - 1)
+	children := (chunks + below - 1) / below
+	if uint64(len(node)) != children*sha256.Size {
+		return nil, fmt.Errorf("invalid node of level %d in metafile tree", level)
+	}
+	return SplitHashes(node), nil
+}
+
+// ChunkCountOf returns the number of chunks of the file described by the metafile.
+func ChunkCountOf(meta Metafile) (uint64, error) {
+	if IsTree(meta) {
+		r, err := DecodeTreeRoot(meta)
+		if err != nil {
+			return 0, err
+		}
+		return r.ChunkCount, nil
+	}
+	if len(meta)%sha256.Size != 0 {
+		return 0, fmt.Errorf("invalid metafile of %d bytes", len(meta))
+	}
+	return uint64(len(meta) / sha256.Size), nil
+}
+
+// SplitHashes returns the hashes listed by a flat metafile or a node of a tree.
+func SplitHashes(meta Metafile) []utils.SHA256 {
+	hashes := make([]utils.SHA256, 0, len(meta)/sha256.Size)
+	for i := 0; i+sha256.Size <= len(meta); i += sha256.Size {
+		hashes = append(hashes, utils.SliceToHash(meta[i:i+sha256.Size]))
+	}
+	return hashes
+}
+
+func joinHashes(hashes []utils.SHA256) Metafile {
+	meta := make(Metafile, 0, len(hashes)*sha256.Size)
+	for _, h := range hashes {
+		meta = append(meta, h[:]...)
+	}
+	return meta
+}
+
+// treeSpan returns the number of chunks below a full node of level.
+func treeSpan(level uint8) uint64 {
+	span := uint64(1)
+	for i := uint8(0); i < level; i++ {
+		span *= constant.MetafileFanout
+	}
+	return span
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/vquelque/Peerster/constant"
+	"github.com/vquelque/Peerster/utils"
+)
+
+// testHashes returns n distinct chunk hashes.
+func testHashes(n int) []utils.SHA256 {
+	hashes := make([]utils.SHA256, n)
+	for i := range hashes {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(i))
+		hashes[i] = sha256.Sum256(b[:])
+	}
+	return hashes
+}
+
+func TestBuildAndWalkMetafile(t *testing.T) {
+	fanout := constant.MetafileFanout
+	tests := []struct {
+		chunks int
+		tree   bool
+		level  uint8
+	}{
+		{0, false, 0},
+		{1, false, 0},
+		{fanout, false, 0},
+		{fanout + 1, true, 2},
+		{3*fanout - 5, true, 2},
+		{fanout * fanout, true, 2},
+		{fanout*fanout + 3, true, 3},
+	}
+	for _, tt := range tests {
+		chunks := testHashes(tt.chunks)
+		root, nodes := BuildMetafile(chunks)
+		if IsTree(root) != tt.tree {
+			t.Fatalf("%d chunks : tree %v, want %v", tt.chunks, IsTree(root), tt.tree)
+		}
+		count, err := ChunkCountOf(root)
+		if err != nil || count != uint64(tt.chunks) {
+			t.Fatalf("%d chunks : counted %d, %v", tt.chunks, count, err)
+		}
+		if !tt.tree {
+			if len(nodes) != 0 || len(root) != tt.chunks*sha256.Size {
+				t.Fatalf("%d chunks : flat metafile of %d bytes", tt.chunks, len(root))
+			}
+			continue
+		}
+		r, err := DecodeTreeRoot(root)
+		if err != nil || r.Level != tt.level {
+			t.Fatalf("%d chunks : root %+v, %v", tt.chunks, r, err)
+		}
+		store := make(map[utils.SHA256]Metafile)
+		for _, node := range nodes {
+			if len(node) > fanout*sha256.Size {
+				t.Fatalf("%d chunks : node of %d bytes", tt.chunks, len(node))
+			}
+			store[sha256.Sum256(node)] = node
+		}
+		walked := make([]utils.SHA256, 0)
+		getNode := func(h utils.SHA256) (Metafile, error) { return store[h], nil }
+		err = WalkTree(root, getNode, func(first uint64, hashes []utils.SHA256) error {
+			if first != uint64(len(walked)) {
+				t.Fatalf("%d chunks : node starting at %d after %d chunks", tt.chunks, first, len(walked))
+			}
+			walked = append(walked, hashes...)
+			return nil
+		})
+		if err != nil || len(walked) != tt.chunks {
+			t.Fatalf("%d chunks : walked %d, %v", tt.chunks, len(walked), err)
+		}
+		for i := range walked {
+			if walked[i] != chunks[i] {
+				t.Fatalf("%d chunks : chunk %d differs", tt.chunks, i)
+			}
+		}
+	}
+}
+
+func TestDecodeTreeRootRejectsInconsistentRoots(t *testing.T) {
+	root, _ := BuildMetafile(testHashes(constant.MetafileFanout + 1))
+	header := len(treeMagic)
+	tests := []struct {
+		name  string
+		forge func(Metafile) Metafile
+	}{
+		{"truncated header", func(m Metafile) Metafile { return m[:header+3] }},
+		{"level 0", func(m Metafile) Metafile { m[header] = 0; return m }},
+		{"level 1", func(m Metafile) Metafile { m[header] = 1; return m }},
+		{"level too high", func(m Metafile) Metafile { m[header] = maxTreeLevel + 1; return m }},
+		{"level higher than needed", func(m Metafile) Metafile { m[header] = 3; return m }},
+		{"no chunks", func(m Metafile) Metafile { binary.LittleEndian.PutUint64(m[header+1:], 0); return m }},
+		{"flat file", func(m Metafile) Metafile {
+			binary.LittleEndian.PutUint64(m[header+1:], uint64(constant.MetafileFanout))
+			return m
+		}},
+		{"more chunks than children", func(m Metafile) Metafile {
+			binary.LittleEndian.PutUint64(m[header+1:], 3*uint64(constant.MetafileFanout))
+			return m
+		}},
+		{"huge chunk count", func(m Metafile) Metafile {
+			m[header] = maxTreeLevel
+			binary.LittleEndian.PutUint64(m[header+1:], 1<<62)
+			return m
+		}},
+		{"missing child", func(m Metafile) Metafile { return m[:len(m)-sha256.Size] }},
+		{"extra child", func(m Metafile) Metafile { return append(m, make([]byte, sha256.Size)...) }},
+		{"partial child", func(m Metafile) Metafile { return m[:len(m)-1] }},
+	}
+	for _, tt := range tests {
+		forged := tt.forge(append(Metafile{}, root...))
+		if _, err := DecodeTreeRoot(forged); err == nil {
+			t.Errorf("%s : accepted", tt.name)
+		}
+		if _, err := ChunkCountOf(forged); err == nil {
+			t.Errorf("%s : counted", tt.name)
+		}
+	}
+}
+
+func TestWalkTreeRejectsInconsistentNodes(t *testing.T) {
+	root, nodes := BuildMetafile(testHashes(2*constant.MetafileFanout + 7))
+	store := make(map[utils.SHA256]Metafile)
+	for _, node := range nodes {
+		store[sha256.Sum256(node)] = node
+	}
+	visit := func(uint64, []utils.SHA256) error { return nil }
+	last := sha256.Sum256(nodes[len(nodes)-1])
+	tests := []struct {
+		name string
+		node Metafile
+	}{
+		{"truncated", nodes[len(nodes)-1][:sha256.Size]},
+		{"padded", append(append(Metafile{}, nodes[len(nodes)-1]...), make([]byte, sha256.Size)...)},
+		{"full instead of last", nodes[0]},
+	}
+	for _, tt := range tests {
+		getNode := func(h utils.SHA256) (Metafile, error) {
+			if h == last {
+				return tt.node, nil
+			}
+			return store[h], nil
+		}
+		if err := WalkTree(root, getNode, visit); err == nil {
+			t.Errorf("%s : accepted", tt.name)
+		}
+	}
+}
+
+func TestChunkMapOfPartialTree(t *testing.T) {
+	fs := NewFileStorage()
+	n := 2*constant.MetafileFanout + 88
+	data := make([][]byte, n)
+	chunks := make([]utils.SHA256, n)
+	for i := range data {
+		data[i] = []byte{byte(i), byte(i >> 8)}
+		chunks[i] = sha256.Sum256(data[i])
+	}
+	root, nodes := BuildMetafile(chunks)
+	metahash := sha256.Sum256(root)
+	fs.StoreFile(&File{Name: "f", MetafileHash: metahash}, root)
+	for _, i := range []int{0, constant.MetafileFanout + 4, n - 1} {
+		fs.StoreChunk(&Chunk{Data: data[i], Hash: chunks[i]})
+	}
+	if fs.ChunkCount(metahash) != uint64(n) {
+		t.Fatalf("chunk count %d", fs.ChunkCount(metahash))
+	}
+	// chunks below unknown nodes are left out
+	if m := fs.ChunkMap(metahash); len(m) != 0 {
+		t.Fatalf("chunk map %v without nodes", m)
+	}
+	fs.StoreMetafile(sha256.Sum256(nodes[1]), nodes[1])
+	if m := fs.ChunkMap(metahash); len(m) != 1 || m[0] != uint64(constant.MetafileFanout+5) {
+		t.Fatalf("chunk map %v with the second node", m)
+	}
+	for _, node := range nodes {
+		fs.StoreMetafile(sha256.Sum256(node), node)
+	}
+	if m := fs.ChunkMap(metahash); len(m) != 3 || m[0] != 1 || m[2] != uint64(n) {
+		t.Fatalf("chunk map %v with all the nodes", m)
+	}
+}
@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/vquelque/Peerster/utils"
+)
+
+// PartialFile is a file being downloaded. Each chunk is written at its offset in a
+// temporary file next to the file once verified, and the file is renamed into place once
+// complete. The offset of a chunk is known once the chunks before it are, or right away
+// if the chunks all have the size of the first ones as with fixed size chunking. Until
+// then a chunk received out of order is read back from the chunks of a disk storage, or
+// from a spill file with a memory storage, so that it is not kept in memory.
+type PartialFile struct {
+	file      *os.File
+	spill     *os.File                  //chunks received out of order by a memory storage. nil until needed
+	path      string                    //of the file once complete
+	hashes    []utils.SHA256            //chunks of the file known so far, in order
+	count     uint64                    //chunks of the file
+	written   uint64                    //chunks written at the start of the file
+	end       int64                     //offset of the end of the chunks written
+	chunkSize int                       //of every chunk but the last if they have the same size. 0 until known, -1 if not
+	placed    map[uint64]int            //size of the chunks written at their offset after the ones at the start
+	pending   map[uint64]*chunkLocation //chunks in the spill file waiting for the chunks before them
+	lock      sync.Mutex
+}
+
+// chunkLocation is where a chunk of a downloaded file is read from.
+type chunkLocation struct {
+	partial *PartialFile
+	path    string //temporary file until the download completes
+	offset  int64
+	size    int
+}
+
+// CreatePartial creates the temporary file of the file of count chunks downloaded to path.
+// It is preallocated to size bytes if the size is known, i.e. positive.
+func (fs *FileStorage) CreatePartial(path string, size int64, count uint64) (*PartialFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".download-")
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 {
+		if err := tmp.Truncate(size); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	p := &PartialFile{
+		file:    tmp,
+		path:    path,
+		count:   count,
+		placed:  make(map[uint64]int),
+		pending: make(map[uint64]*chunkLocation),
+	}
+	return p, nil
+}
+
+// AddPartialChunks appends the hashes of the next chunks of the file, and writes the ones
+// already stored.
+func (fs *FileStorage) AddPartialChunks(p *PartialFile, hashes []utils.SHA256) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.hashes = append(p.hashes, hashes...)
+	return fs.flushPartial(p)
+}
+
+// StorePartialChunk stores the verified chunk at index in the file being downloaded. It is
+// served from the file once written, and also persisted by a disk storage so that the
+// download can be resumed.
+func (fs *FileStorage) StorePartialChunk(p *PartialFile, index uint64, c *Chunk) error {
+	if fs.dir != "" {
+		fs.StoreChunk(c)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, placed := p.placed[index]
+	if index < p.written || placed || p.pending[index] != nil {
+		return nil
+	}
+	offset, fixed, err := fs.fixedOffset(p, index, len(c.Data))
+	if err != nil {
+		return err
+	}
+	switch {
+	case index == p.written:
+		if err := fs.appendPartial(p, c.Hash, c.Data); err != nil {
+			return err
+		}
+	case fixed:
+		if _, err := p.file.WriteAt(c.Data, offset); err != nil {
+			return err
+		}
+		fs.locate(p, c.Hash, offset, len(c.Data))
+		p.placed[index] = len(c.Data)
+	case fs.dir == "":
+		// a disk storage reads it back from its chunks
+		if err := spillChunk(p, index, c.Data); err != nil {
+			return err
+		}
+	}
+	return fs.flushPartial(p)
+}
+
+// CompletePartial renames the temporary file into place once every chunk is written.
+func (fs *FileStorage) CompletePartial(p *PartialFile) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := fs.flushPartial(p); err != nil {
+		return err
+	}
+	if p.written < uint64(len(p.hashes)) {
+		return fmt.Errorf("chunk %d (%x) of %s is missing", p.written+1, p.hashes[p.written], p.path)
+	}
+	tmp := p.file.Name()
+	err := p.file.Truncate(p.end)
+	if cerr := p.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	closeSpill(p)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := os.Rename(tmp, p.path); err != nil {
+		return err
+	}
+	for _, l := range fs.located {
+		if l.partial == p {
+			l.path = p.path
+		}
+	}
+	return nil
+}
+
+// AbortPartial removes the temporary file of a download that failed.
+func (fs *FileStorage) AbortPartial(p *PartialFile) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	fs.lock.Lock()
+	for h, l := range fs.located {
+		if l.partial == p {
+			delete(fs.located, h)
+		}
+	}
+	fs.lock.Unlock()
+	p.file.Close()
+	os.Remove(p.file.Name())
+	closeSpill(p)
+	p.placed = make(map[uint64]int)
+	p.pending = make(map[uint64]*chunkLocation)
+}
+
+// flushPartial writes the chunks following the ones already written, as long as they are
+// received or stored. Caller must hold the lock of p, and not the lock of fs.
+func (fs *FileStorage) flushPartial(p *PartialFile) error {
+	for p.written < uint64(len(p.hashes)) {
+		if size, found := p.placed[p.written]; found {
+			delete(p.placed, p.written)
+			p.end += int64(size)
+			p.written++
+			continue
+		}
+		h := p.hashes[p.written]
+		var data []byte
+		if l := p.pending[p.written]; l != nil {
+			data = make([]byte, l.size)
+			if _, err := p.spill.ReadAt(data, l.offset); err != nil {
+				return err
+			}
+		} else {
+			var found bool
+			fs.lock.RLock()
+			data, found = fs.getChunk(h)
+			fs.lock.RUnlock()
+			if !found {
+				return nil
+			}
+		}
+		if _, _, err := fs.fixedOffset(p, p.written, len(data)); err != nil {
+			return err
+		}
+		if err := fs.appendPartial(p, h, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendPartial writes the chunk following the ones already written. Caller must hold the
+// lock of p, and not the lock of fs.
+func (fs *FileStorage) appendPartial(p *PartialFile, hash utils.SHA256, data []byte) error {
+	if _, err := p.file.WriteAt(data, p.end); err != nil {
+		return err
+	}
+	delete(p.pending, p.written)
+	fs.locate(p, hash, p.end, len(data))
+	p.end += int64(len(data))
+	p.written++
+	return nil
+}
+
+// fixedOffset returns the offset of the chunk at index of size bytes if the chunks of the
+// file have a fixed size, learnt from the first chunk that is not the last. Once a chunk
+// shows they do not, the chunks written at their offset are read back as if received out
+// of order. Caller must hold the lock of p, and not the lock of fs.
+func (fs *FileStorage) fixedOffset(p *PartialFile, index uint64, size int) (int64, bool, error) {
+	if p.chunkSize < 0 {
+		return 0, false, nil
+	}
+	last := index+1 == p.count
+	if p.chunkSize == 0 {
+		if last {
+			return 0, index == 0, nil
+		}
+		p.chunkSize = size
+	}
+	if size == p.chunkSize || last && size < p.chunkSize {
+		return int64(index) * int64(p.chunkSize), true, nil
+	}
+	chunkSize := int64(p.chunkSize)
+	p.chunkSize = -1
+	for i, size := range p.placed {
+		offset := int64(i) * chunkSize
+		fs.lock.Lock()
+		if l := fs.located[p.hashes[i]]; l != nil && l.partial == p && l.offset == offset {
+			delete(fs.located, p.hashes[i])
+		}
+		fs.lock.Unlock()
+		if fs.dir != "" {
+			continue
+		}
+		data := make([]byte, size)
+		if _, err := p.file.ReadAt(data, offset); err != nil {
+			return 0, false, err
+		}
+		if err := spillChunk(p, i, data); err != nil {
+			return 0, false, err
+		}
+	}
+	p.placed = make(map[uint64]int)
+	return 0, false, nil
+}
+
+// locate serves the chunk written at offset of the downloaded file, unless it is stored.
+// Caller must hold the lock of p, and not the lock of fs.
+func (fs *FileStorage) locate(p *PartialFile, hash utils.SHA256, offset int64, size int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.hasStoredChunk(hash) && fs.located[hash] == nil {
+		fs.located[hash] = &chunkLocation{partial: p, path: p.file.Name(), offset: offset, size: size}
+	}
+}
+
+// spillChunk appends the chunk at index to the spill file until the chunks before it are
+// written. Caller must hold the lock of p.
+func spillChunk(p *PartialFile, index uint64, data []byte) error {
+	if p.spill == nil {
+		spill, err := ioutil.TempFile(filepath.Dir(p.path), ".download-")
+		if err != nil {
+			return err
+		}
+		p.spill = spill
+	}
+	offset, err := p.spill.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := p.spill.Write(data); err != nil {
+		return err
+	}
+	p.pending[index] = &chunkLocation{offset: offset, size: len(data)}
+	return nil
+}
+
+// closeSpill removes the spill file. Caller must hold the lock of p.
+func closeSpill(p *PartialFile) {
+	if p.spill != nil {
+		p.spill.Close()
+		os.Remove(p.spill.Name())
+		p.spill = nil
+	}
+}
+
+// readLocated reads the chunk from the downloaded file holding it. The chunk is checked
+// against its hash as the file may have been modified. Caller must hold the lock.
+func (fs *FileStorage) readLocated(hash utils.SHA256) ([]byte, bool) {
+	l, found := fs.located[hash]
+	if !found {
+		return nil, false
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	data := make([]byte, l.size)
+	if _, err := f.ReadAt(data, l.offset); err != nil || sha256.Sum256(data) != hash {
+		return nil, false
+	}
+	return data, true
+}
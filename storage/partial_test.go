@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vquelque/Peerster/utils"
+)
+
+// testChunks returns chunks of the sizes, and their hashes.
+func testChunks(sizes ...int) ([][]byte, []utils.SHA256) {
+	data := make([][]byte, len(sizes))
+	hashes := make([]utils.SHA256, len(sizes))
+	for i, size := range sizes {
+		data[i] = bytes.Repeat([]byte{byte('a' + i)}, size)
+		hashes[i] = sha256.Sum256(data[i])
+	}
+	return data, hashes
+}
+
+func TestPartialFileOrders(t *testing.T) {
+	layouts := []struct {
+		name  string
+		sizes []int
+	}{
+		{"single chunk", []int{5}},
+		{"fixed", []int{4, 4, 4, 4, 1}},
+		{"fixed full last chunk", []int{4, 4, 4}},
+		{"variable", []int{4, 2, 6, 3, 1}},
+		{"fixed until the last", []int{4, 4, 4, 4, 9}},
+		{"fixed until the middle", []int{4, 4, 7, 4, 4}},
+	}
+	orders := []struct {
+		name  string
+		order func(n int) []int
+	}{
+		{"in order", func(n int) []int {
+			o := make([]int, n)
+			for i := range o {
+				o[i] = i
+			}
+			return o
+		}},
+		{"reversed", func(n int) []int {
+			o := make([]int, n)
+			for i := range o {
+				o[i] = n - 1 - i
+			}
+			return o
+		}},
+		{"odd first", func(n int) []int {
+			o := make([]int, 0, n)
+			for i := 1; i < n; i += 2 {
+				o = append(o, i)
+			}
+			for i := 0; i < n; i += 2 {
+				o = append(o, i)
+			}
+			return o
+		}},
+	}
+	for _, disk := range []bool{false, true} {
+		for _, l := range layouts {
+			for _, o := range orders {
+				name := l.name + " " + o.name
+				dir := t.TempDir()
+				fs := NewFileStorage()
+				if disk {
+					name += " on disk"
+					fs, _ = NewDiskFileStorage(filepath.Join(dir, "data"), false)
+				}
+				data, hashes := testChunks(l.sizes...)
+				out := filepath.Join(dir, "sub", "f")
+				p, err := fs.CreatePartial(out, -1, uint64(len(data)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				fs.AddPartialChunks(p, hashes)
+				for _, i := range o.order(len(data)) {
+					if err := fs.StorePartialChunk(p, uint64(i), &Chunk{Data: data[i], Hash: hashes[i]}); err != nil {
+						t.Fatalf("%s : %v", name, err)
+					}
+					if !bytes.Equal(fs.GetChunkOrMeta(hashes[0]), data[0]) && p.written > 0 {
+						t.Fatalf("%s : first chunk not served", name)
+					}
+				}
+				if len(fs.chunks) != 0 {
+					t.Fatalf("%s : chunks kept in memory", name)
+				}
+				if err := fs.CompletePartial(p); err != nil {
+					t.Fatalf("%s : %v", name, err)
+				}
+				got, _ := ioutil.ReadFile(out)
+				if !bytes.Equal(got, bytes.Join(data, nil)) {
+					t.Fatalf("%s : content %q", name, got)
+				}
+				for i := range data {
+					if !bytes.Equal(fs.GetChunkOrMeta(hashes[i]), data[i]) {
+						t.Fatalf("%s : chunk %d not served", name, i)
+					}
+				}
+				if entries, _ := ioutil.ReadDir(filepath.Dir(out)); len(entries) != 1 {
+					t.Fatalf("%s : %d files left", name, len(entries))
+				}
+			}
+		}
+	}
+}
+
+func TestPartialFileMissingAndAborted(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFileStorage()
+	data, hashes := testChunks(4, 2, 4, 6, 1)
+	out := filepath.Join(dir, "f")
+	p, _ := fs.CreatePartial(out, 100, uint64(len(data)))
+	fs.AddPartialChunks(p, hashes[:3])
+	// chunk 1 is first written where it would be if every chunk had its size
+	fs.StorePartialChunk(p, 1, &Chunk{Data: data[1], Hash: hashes[1]})
+	fs.StorePartialChunk(p, 0, &Chunk{Data: data[0], Hash: hashes[0]})
+	if !bytes.Equal(fs.GetChunkOrMeta(hashes[1]), data[1]) {
+		t.Fatal("not served from the partial file")
+	}
+	fs.AddPartialChunks(p, hashes[3:])
+	fs.StorePartialChunk(p, 4, &Chunk{Data: data[4], Hash: hashes[4]})
+	if err := fs.CompletePartial(p); err == nil {
+		t.Fatal("completed with missing chunks")
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Fatal("renamed before completion")
+	}
+	fs.AbortPartial(p)
+	if fs.GetChunkOrMeta(hashes[0]) != nil {
+		t.Fatal("served after abort")
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("%d files left", len(entries))
+	}
+}
+
+func TestPartialFileModified(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFileStorage()
+	data, hashes := testChunks(3, 3)
+	out := filepath.Join(dir, "f")
+	p, _ := fs.CreatePartial(out, -1, 2)
+	fs.AddPartialChunks(p, hashes)
+	fs.StorePartialChunk(p, 1, &Chunk{Data: data[1], Hash: hashes[1]})
+	fs.StorePartialChunk(p, 0, &Chunk{Data: data[0], Hash: hashes[0]})
+	if err := fs.CompletePartial(p); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(out, []byte("xxxxxx"), 0644)
+	if fs.GetChunkOrMeta(hashes[1]) != nil {
+		t.Fatal("served a modified chunk")
+	}
+}
@@ -1,6 +1,9 @@
 package storage
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
 	"sync"
 
 	"github.com/vquelque/Peerster/message"
@@ -8,15 +11,94 @@ import (
 
 type PrivateStorage struct {
 	messages map[string][]*message.PrivateMessage
+	received map[string]map[uint32]*message.PrivateMessage //origin -> messages already delivered by ID
+	nextID   map[string]uint32                             //destination -> ID of the last message we sent
+	path     string                                        //persists nextID. Kept in memory if empty
 	lock     sync.RWMutex
 }
 
-func NewPrivateStorage() *PrivateStorage {
+// NewPrivateStorage creates a private storage whose message IDs are persisted in path, so
+// that a restarted gossiper does not reuse the IDs its peers already received. The IDs
+// are kept in memory if path is empty.
+func NewPrivateStorage(path string) (*PrivateStorage, error) {
 	st := &PrivateStorage{
 		messages: make(map[string][]*message.PrivateMessage),
+		received: make(map[string]map[uint32]*message.PrivateMessage),
+		nextID:   make(map[string]uint32),
+		path:     path,
 		lock:     sync.RWMutex{},
 	}
-	return st
+	if path == "" {
+		return st, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &st.nextID); err != nil {
+		storageLog.Warnf("Ignoring corrupted private message IDs in %s : %v", path, err)
+		st.nextID = make(map[string]uint32)
+	}
+	return st, nil
+}
+
+// NextID returns the ID of the next private message sent to dest. IDs start at 1.
+func (storage *PrivateStorage) NextID(dest string) uint32 {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	storage.nextID[dest]++
+	if storage.path != "" {
+		data, _ := json.Marshal(storage.nextID)
+		if err := writeFileAtomic(storage.path, data); err != nil {
+			storageLog.Errorf("%v", err)
+		}
+	}
+	return storage.nextID[dest]
+}
+
+// StoreIfNew stores a received private message unless a message with the same
+// origin and ID was already stored. Returns false for duplicates, with conflict set
+// if the message stored with this ID has another text.
+func (storage *PrivateStorage) StoreIfNew(msg *message.PrivateMessage, peer string) (stored bool, conflict bool) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	ids, found := storage.received[peer]
+	if !found {
+		ids = make(map[uint32]*message.PrivateMessage)
+		storage.received[peer] = ids
+	}
+	if previous, found := ids[msg.ID]; found {
+		return false, previous.Text != msg.Text
+	}
+	ids[msg.ID] = msg
+	storage.messages[peer] = append(storage.messages[peer], msg)
+	return true, false
+}
+
+// Restore stores a private message of the conversation with peer replayed from the
+// history. sent tells if we are the origin of the message.
+func (storage *PrivateStorage) Restore(msg *message.PrivateMessage, peer string, sent bool) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	storage.messages[peer] = append(storage.messages[peer], msg)
+	if msg.ID == 0 {
+		return
+	}
+	if sent {
+		if msg.ID > storage.nextID[peer] {
+			storage.nextID[peer] = msg.ID
+		}
+		return
+	}
+	ids, found := storage.received[peer]
+	if !found {
+		ids = make(map[uint32]*message.PrivateMessage)
+		storage.received[peer] = ids
+	}
+	ids[msg.ID] = msg
 }
 
 // Store private message to storage
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/vquelque/Peerster/message"
+)
+
+func TestPrivateIDsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "A.private")
+	ps, err := NewPrivateStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := uint32(1); want <= 3; want++ {
+		if id := ps.NextID("B"); id != want {
+			t.Fatalf("ID %d, want %d", id, want)
+		}
+	}
+	ps.NextID("C")
+	restarted, err := NewPrivateStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := restarted.NextID("B"); id != 4 {
+		t.Fatalf("ID %d after restart, want 4", id)
+	}
+	if id := restarted.NextID("C"); id != 2 {
+		t.Fatalf("ID %d after restart, want 2", id)
+	}
+	if id := restarted.NextID("D"); id != 1 {
+		t.Fatalf("ID %d for a new destination, want 1", id)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if corrupted, err := NewPrivateStorage(path); err != nil || corrupted.NextID("B") != 1 {
+		t.Fatalf("corrupted IDs not ignored : %v", err)
+	}
+}
+
+func TestPrivateStoreIfNew(t *testing.T) {
+	tests := []struct {
+		id       uint32
+		text     string
+		stored   bool
+		conflict bool
+	}{
+		{1, "hello", true, false},
+		{1, "hello", false, false}, //retransmission
+		{2, "world", true, false},
+		{1, "reused", false, true},
+		{2, "world", false, false},
+		{3, "hello", true, false},
+	}
+	ps, err := NewPrivateStorage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		msg := &message.PrivateMessage{Origin: "B", Destination: "A", ID: tt.id, Text: tt.text}
+		stored, conflict := ps.StoreIfNew(msg, "B")
+		if stored != tt.stored || conflict != tt.conflict {
+			t.Fatalf("message %d %q : stored %v conflict %v", tt.id, tt.text, stored, conflict)
+		}
+	}
+	if n := len(ps.messages["B"]); n != 3 {
+		t.Fatalf("%d messages stored, want 3", n)
+	}
+}
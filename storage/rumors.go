@@ -10,6 +10,7 @@ import (
 type RumorStorage struct {
 	// use a map to store the previous rumors. Key corresponds to peer origin.
 	// value is a slice with all rumors for a given peer with IDs starting at 0.
+	// nil for the rumors skipped, see Skip
 	rumors      map[string][]*message.RumorPacket
 	rumor_order []string //append the name of the origin when the rumors arrive.
 	// allows the client to retrieve rumors in order
@@ -39,6 +40,18 @@ func (storage *RumorStorage) Store(pkt *message.RumorPacket) {
 	}
 }
 
+// Skip marks the rumors of origin before id as missing, like the route rumors not kept
+// by the history. They are never returned by Get, so that the next ones can be stored.
+func (storage *RumorStorage) Skip(origin string, id uint32) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	archive := storage.rumors[origin]
+	for uint32(len(archive)+1) < id {
+		archive = append(archive, nil)
+	}
+	storage.rumors[origin] = archive
+}
+
 // GetRumor gets the rumor from storage
 func (storage *RumorStorage) Get(peer string, ID uint32) *message.RumorPacket {
 	storage.lock.RLock()
@@ -68,6 +81,9 @@ func (storage *RumorStorage) GetAll() []message.RumorPacket {
 	rID := make(map[string]int, len(storage.rumor_order))
 	rumors := make([]message.RumorPacket, 0)
 	for _, sender := range storage.rumor_order {
+		for storage.rumors[sender][rID[sender]] == nil {
+			rID[sender]++
+		}
 		rumors = append(rumors, *storage.rumors[sender][rID[sender]])
 		rID[sender]++
 	}
@@ -53,7 +53,7 @@ func (sr *SearchResults) AddSearchResult(r *message.SearchResult, origin string)
 	metahash := utils.SliceToHash(r.MetafileHash)
 	_, found := sr.results[metahash]
 	if !found {
-		sr.results[metahash] = make(map[uint64][]string, r.ChunkCount)
+		sr.results[metahash] = make(map[uint64][]string)
 	}
 	for _, ch := range r.ChunkMap {
 		c := ch - 1
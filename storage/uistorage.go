@@ -14,8 +14,22 @@ type RumorUIStorage struct {
 	Lock   sync.RWMutex
 }
 
+// Delivery status of the private messages we sent
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// UIPrivateMessage is a private message with its delivery status. Status is
+// empty for received messages.
+type UIPrivateMessage struct {
+	message.PrivateMessage
+	Status string
+}
+
 type PrivateUIStorage struct {
-	PrivateMsg map[string][]message.PrivateMessage
+	PrivateMsg map[string][]UIPrivateMessage
 	Lock       sync.RWMutex
 }
 
@@ -24,6 +38,17 @@ type DownloadableFiles struct {
 	Lock         sync.RWMutex
 }
 
+type DownloadProgress struct {
+	Filename   string
+	Downloaded uint64 //number of chunks already stored
+	Total      uint64
+}
+
+type DownloadsUIStorage struct {
+	Progress map[string]*DownloadProgress //hex metahash -> progress
+	Lock     sync.RWMutex
+}
+
 type BlockchainUIStorage struct {
 	ConfirmedRumors []*message.TLCMessage
 	ProofForRound   []string
@@ -36,42 +61,71 @@ type UIStorage struct {
 	PrivateUIStorage    *PrivateUIStorage
 	DownloadableFiles   *DownloadableFiles
 	BlockchainUIStorage *BlockchainUIStorage
+	DownloadsUIStorage  *DownloadsUIStorage
 }
 
 func NewUIStorage() *UIStorage {
 	rumorStorage := &RumorUIStorage{Rumors: make([]*message.RumorMessage, 0), Lock: sync.RWMutex{}}
-	privateStorage := &PrivateUIStorage{PrivateMsg: make(map[string][]message.PrivateMessage, 0), Lock: sync.RWMutex{}}
+	privateStorage := &PrivateUIStorage{PrivateMsg: make(map[string][]UIPrivateMessage, 0), Lock: sync.RWMutex{}}
 	downloadableFiles := &DownloadableFiles{Downloadable: make(map[string]string, 0), Lock: sync.RWMutex{}}
 	blockchainUIStorage := &BlockchainUIStorage{ConfirmedRumors: make([]*message.TLCMessage, 0), ProofForRound: make([]string, 0)}
-	return &UIStorage{RumorUIStorage: rumorStorage, PrivateUIStorage: privateStorage, DownloadableFiles: downloadableFiles, BlockchainUIStorage: blockchainUIStorage}
+	downloadsUIStorage := &DownloadsUIStorage{Progress: make(map[string]*DownloadProgress)}
+	return &UIStorage{RumorUIStorage: rumorStorage, PrivateUIStorage: privateStorage, DownloadableFiles: downloadableFiles, BlockchainUIStorage: blockchainUIStorage, DownloadsUIStorage: downloadsUIStorage}
 }
 
 func (sto *UIStorage) AppendRumorAsync(rumor *message.RumorMessage) {
 	//append rumor if ui not reading => does not block main map
-	go func() {
-		sto.RumorUIStorage.Lock.Lock()
-		defer sto.RumorUIStorage.Lock.Unlock()
-		sto.RumorUIStorage.Rumors = append(sto.RumorUIStorage.Rumors, rumor)
-	}()
+	go sto.AppendRumor(rumor)
+}
+
+func (sto *UIStorage) AppendRumor(rumor *message.RumorMessage) {
+	sto.RumorUIStorage.Lock.Lock()
+	defer sto.RumorUIStorage.Lock.Unlock()
+	sto.RumorUIStorage.Rumors = append(sto.RumorUIStorage.Rumors, rumor)
 }
 
 func (sto *UIStorage) AppendConfirmedRumorAsync(tlc *message.TLCMessage) {
 	//append rumor if ui not reading => does not block main map
-	go func() {
-		sto.BlockchainUIStorage.Lock.Lock()
-		defer sto.BlockchainUIStorage.Lock.Unlock()
-		sto.BlockchainUIStorage.ConfirmedRumors = append(sto.BlockchainUIStorage.ConfirmedRumors, tlc)
-	}()
+	go sto.AppendConfirmedRumor(tlc)
+}
+
+func (sto *UIStorage) AppendConfirmedRumor(tlc *message.TLCMessage) {
+	sto.BlockchainUIStorage.Lock.Lock()
+	defer sto.BlockchainUIStorage.Lock.Unlock()
+	sto.BlockchainUIStorage.ConfirmedRumors = append(sto.BlockchainUIStorage.ConfirmedRumors, tlc)
 }
 
 func (sto *UIStorage) StorePrivateMsgAsync(msg *message.PrivateMessage, peer string) {
-	go func() {
-		sto.PrivateUIStorage.Lock.Lock()
-		defer sto.PrivateUIStorage.Lock.Unlock()
-		archive := sto.PrivateUIStorage.PrivateMsg[peer]
-		archive = append(archive, *msg)
-		sto.PrivateUIStorage.PrivateMsg[peer] = archive
-	}()
+	go sto.StorePrivateMsg(msg, peer)
+}
+
+func (sto *UIStorage) StorePrivateMsg(msg *message.PrivateMessage, peer string) {
+	sto.PrivateUIStorage.Lock.Lock()
+	defer sto.PrivateUIStorage.Lock.Unlock()
+	archive := sto.PrivateUIStorage.PrivateMsg[peer]
+	archive = append(archive, UIPrivateMessage{PrivateMessage: *msg})
+	sto.PrivateUIStorage.PrivateMsg[peer] = archive
+}
+
+// StoreSentPrivateMsg stores a private message we sent to peer as pending
+func (sto *UIStorage) StoreSentPrivateMsg(msg *message.PrivateMessage, peer string) {
+	sto.PrivateUIStorage.Lock.Lock()
+	defer sto.PrivateUIStorage.Lock.Unlock()
+	archive := sto.PrivateUIStorage.PrivateMsg[peer]
+	archive = append(archive, UIPrivateMessage{PrivateMessage: *msg, Status: DeliveryPending})
+	sto.PrivateUIStorage.PrivateMsg[peer] = archive
+}
+
+// SetPrivateMsgStatus updates the delivery status of the message id sent to peer
+func (sto *UIStorage) SetPrivateMsgStatus(peer string, id uint32, status string) {
+	sto.PrivateUIStorage.Lock.Lock()
+	defer sto.PrivateUIStorage.Lock.Unlock()
+	archive := sto.PrivateUIStorage.PrivateMsg[peer]
+	for i := range archive {
+		if archive[i].ID == id && archive[i].Status != "" {
+			archive[i].Status = status
+		}
+	}
 }
 
 // GetAllRumors return all the rumors in the order they were added.
@@ -81,7 +135,7 @@ func (sto *UIStorage) GetAllRumors() []*message.RumorMessage {
 	return sto.RumorUIStorage.Rumors
 }
 
-func (sto *UIStorage) GetPrivateMessagesForPeer(peer string) []message.PrivateMessage {
+func (sto *UIStorage) GetPrivateMessagesForPeer(peer string) []UIPrivateMessage {
 	sto.PrivateUIStorage.Lock.RLock()
 	defer sto.PrivateUIStorage.Lock.RUnlock()
 	archive, _ := sto.PrivateUIStorage.PrivateMsg[peer]
@@ -111,3 +165,10 @@ func (sto *UIStorage) AppendProofsForRoundAsync(proofs []*message.TLCMessage, rN
 		}
 	}()
 }
+
+// UpdateDownloadProgress sets the number of chunks downloaded for the file
+func (sto *UIStorage) UpdateDownloadProgress(metahash utils.SHA256, filename string, downloaded uint64, total uint64) {
+	sto.DownloadsUIStorage.Lock.Lock()
+	defer sto.DownloadsUIStorage.Lock.Unlock()
+	sto.DownloadsUIStorage.Progress[fmt.Sprintf("%x", metahash)] = &DownloadProgress{Filename: filename, Downloaded: downloaded, Total: total}
+}
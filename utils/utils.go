@@ -3,21 +3,14 @@ package utils
 import (
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
+	"sync"
 )
 
 type SHA256 = [32]byte
 
-type AdditionalFlags struct {
-	HW3ex2          bool
-	HW3ex3          bool
-	HW3ex4          bool
-	PeersNumber     uint64
-	StubbornTimeout int
-	AckAll          bool
-}
-
 // MapToUDP converts the given array of string addresses to an array of UDP addresses.
 func MapToUDP(vs []string) *[]net.UDPAddr {
 	vsm := make([]net.UDPAddr, len(vs))
@@ -62,6 +55,35 @@ func CopyFile(src, dst string) (int64, error) {
 	return nBytes, err
 }
 
+// NewRand returns a source of random numbers seeded with seed that can be used by several
+// goroutines, like the functions of math/rand.
+func NewRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+type lockedSource struct {
+	src  rand.Source64
+	lock sync.Mutex
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.src.Seed(seed)
+}
+
 func SliceToHash(hash []byte) SHA256 {
 	var h SHA256
 	copy(h[:], hash)
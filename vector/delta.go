@@ -0,0 +1,127 @@
+package vector
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/vquelque/Peerster/message"
+)
+
+// Deltas encodes the status packets sent to each neighbor relative to the last one sent
+// to it, and decodes the ones received relative to the last one received. Once in sync,
+// a status packet only carries the digests of the vectors.
+type Deltas struct {
+	sent     map[string]*statusVector //neighbor -> last vector sent
+	received map[string]*statusVector //neighbor -> last vector received
+	lock     sync.Mutex
+}
+
+type statusVector struct {
+	want   map[string]uint32
+	digest []byte
+}
+
+// NewDeltas returns an encoder without any status exchanged.
+func NewDeltas() *Deltas {
+	return &Deltas{sent: make(map[string]*statusVector), received: make(map[string]*statusVector)}
+}
+
+// Encode returns the status packet sp to send to neighbor, relative to the last one sent
+// to it. The first status packet sent to a neighbor is full.
+func (d *Deltas) Encode(neighbor string, sp *message.StatusPacket) *message.StatusPacket {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	current := newStatusVector(sp.Want)
+	last, found := d.sent[neighbor]
+	d.sent[neighbor] = current
+	if !found {
+		return sp
+	}
+	delta := make([]message.PeerStatus, 0)
+	for origin, next := range current.want {
+		if last.want[origin] != next {
+			delta = append(delta, message.PeerStatus{Identifier: origin, NextID: next})
+		}
+	}
+	for origin := range last.want {
+		if _, found := current.want[origin]; !found {
+			// origins are never forgotten by a vector clock : cannot be encoded as a delta
+			return sp
+		}
+	}
+	encoded := *sp
+	encoded.Want = delta
+	encoded.Delta = true
+	encoded.Base = last.digest
+	encoded.Digest = current.digest
+	return &encoded
+}
+
+// Decode returns the whole status packet of neighbor encoded by sp. Returns false if sp
+// is relative to a vector that was not received, or does not match its digest.
+func (d *Deltas) Decode(neighbor string, sp *message.StatusPacket) (*message.StatusPacket, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !sp.Delta {
+		d.received[neighbor] = newStatusVector(sp.Want)
+		return sp, true
+	}
+	last, found := d.received[neighbor]
+	if !found || !bytes.Equal(last.digest, sp.Base) {
+		return nil, false
+	}
+	want := make(map[string]uint32, len(last.want)+len(sp.Want))
+	for origin, next := range last.want {
+		want[origin] = next
+	}
+	for _, ps := range sp.Want {
+		want[ps.Identifier] = ps.NextID
+	}
+	current := &statusVector{want: want, digest: digest(want)}
+	if !bytes.Equal(current.digest, sp.Digest) {
+		return nil, false
+	}
+	d.received[neighbor] = current
+	decoded := *sp
+	decoded.Want = make([]message.PeerStatus, 0, len(want))
+	for origin, next := range want {
+		decoded.Want = append(decoded.Want, message.PeerStatus{Identifier: origin, NextID: next})
+	}
+	decoded.Delta, decoded.Base, decoded.Digest = false, nil, nil
+	return &decoded, true
+}
+
+// Reset forgets the vector last sent to neighbor : the next status packet sent to it is
+// full.
+func (d *Deltas) Reset(neighbor string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.sent, neighbor)
+}
+
+func newStatusVector(statuses []message.PeerStatus) *statusVector {
+	want := make(map[string]uint32, len(statuses))
+	for _, ps := range statuses {
+		want[ps.Identifier] = ps.NextID
+	}
+	return &statusVector{want: want, digest: digest(want)}
+}
+
+// digest hashes the vector in the order of the origins.
+func digest(want map[string]uint32) []byte {
+	origins := make([]string, 0, len(want))
+	for origin := range want {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	h := sha256.New()
+	for _, origin := range origins {
+		binary.Write(h, binary.LittleEndian, uint32(len(origin)))
+		h.Write([]byte(origin))
+		binary.Write(h, binary.LittleEndian, want[origin])
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,160 @@
+package vector
+
+import (
+	"testing"
+
+	"github.com/vquelque/Peerster/message"
+)
+
+func statusOf(want map[string]uint32) *message.StatusPacket {
+	sp := &message.StatusPacket{Want: make([]message.PeerStatus, 0, len(want))}
+	for origin, next := range want {
+		sp.Want = append(sp.Want, message.PeerStatus{Identifier: origin, NextID: next})
+	}
+	return sp
+}
+
+func wantOf(sp *message.StatusPacket) map[string]uint32 {
+	want := make(map[string]uint32, len(sp.Want))
+	for _, ps := range sp.Want {
+		want[ps.Identifier] = ps.NextID
+	}
+	return want
+}
+
+func sameVector(a map[string]uint32, b map[string]uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for origin, next := range a {
+		if n, found := b[origin]; !found || n != next {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDeltaEncoding(t *testing.T) {
+	type step struct {
+		want  map[string]uint32
+		delta bool //encoded as a delta
+		sent  int  //entries carried
+		lost  bool
+		ok    bool //decoded by the receiver
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"first full then digests", []step{
+			{map[string]uint32{"A": 2, "B": 5}, false, 2, false, true},
+			{map[string]uint32{"A": 2, "B": 5}, true, 0, false, true},
+			{map[string]uint32{"A": 2, "B": 5}, true, 0, false, true},
+		}},
+		{"changed and new origins only", []step{
+			{map[string]uint32{"A": 2, "B": 5, "C": 1}, false, 3, false, true},
+			{map[string]uint32{"A": 3, "B": 5, "C": 1, "D": 2}, true, 2, false, true},
+			{map[string]uint32{"A": 3, "B": 6, "C": 1, "D": 2}, true, 1, false, true},
+		}},
+		{"forgotten origin sent full", []step{
+			{map[string]uint32{"A": 2, "B": 5}, false, 2, false, true},
+			{map[string]uint32{"A": 2}, false, 1, false, true},
+			{map[string]uint32{"A": 3}, true, 1, false, true},
+		}},
+		{"lost delta breaks the next ones", []step{
+			{map[string]uint32{"A": 2}, false, 1, false, true},
+			{map[string]uint32{"A": 3}, true, 1, true, false},
+			{map[string]uint32{"A": 4}, true, 1, false, false},
+			{map[string]uint32{"A": 4}, true, 0, false, false},
+		}},
+		{"lost full packet", []step{
+			{map[string]uint32{"A": 2}, false, 1, true, false},
+			{map[string]uint32{"A": 2}, true, 0, false, false},
+		}},
+	}
+	for _, tt := range tests {
+		sender, receiver := NewDeltas(), NewDeltas()
+		for i, s := range tt.steps {
+			sp := sender.Encode("R", statusOf(s.want))
+			if sp.Delta != s.delta || len(sp.Want) != s.sent {
+				t.Fatalf("%s, step %d : delta %v with %d entries", tt.name, i, sp.Delta, len(sp.Want))
+			}
+			if s.lost {
+				continue
+			}
+			full, ok := receiver.Decode("S", sp)
+			if ok != s.ok {
+				t.Fatalf("%s, step %d : decoded %v", tt.name, i, ok)
+			}
+			if ok && (full.Delta || !sameVector(wantOf(full), s.want)) {
+				t.Fatalf("%s, step %d : decoded %v", tt.name, i, full.Want)
+			}
+		}
+	}
+}
+
+func TestDeltaRejectsInconsistentPackets(t *testing.T) {
+	base := map[string]uint32{"A": 2, "B": 5, "C": 1}
+	next := map[string]uint32{"A": 3, "B": 7, "C": 1, "D": 1}
+	tests := []struct {
+		name   string
+		modify func(sp *message.StatusPacket)
+	}{
+		{"truncated", func(sp *message.StatusPacket) { sp.Want = sp.Want[:len(sp.Want)-1] }},
+		{"empty", func(sp *message.StatusPacket) { sp.Want = nil }},
+		{"extra entry", func(sp *message.StatusPacket) {
+			sp.Want = append(sp.Want, message.PeerStatus{Identifier: "E", NextID: 2})
+		}},
+		{"altered entry", func(sp *message.StatusPacket) { sp.Want[0].NextID++ }},
+		{"other base", func(sp *message.StatusPacket) { sp.Base = digest(next) }},
+		{"missing base", func(sp *message.StatusPacket) { sp.Base = nil }},
+		{"truncated digest", func(sp *message.StatusPacket) { sp.Digest = sp.Digest[:16] }},
+		{"missing digest", func(sp *message.StatusPacket) { sp.Digest = nil }},
+	}
+	for _, tt := range tests {
+		sender, receiver := NewDeltas(), NewDeltas()
+		if _, ok := receiver.Decode("S", sender.Encode("R", statusOf(base))); !ok {
+			t.Fatalf("%s : full packet not decoded", tt.name)
+		}
+		sp := sender.Encode("R", statusOf(next))
+		if !sp.Delta || len(sp.Want) != 3 {
+			t.Fatalf("%s : delta of %d entries", tt.name, len(sp.Want))
+		}
+		tt.modify(sp)
+		if _, ok := receiver.Decode("S", sp); ok {
+			t.Fatalf("%s : decoded", tt.name)
+		}
+		// the receiver asks for the whole vector : the sender starts again from a full packet
+		sender.Reset("R")
+		sp = sender.Encode("R", statusOf(next))
+		if full, ok := receiver.Decode("S", sp); sp.Delta || !ok || !sameVector(wantOf(full), next) {
+			t.Fatalf("%s : not resynchronized", tt.name)
+		}
+		next["A"]++
+		if full, ok := receiver.Decode("S", sender.Encode("R", statusOf(next))); !ok || !sameVector(wantOf(full), next) {
+			t.Fatalf("%s : delta after the resynchronization not decoded", tt.name)
+		}
+		next["A"]--
+	}
+}
+
+func TestDeltaNeighborsApart(t *testing.T) {
+	d := NewDeltas()
+	want := map[string]uint32{"A": 2}
+	if d.Encode("R1", statusOf(want)).Delta || d.Encode("R2", statusOf(want)).Delta {
+		t.Fatal("first packet of a neighbor encoded as a delta")
+	}
+	d.Reset("R1")
+	if d.Encode("R1", statusOf(want)).Delta || !d.Encode("R2", statusOf(want)).Delta {
+		t.Fatal("reset of another neighbor")
+	}
+	// a delta from a neighbor is never decoded against the vector of another one
+	sender := NewDeltas()
+	if _, ok := d.Decode("S1", sender.Encode("R", statusOf(want))); !ok {
+		t.Fatal("full packet not decoded")
+	}
+	want["A"]++
+	if _, ok := d.Decode("S2", sender.Encode("R", statusOf(want))); ok {
+		t.Fatal("delta decoded against the vector of another neighbor")
+	}
+}